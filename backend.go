@@ -0,0 +1,97 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"io"
+)
+
+type (
+	// Backend runs the commands built by this package. Execute runs a
+	// command for its effect, Run returns its output and ExecuteStdin feeds
+	// it input, as `ipvsadm -R` needs.
+	Backend interface {
+		Execute(ctx context.Context, exe string, args ...string) error
+		Run(ctx context.Context, args []string) ([]byte, error)
+		ExecuteStdin(ctx context.Context, in, exe string, args ...string) error
+	}
+
+	// StreamBackend is a Backend that can pass a command's output on while
+	// the command runs, which Save uses to read large tables. Backends
+	// without it have their Run output passed on once the command is done.
+	StreamBackend interface {
+		Backend
+		Stream(ctx context.Context, args []string, out func(io.Reader) error) error
+	}
+
+	// OutputBackend is a Backend that also returns what the commands it runs
+	// for their effect printed, such as the lines `ipvsadm -R` reports and
+	// carries on past. Backends without it print nothing for them.
+	OutputBackend interface {
+		Backend
+		ExecuteOutput(ctx context.Context, exe string, args ...string) ([]byte, error)
+		ExecuteStdinOutput(ctx context.Context, in, exe string, args ...string) ([]byte, error)
+	}
+
+	// ExecBackend runs commands on the host, it is the default backend.
+	ExecBackend struct{}
+)
+
+// SetBackend replaces the backend every operation runs its commands through.
+func SetBackend(b Backend) {
+	backend, backendRun, backendStdin = b.Execute, b.Run, b.ExecuteStdin
+	backendStream, backendStdinOutput = nil, nil
+	if s, ok := b.(StreamBackend); ok {
+		backendStream = s.Stream
+	}
+	if o, ok := b.(OutputBackend); ok {
+		backendStdinOutput = o.ExecuteStdinOutput
+	}
+}
+
+// executeOutputOf runs the command through b, with its output if b is an
+// OutputBackend.
+func executeOutputOf(b Backend, ctx context.Context, exe string, args ...string) ([]byte, error) {
+	if o, ok := b.(OutputBackend); ok {
+		return o.ExecuteOutput(ctx, exe, args...)
+	}
+	return nil, b.Execute(ctx, exe, args...)
+}
+
+// executeStdinOutputOf feeds in to the command through b, with its output if
+// b is an OutputBackend.
+func executeStdinOutputOf(b Backend, ctx context.Context, in, exe string, args ...string) ([]byte, error) {
+	if o, ok := b.(OutputBackend); ok {
+		return o.ExecuteStdinOutput(ctx, in, exe, args...)
+	}
+	return nil, b.ExecuteStdin(ctx, in, exe, args...)
+}
+
+func (ExecBackend) Execute(ctx context.Context, exe string, args ...string) error {
+	return execute(ctx, exe, args...)
+}
+
+func (ExecBackend) Run(ctx context.Context, args []string) ([]byte, error) {
+	return run(ctx, args)
+}
+
+func (ExecBackend) ExecuteStdin(ctx context.Context, in, exe string, args ...string) error {
+	return executeStdin(ctx, in, exe, args...)
+}
+
+func (ExecBackend) ExecuteOutput(ctx context.Context, exe string, args ...string) ([]byte, error) {
+	return executeOutput(ctx, exe, args...)
+}
+
+func (ExecBackend) ExecuteStdinOutput(ctx context.Context, in, exe string, args ...string) ([]byte, error) {
+	return executeStdinOutput(ctx, in, exe, args...)
+}
+
+func (ExecBackend) Stream(ctx context.Context, args []string, out func(io.Reader) error) error {
+	return stream(ctx, args, out)
+}
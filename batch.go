@@ -0,0 +1,335 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+type (
+	// Batch collects service and server operations and runs them all in a
+	// single `ipvsadm -R`, updating the Ipvs it came from for every
+	// operation that succeeds.
+	Batch struct {
+		ipvs       *Ipvs
+		operations []batchOperation
+	}
+
+	batchOperation struct {
+		lines []string
+		apply func(i *Ipvs)
+		// done reports whether the table read back after the restore shows
+		// the operation, before is the Ipvs as the operations queued ahead
+		// of it left it
+		done func(before, table Ipvs) bool
+		// what the operation changes: the service, its options, the
+		// servers given or all of its servers
+		service    string
+		options    bool
+		servers    []string
+		allServers bool
+	}
+)
+
+// Batch returns an empty batch of operations on i.
+func (i *Ipvs) Batch() *Batch {
+	return &Batch{ipvs: i}
+}
+
+func NewBatch() *Batch {
+	return DefaultIpvs.Batch()
+}
+
+// Len returns how many operations are queued.
+func (b *Batch) Len() int {
+	return len(b.operations)
+}
+
+func (b *Batch) AddService(service Service) error {
+	err := service.Validate()
+	if err != nil {
+		return err
+	}
+	lines := []string{serviceLine("-A", service)}
+	for i := range service.Servers {
+		lines = append(lines, serverLine("-a", service, service.Servers[i].String()))
+	}
+	servers := make([]string, 0, len(service.Servers))
+	for _, server := range service.Servers {
+		servers = append(servers, serverKey(server.Host, server.Port))
+	}
+	b.queue(batchOperation{
+		lines: lines,
+		apply: func(i *Ipvs) {
+			if i.findService(service.Type, service.getHost(), service.Port) == -1 {
+				i.appendService(service)
+			}
+		},
+		done: func(before, table Ipvs) bool {
+			return before.FindService(service.Type, service.getHost(), service.Port) == nil && tableShows(table, service, true, service.Servers...)
+		},
+		service: serviceKey(service.Type, service.getHost(), service.Port),
+		options: true,
+		servers: servers,
+	})
+	return nil
+}
+
+func (b *Batch) EditService(service Service) error {
+	err := service.Validate()
+	if err != nil {
+		return err
+	}
+	b.queue(batchOperation{
+		lines: []string{serviceLine("-E", service)},
+		apply: func(i *Ipvs) {
+			if j := i.findService(service.Type, service.getHost(), service.Port); j != -1 {
+				service.reindex()
+				i.Services[j] = service
+			}
+		},
+		done: func(before, table Ipvs) bool {
+			return before.FindService(service.Type, service.getHost(), service.Port) != nil && tableShows(table, service, true)
+		},
+		service: serviceKey(service.Type, service.getHost(), service.Port),
+		options: true,
+	})
+	return nil
+}
+
+func (b *Batch) RemoveService(netType, host string, port int) {
+	service := Service{Type: netType, Host: host, Port: port}
+	b.queue(batchOperation{
+		lines: []string{"-D " + ServiceTypeFlag[netType] + " " + service.getHostPort()},
+		apply: func(i *Ipvs) {
+			if j := i.findService(netType, host, port); j != -1 {
+				i.removeService(j)
+			}
+		},
+		done: func(before, table Ipvs) bool {
+			return before.FindService(netType, host, port) != nil && table.FindService(netType, host, port) == nil
+		},
+		service:    serviceKey(netType, host, port),
+		options:    true,
+		allServers: true,
+	})
+}
+
+// AddServer queues adding server to the service identified by netType, host
+// and port.
+func (b *Batch) AddServer(netType, host string, port int, server Server) error {
+	err := server.Validate()
+	if err != nil {
+		return err
+	}
+	if server.Forwarder != "m" && netType != "fwmark" && port != server.Port {
+		return InvalidServerPort
+	}
+	service := Service{Type: netType, Host: host, Port: port}
+	b.queue(batchOperation{
+		lines: []string{serverLine("-a", service, server.String())},
+		apply: func(i *Ipvs) {
+			if s := i.FindService(netType, host, port); s != nil && s.findServer(server.Host, server.Port) == -1 {
+				s.appendServer(server)
+			}
+		},
+		done: func(before, table Ipvs) bool {
+			if s := before.FindService(netType, host, port); s == nil || s.FindServer(server.Host, server.Port) != nil {
+				return false
+			}
+			return tableShows(table, service, false, server)
+		},
+		service: serviceKey(netType, host, port),
+		servers: []string{serverKey(server.Host, server.Port)},
+	})
+	return nil
+}
+
+func (b *Batch) EditServer(netType, host string, port int, server Server) error {
+	err := server.Validate()
+	if err != nil {
+		return err
+	}
+	if server.Forwarder != "m" && netType != "fwmark" && port != server.Port {
+		return InvalidServerPort
+	}
+	service := Service{Type: netType, Host: host, Port: port}
+	b.queue(batchOperation{
+		lines: []string{serverLine("-e", service, server.String())},
+		apply: func(i *Ipvs) {
+			if s := i.FindService(netType, host, port); s != nil {
+				if found := s.FindServer(server.Host, server.Port); found != nil {
+					*found = server
+				}
+			}
+		},
+		done: func(before, table Ipvs) bool {
+			if s := before.FindService(netType, host, port); s == nil || s.FindServer(server.Host, server.Port) == nil {
+				return false
+			}
+			return tableShows(table, service, false, server)
+		},
+		service: serviceKey(netType, host, port),
+		servers: []string{serverKey(server.Host, server.Port)},
+	})
+	return nil
+}
+
+func (b *Batch) RemoveServer(netType, host string, port int, serverHost string, serverPort int) {
+	service := Service{Type: netType, Host: host, Port: port}
+	server := Server{Host: serverHost, Port: serverPort}
+	b.queue(batchOperation{
+		lines: []string{serverLine("-d", service, server.getHostPort())},
+		apply: func(i *Ipvs) {
+			if s := i.FindService(netType, host, port); s != nil {
+				if j := s.findServer(serverHost, serverPort); j != -1 {
+					s.removeServer(j)
+				}
+			}
+		},
+		done: func(before, table Ipvs) bool {
+			if s := before.FindService(netType, host, port); s == nil || s.FindServer(serverHost, serverPort) == nil {
+				return false
+			}
+			s := table.FindService(netType, host, port)
+			return s == nil || s.FindServer(serverHost, serverPort) == nil
+		},
+		service: serviceKey(netType, host, port),
+		servers: []string{serverKey(serverHost, serverPort)},
+	})
+}
+
+func (b *Batch) Run() ([]error, error) {
+	return b.RunContext(context.Background())
+}
+
+// RunContext runs every queued operation and empties the batch. It returns
+// the result of each operation in the order they were queued, and the error
+// of the restore. ipvsadm reports the lines the kernel rejects and carries
+// on, exiting with the status of the last line, so when the restore fails or
+// reports anything the table is read back to tell which operations it shows
+// and the services of the Ipvs are replaced with it. Additions must not find
+// what they add in the Ipvs as the operations before them left it, edits and
+// removals must find it. An operation
+// followed in the batch by another changing the same service or server
+// can't be told from the table and returns the error of the restore. If the
+// table can't be read every operation returns the error and the Ipvs is
+// left alone. Backends that are not an OutputBackend report nothing, so
+// there a restore exiting 0 is taken to have applied every operation.
+func (b *Batch) RunContext(ctx context.Context) ([]error, error) {
+	operations := b.operations
+	if len(operations) == 0 {
+		return nil, nil
+	}
+	lines := make([]string, 0, len(operations))
+	for j := range operations {
+		lines = append(lines, operations[j].lines...)
+	}
+
+	output, err := commandStdinOutput(ctx, strings.Join(lines, "\n")+"\n", "ipvsadm", "-R")
+	b.operations = nil
+
+	results := make([]error, len(operations))
+	if err == nil && strings.TrimSpace(string(output)) == "" {
+		for j := range operations {
+			operations[j].apply(b.ipvs)
+		}
+		return results, nil
+	}
+	if err == nil {
+		// the last line went through but ipvsadm rejected earlier ones
+		ipvsErr := newIpvsError([]string{"ipvsadm", "-R"}, nil, output).(*IpvsError)
+		ipvsErr.ExitCode = 0
+		err = ipvsErr
+	}
+
+	table := Ipvs{}
+	if table.SaveContext(ctx) != nil {
+		for j := range results {
+			results[j] = err
+		}
+		return results, err
+	}
+	// each operation is checked against the Ipvs as the operations before it
+	// left it
+	before := b.ipvs.Clone()
+	before.Reindex()
+	for j := range operations {
+		hidden := false
+		for k := j + 1; k < len(operations) && !hidden; k++ {
+			hidden = operations[j].overlaps(operations[k])
+		}
+		if hidden || !operations[j].done(before, table) {
+			results[j] = err
+		}
+		operations[j].apply(&before)
+	}
+	b.ipvs.Services = table.Services
+	b.ipvs.Reindex()
+	return results, err
+}
+
+func (b *Batch) queue(operation batchOperation) {
+	b.operations = append(b.operations, operation)
+}
+
+// overlaps reports whether a and b change the same service or server, in
+// which case the table only shows the later of them.
+func (a batchOperation) overlaps(b batchOperation) bool {
+	if a.service != b.service {
+		return false
+	}
+	if (a.options && b.options) || a.allServers || b.allServers {
+		return true
+	}
+	for _, x := range a.servers {
+		for _, y := range b.servers {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tableShows reports whether the table read back has service, with its
+// options when options is set, and the servers. They are compared by the
+// lines `ipvsadm -S -n` prints, which is all the kernel keeps of them.
+func tableShows(table Ipvs, service Service, options bool, servers ...Server) bool {
+	found := table.FindService(service.Type, service.getHost(), service.Port)
+	if found == nil {
+		return false
+	}
+	if options && saveLines(normalized(*found, nil))[0] != saveLines(normalized(service, nil))[0] {
+		return false
+	}
+	for _, server := range servers {
+		s := found.FindServer(server.Host, server.Port)
+		if s == nil || saveLines(normalized(*found, []Server{*s}))[1] != saveLines(normalized(*found, []Server{server}))[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// normalized returns a normalized copy of s with the servers given.
+func normalized(s Service, servers []Server) Service {
+	s = s.Clone()
+	s.Servers = append([]Server{}, servers...)
+	s.Normalize()
+	return s
+}
+
+func serviceLine(op string, service Service) string {
+	return strings.Join(append([]string{op, ServiceTypeFlag[service.Type], service.getHostPort()}, service.getOptions()...), " ")
+}
+
+func serverLine(op string, service Service, server string) string {
+	return fmt.Sprintf("%s %s %s -r %s", op, ServiceTypeFlag[service.Type], service.getHostPort(), server)
+}
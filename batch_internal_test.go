@@ -0,0 +1,138 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBatch(test *testing.T) {
+	simulator := useSimulator()
+	defer useFakes()
+	var restores int
+	BeforeCommand = func(ctx context.Context, trace Trace) {
+		if len(trace.Command) == 2 && trace.Command[1] == "-R" {
+			restores++
+		}
+	}
+	defer func() { BeforeCommand = nil }()
+
+	// the batch edits the restored servers in place, keep the fixture
+	existing := testServices[0]
+	existing.Servers = append([]Server{}, existing.Servers...)
+	ipvs := &Ipvs{}
+	if err := ipvs.Restore([]Service{existing}); err != nil {
+		test.Fatalf("restore failed: %v", err)
+	}
+	restores = 0
+
+	batch := ipvs.Batch()
+	service := Service{Host: "10.0.0.9", Port: 80, Type: "tcp", Scheduler: "rr"}
+	for n := 1; n <= 200; n++ {
+		service.Servers = append(service.Servers, Server{Host: fmt.Sprintf("10.1.%d.%d", n/250, n%250), Port: 80, Forwarder: "g", Weight: 1})
+	}
+	if err := batch.AddService(service); err != nil {
+		test.Fatal(err)
+	}
+	edited := testServices[0].Servers[0]
+	edited.Weight = 9
+	if err := batch.EditServer("tcp", testServices[0].Host, testServices[0].Port, edited); err != nil {
+		test.Fatal(err)
+	}
+	batch.RemoveServer("tcp", testServices[0].Host, testServices[0].Port, testServices[0].Servers[1].Host, testServices[0].Servers[1].Port)
+	if err := batch.AddServer("tcp", "10.0.0.9", 80, Server{Host: "10.2.0.1", Port: 8080}); err != InvalidServerPort {
+		test.Errorf("expected InvalidServerPort, got %v", err)
+	}
+
+	results, err := batch.Run()
+	if err != nil || len(results) != 3 || batch.Len() != 0 {
+		test.Fatalf("unexpected batch results %v %v", results, err)
+	}
+	if restores != 1 {
+		test.Errorf("expected a single command, got %d", restores)
+	}
+	table := simulator.Ipvs()
+	if len(table.Services) != 2 || len(table.Services[1].Servers) != 200 || table.Services[0].Servers[0].Weight != 9 || len(table.Services[0].Servers) != len(testServices[0].Servers)-1 {
+		test.Errorf("unexpected table %+v", table.Services)
+	}
+	if len(ipvs.Services) != 2 || ipvs.Services[0].Servers[0].Weight != 9 || len(ipvs.Services[0].Servers) != len(testServices[0].Servers)-1 {
+		test.Errorf("model out of sync with the table %+v", ipvs.Services)
+	}
+}
+
+func TestBatchFailure(test *testing.T) {
+	simulator := useSimulator()
+	defer useFakes()
+
+	// ipvsadm carries on past the rejected server and exits with the status
+	// of the last line, printing bare messages
+	ipvs := &Ipvs{}
+	batch := ipvs.Batch()
+	batch.AddService(Service{Host: "10.0.0.1", Port: 80, Type: "tcp"})
+	batch.AddServer("tcp", "10.0.0.2", 80, Server{Host: "10.1.0.1", Port: 80, Forwarder: "g"})
+	batch.AddService(Service{Host: "10.0.0.3", Port: 80, Type: "tcp"})
+	batch.EditService(Service{Host: "10.0.0.9", Port: 80, Type: "tcp"})
+
+	results, err := batch.Run()
+	var ipvsErr *IpvsError
+	if !errors.As(err, &ipvsErr) || !errors.Is(err, NotFound) || strings.Contains(ipvsErr.Output, "line") {
+		test.Fatalf("expected NotFound, got %v", err)
+	}
+	if results[0] != nil || results[1] != err || results[2] != nil || results[3] != err {
+		test.Errorf("unexpected results %v", results)
+	}
+	if len(simulator.Ipvs().Services) != 2 || len(ipvs.Services) != 2 || ipvs.Services[1].Host != "10.0.0.3" {
+		test.Errorf("the model should match the table: %+v", ipvs.Services)
+	}
+
+	// an operation hidden by a later one takes the error of the restore
+	batch.RemoveService("tcp", "10.0.0.3", 80)
+	batch.AddService(Service{Host: "10.0.0.3", Port: 80, Type: "tcp", Scheduler: "rr"})
+	batch.RemoveServer("tcp", "10.0.0.9", 80, "10.1.0.1", 80)
+	results, err = batch.Run()
+	if err == nil || results[0] != err || results[1] != nil || results[2] != err {
+		test.Errorf("unexpected results %v %v", results, err)
+	}
+	if s := ipvs.FindService("tcp", "10.0.0.3", 80); s == nil || s.Scheduler != "rr" {
+		test.Errorf("unexpected service %+v", s)
+	}
+
+	// a rejected line before the last leaves the exit status alone, but
+	// ipvsadm still prints it
+	useSimulator()
+	ipvs = &Ipvs{}
+	ipvs.AddService(Service{Host: "10.0.0.1", Port: 80, Type: "tcp"})
+	ipvs.AddService(Service{Host: "10.0.0.2", Port: 80, Type: "tcp"})
+	batch = ipvs.Batch()
+	batch.AddService(Service{Host: "10.0.0.1", Port: 80, Type: "tcp"})
+	batch.AddServer("tcp", "10.0.0.2", 80, Server{Host: "10.1.0.1", Port: 80, Forwarder: "g"})
+	results, err = batch.Run()
+	if !errors.As(err, &ipvsErr) || !errors.Is(err, Conflict) || ipvsErr.ExitCode != 0 {
+		test.Fatalf("expected Conflict, got %v", err)
+	}
+	if results[0] != err || results[1] != nil {
+		test.Errorf("unexpected results %v", results)
+	}
+	if len(ipvs.Services) != 2 || len(ipvs.Services[1].Servers) != 1 {
+		test.Errorf("the model should match the table: %+v", ipvs.Services)
+	}
+
+	// when the table can't be read nothing is known to have been applied
+	useFakes()
+	fakeExecuteStdinErr = &IpvsError{Command: []string{"ipvsadm", "-R"}, Output: "Memory allocation problem"}
+	fakeRunErr = errors.New("exit status 1")
+	defer func() { fakeExecuteStdinErr, fakeRunErr = nil, nil }()
+	batch.RemoveService("tcp", "10.0.0.1", 80)
+	results, err = batch.Run()
+	if err != fakeExecuteStdinErr || results[0] != err || len(ipvs.Services) != 2 {
+		test.Errorf("unexpected results %v %v", results, err)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The yaml and toml forms are read into and written from a small document
+// tree, which is decoded into and encoded from the types using their json
+// field names, so all three forms share one schema.
+
+type (
+	// ConfigError is a problem reading a config file, such as a yaml or toml
+	// document, at Line.
+	ConfigError struct {
+		Line int
+		Err  error
+	}
+
+	nodeKind int
+
+	// node is a value in a yaml or toml document.
+	node struct {
+		kind   nodeKind
+		line   int
+		text   string
+		string bool
+		null   bool
+		fields []field
+		items  []*node
+	}
+
+	field struct {
+		key   string
+		value *node
+	}
+)
+
+const (
+	scalarNode nodeKind = iota
+	mappingNode
+	sequenceNode
+)
+
+var (
+	InvalidConfig = errors.New("Invalid Config")
+)
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func configError(line int, format string, a ...any) error {
+	return &ConfigError{Line: line, Err: fmt.Errorf("%w: "+format, append([]any{InvalidConfig}, a...)...)}
+}
+
+func (n *node) get(key string) *node {
+	for i := range n.fields {
+		if n.fields[i].key == key {
+			return n.fields[i].value
+		}
+	}
+	return nil
+}
+
+// encodeNode builds the document tree for v, a struct, slice, string or int,
+// naming struct fields by their json tags.
+func encodeNode(v reflect.Value) *node {
+	switch v.Kind() {
+	case reflect.Struct:
+		n := &node{kind: mappingNode}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name, omitEmpty, ok := jsonName(t.Field(i))
+			if !ok || (omitEmpty && v.Field(i).IsZero()) {
+				continue
+			}
+			n.fields = append(n.fields, field{key: name, value: encodeNode(v.Field(i))})
+		}
+		return n
+	case reflect.Slice:
+		n := &node{kind: sequenceNode}
+		for i := 0; i < v.Len(); i++ {
+			n.items = append(n.items, encodeNode(v.Index(i)))
+		}
+		return n
+	case reflect.String:
+		return &node{kind: scalarNode, text: v.String(), string: true}
+	default:
+		return &node{kind: scalarNode, text: strconv.FormatInt(v.Int(), 10)}
+	}
+}
+
+// decodeNode sets v from n, leaving it alone if n is null.
+func decodeNode(n *node, v reflect.Value) error {
+	if n.null {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		if n.kind != mappingNode {
+			return configError(n.line, "expected a mapping")
+		}
+		t := v.Type()
+		for _, f := range n.fields {
+			found := false
+			for i := 0; i < t.NumField(); i++ {
+				if name, _, ok := jsonName(t.Field(i)); ok && name == f.key {
+					if err := decodeNode(f.value, v.Field(i)); err != nil {
+						return err
+					}
+					found = true
+					break
+				}
+			}
+			if !found {
+				return configError(f.value.line, "unknown field %q", f.key)
+			}
+		}
+	case reflect.Slice:
+		if n.kind != sequenceNode {
+			return configError(n.line, "expected a list")
+		}
+		slice := reflect.MakeSlice(v.Type(), len(n.items), len(n.items))
+		for i, item := range n.items {
+			if err := decodeNode(item, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.String:
+		if n.kind != scalarNode {
+			return configError(n.line, "expected a string")
+		}
+		v.SetString(n.text)
+	default:
+		if n.kind != scalarNode {
+			return configError(n.line, "expected a number")
+		}
+		i, err := strconv.ParseInt(strings.ReplaceAll(n.text, "_", ""), 10, 64)
+		if err != nil || v.OverflowInt(i) {
+			return configError(n.line, "invalid number %q", n.text)
+		}
+		v.SetInt(i)
+	}
+	return nil
+}
+
+// jsonName returns the json name of a struct field and whether it is
+// omitted when empty, ok is false for fields json skips.
+func jsonName(f reflect.StructField) (name string, omitEmpty bool, ok bool) {
+	if f.PkgPath != "" {
+		return "", false, false
+	}
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false, false
+	}
+	parts := strings.Split(tag, ",")
+	name = parts[0]
+	if name == "" {
+		name = f.Name
+	}
+	for _, option := range parts[1:] {
+		omitEmpty = omitEmpty || option == "omitempty"
+	}
+	return name, omitEmpty, true
+}
+
+// encodeIpvs is the document for i, with the version of its schema first.
+func encodeIpvs(i Ipvs) *node {
+	i = i.Clone()
+	i.Normalize()
+	if i.Services == nil {
+		i.Services = []Service{}
+	}
+	n := encodeNode(reflect.ValueOf(i))
+	version := field{key: "version", value: &node{kind: scalarNode, text: strconv.Itoa(JsonVersion)}}
+	n.fields = append([]field{version}, n.fields...)
+	return n
+}
+
+func decodeIpvs(n *node, i *Ipvs) error {
+	if n.kind != mappingNode {
+		return configError(n.line, "expected a mapping")
+	}
+	doc := *n
+	doc.fields = nil
+	for _, f := range n.fields {
+		if f.key != "version" {
+			doc.fields = append(doc.fields, f)
+			continue
+		}
+		version, err := strconv.Atoi(f.value.text)
+		if err != nil || f.value.kind != scalarNode {
+			return configError(f.value.line, "invalid version %q", f.value.text)
+		}
+		if version > JsonVersion {
+			return &ConfigError{Line: f.value.line, Err: fmt.Errorf("%w: %d", UnsupportedJsonVersion, version)}
+		}
+	}
+	decoded := Ipvs{}
+	if err := decodeNode(&doc, reflect.ValueOf(&decoded).Elem()); err != nil {
+		return err
+	}
+	*i = decoded
+	i.Reindex()
+	return nil
+}
+
+func encodeService(s Service) *node {
+	s = s.Clone()
+	s.Normalize()
+	return encodeNode(reflect.ValueOf(s))
+}
+
+func encodeServer(s Server) *node {
+	s.Normalize()
+	return encodeNode(reflect.ValueOf(s))
+}
+
+// decodeValue decodes n into a fresh value and stores it in v, a *Service or
+// *Server.
+func decodeValue(n *node, v any) error {
+	target := reflect.ValueOf(v).Elem()
+	decoded := reflect.New(target.Type()).Elem()
+	if err := decodeNode(n, decoded); err != nil {
+		return err
+	}
+	target.Set(decoded)
+	return nil
+}
@@ -0,0 +1,282 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type (
+	// Change is a field that differs between two snapshots.
+	Change struct {
+		Field string `json:"field"`
+		From  string `json:"from"`
+		To    string `json:"to"`
+	}
+
+	// ServerDiff lists the changed fields of a server found in both
+	// snapshots.
+	ServerDiff struct {
+		Host    string   `json:"host"`
+		Port    int      `json:"port"`
+		Changes []Change `json:"changes"`
+	}
+
+	// ServiceDiff lists the changed fields and servers of a service found in
+	// both snapshots.
+	ServiceDiff struct {
+		Type           string       `json:"type"`
+		Host           string       `json:"host"`
+		Port           int          `json:"port"`
+		Changes        []Change     `json:"changes,omitempty"`
+		AddedServers   []Server     `json:"added_servers,omitempty"`
+		RemovedServers []Server     `json:"removed_servers,omitempty"`
+		ChangedServers []ServerDiff `json:"changed_servers,omitempty"`
+	}
+
+	// IpvsDiff is what changed from one Ipvs to another. Services are
+	// matched by type, host (or mark) and port, servers by host and port, so
+	// the order of either does not matter.
+	IpvsDiff struct {
+		Changes         []Change      `json:"changes,omitempty"`
+		AddedServices   []Service     `json:"added_services,omitempty"`
+		RemovedServices []Service     `json:"removed_services,omitempty"`
+		ChangedServices []ServiceDiff `json:"changed_services,omitempty"`
+	}
+)
+
+// Clone returns a copy of i that shares no slices with it.
+func (i Ipvs) Clone() Ipvs {
+	clone := i
+	clone.services = keyIndex[Service]{}
+	if i.Services != nil {
+		clone.Services = make([]Service, len(i.Services))
+		for j := range i.Services {
+			clone.Services[j] = i.Services[j].Clone()
+		}
+	}
+	return clone
+}
+
+// Clone returns a copy of s that shares no slices with it.
+func (s Service) Clone() Service {
+	clone := s
+	clone.servers = keyIndex[Server]{}
+	if s.SchedulerFlags != nil {
+		clone.SchedulerFlags = append([]string{}, s.SchedulerFlags...)
+	}
+	if s.Servers != nil {
+		clone.Servers = append([]Server{}, s.Servers...)
+	}
+	return clone
+}
+
+// Equal reports whether i and other have no differences once normalized.
+func (i Ipvs) Equal(other Ipvs) bool {
+	return i.Diff(other).Empty()
+}
+
+// Equal reports whether s and other are the same service with no
+// differences once normalized.
+func (s Service) Equal(other Service) bool {
+	return diffKey(s) == diffKey(other) && s.Diff(other).Empty()
+}
+
+// Equal reports whether s and other are the same once normalized.
+func (s Server) Equal(other Server) bool {
+	s.Normalize()
+	other.Normalize()
+	return s == other
+}
+
+// Diff returns what changed from i to other, comparing normalized copies.
+func (i Ipvs) Diff(other Ipvs) IpvsDiff {
+	i, other = i.Clone(), other.Clone()
+	i.Normalize()
+	other.Normalize()
+
+	d := IpvsDiff{}
+	d.Changes = appendChange(d.Changes, "mcast_interface", i.MulticastInterface, other.MulticastInterface)
+	d.Changes = appendChange(d.Changes, "syncid", strconv.Itoa(i.Syncid), strconv.Itoa(other.Syncid))
+	d.Changes = appendChange(d.Changes, "tcp_timeout", strconv.Itoa(i.Tcp), strconv.Itoa(other.Tcp))
+	d.Changes = appendChange(d.Changes, "tcp_fin_timeout", strconv.Itoa(i.Tcpfin), strconv.Itoa(other.Tcpfin))
+	d.Changes = appendChange(d.Changes, "udp_fin_timeout", strconv.Itoa(i.Udp), strconv.Itoa(other.Udp))
+
+	from := make(map[string]int, len(i.Services))
+	for j := range i.Services {
+		from[diffKey(i.Services[j])] = j
+	}
+	to := make(map[string]bool, len(other.Services))
+	for _, service := range other.Services {
+		key := diffKey(service)
+		to[key] = true
+		j, ok := from[key]
+		if !ok {
+			d.AddedServices = append(d.AddedServices, service)
+			continue
+		}
+		if serviceDiff := i.Services[j].diff(service); !serviceDiff.Empty() {
+			d.ChangedServices = append(d.ChangedServices, serviceDiff)
+		}
+	}
+	for _, service := range i.Services {
+		if !to[diffKey(service)] {
+			d.RemovedServices = append(d.RemovedServices, service)
+		}
+	}
+	return d
+}
+
+// Diff returns what changed from s to other, which are assumed to be the
+// same service, comparing normalized copies.
+func (s Service) Diff(other Service) ServiceDiff {
+	s, other = s.Clone(), other.Clone()
+	s.Normalize()
+	other.Normalize()
+	return s.diff(other)
+}
+
+func (s Service) diff(other Service) ServiceDiff {
+	d := ServiceDiff{Type: other.Type, Host: other.getHost(), Port: other.Port}
+	d.Changes = appendChange(d.Changes, "scheduler", s.Scheduler, other.Scheduler)
+	d.Changes = appendChange(d.Changes, "persistence", strconv.Itoa(s.Persistence), strconv.Itoa(other.Persistence))
+	d.Changes = appendChange(d.Changes, "netmask", s.Netmask, other.Netmask)
+	d.Changes = appendChange(d.Changes, "scheduler_flags", strings.Join(s.SchedulerFlags, ","), strings.Join(other.SchedulerFlags, ","))
+	d.Changes = appendChange(d.Changes, "persistence_engine", s.PersistenceEngine, other.PersistenceEngine)
+
+	from := make(map[string]int, len(s.Servers))
+	for j := range s.Servers {
+		from[serverKey(s.Servers[j].Host, s.Servers[j].Port)] = j
+	}
+	to := make(map[string]bool, len(other.Servers))
+	for _, server := range other.Servers {
+		key := serverKey(server.Host, server.Port)
+		to[key] = true
+		j, ok := from[key]
+		if !ok {
+			d.AddedServers = append(d.AddedServers, server)
+			continue
+		}
+		if serverDiff := s.Servers[j].diff(server); len(serverDiff.Changes) != 0 {
+			d.ChangedServers = append(d.ChangedServers, serverDiff)
+		}
+	}
+	for _, server := range s.Servers {
+		if !to[serverKey(server.Host, server.Port)] {
+			d.RemovedServers = append(d.RemovedServers, server)
+		}
+	}
+	return d
+}
+
+// Diff returns the fields that changed from s to other, which are assumed to
+// be the same server, comparing normalized copies.
+func (s Server) Diff(other Server) ServerDiff {
+	s.Normalize()
+	other.Normalize()
+	return s.diff(other)
+}
+
+func (s Server) diff(other Server) ServerDiff {
+	d := ServerDiff{Host: other.Host, Port: other.Port}
+	d.Changes = appendChange(d.Changes, "forwarder", s.Forwarder, other.Forwarder)
+	d.Changes = appendChange(d.Changes, "weight", strconv.Itoa(s.Weight), strconv.Itoa(other.Weight))
+	d.Changes = appendChange(d.Changes, "upper_threshold", strconv.Itoa(s.UpperThreshold), strconv.Itoa(other.UpperThreshold))
+	d.Changes = appendChange(d.Changes, "lower_threshold", strconv.Itoa(s.LowerThreshold), strconv.Itoa(other.LowerThreshold))
+	d.Changes = appendChange(d.Changes, "tunnel_type", s.TunnelType, other.TunnelType)
+	d.Changes = appendChange(d.Changes, "tunnel_port", strconv.Itoa(s.TunnelPort), strconv.Itoa(other.TunnelPort))
+	return d
+}
+
+func (d IpvsDiff) Empty() bool {
+	return len(d.Changes) == 0 && len(d.AddedServices) == 0 && len(d.RemovedServices) == 0 && len(d.ChangedServices) == 0
+}
+
+func (d ServiceDiff) Empty() bool {
+	return len(d.Changes) == 0 && len(d.AddedServers) == 0 && len(d.RemovedServers) == 0 && len(d.ChangedServers) == 0
+}
+
+func (d IpvsDiff) ToJson() ([]byte, error) {
+	return json.Marshal(d)
+}
+
+// String renders the diff one change per line, + for added, - for removed
+// and ~ for changed services and servers.
+func (d IpvsDiff) String() string {
+	a := make([]string, 0, 0)
+	a = appendChangeLines(a, "", d.Changes)
+	for _, service := range d.AddedServices {
+		a = append(a, "+ service "+diffName(service.Type, service.getHost(), service.Port))
+		for _, server := range service.Servers {
+			a = append(a, "  + server "+joinHostPort(server.Host, server.Port))
+		}
+	}
+	for _, service := range d.RemovedServices {
+		a = append(a, "- service "+diffName(service.Type, service.getHost(), service.Port))
+	}
+	for _, service := range d.ChangedServices {
+		a = append(a, service.lines()...)
+	}
+	if len(a) == 0 {
+		return ""
+	}
+	return strings.Join(a, "\n") + "\n"
+}
+
+func (d ServiceDiff) String() string {
+	if d.Empty() {
+		return ""
+	}
+	return strings.Join(d.lines(), "\n") + "\n"
+}
+
+func (d ServiceDiff) lines() []string {
+	a := []string{"~ service " + diffName(d.Type, d.Host, d.Port)}
+	a = appendChangeLines(a, "  ", d.Changes)
+	for _, server := range d.AddedServers {
+		a = append(a, "  + server "+joinHostPort(server.Host, server.Port))
+	}
+	for _, server := range d.RemovedServers {
+		a = append(a, "  - server "+joinHostPort(server.Host, server.Port))
+	}
+	for _, server := range d.ChangedServers {
+		a = append(a, "  ~ server "+joinHostPort(server.Host, server.Port))
+		a = appendChangeLines(a, "    ", server.Changes)
+	}
+	return a
+}
+
+func appendChange(changes []Change, field, from, to string) []Change {
+	if from == to {
+		return changes
+	}
+	return append(changes, Change{Field: field, From: from, To: to})
+}
+
+func appendChangeLines(a []string, indent string, changes []Change) []string {
+	for _, change := range changes {
+		a = append(a, fmt.Sprintf("%s%s: %q -> %q", indent, change.Field, change.From, change.To))
+	}
+	return a
+}
+
+func diffKey(s Service) string {
+	return serviceKey(s.Type, s.getHost(), s.Port)
+}
+
+func diffName(netType, host string, port int) string {
+	if netType == "fwmark" {
+		return "fwmark " + host
+	}
+	if netType == "" {
+		netType = "tcp"
+	}
+	return netType + " " + joinHostPort(host, port)
+}
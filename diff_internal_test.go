@@ -0,0 +1,87 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCloneEqual(test *testing.T) {
+	ipvs := Ipvs{Tcp: 900, Services: testServices}
+	clone := ipvs.Clone()
+	if !ipvs.Equal(clone) {
+		test.Fatal("a clone should equal the original")
+	}
+	clone.Services[0].Servers[0].Weight = 9
+	clone.Services[0].SchedulerFlags = append(clone.Services[0].SchedulerFlags, "sh-port")
+	if testServices[0].Servers[0].Weight == 9 || len(testServices[0].SchedulerFlags) != 0 {
+		test.Fatal("the clone shares slices with the original")
+	}
+	if ipvs.Equal(clone) || clone.Services[0].Equal(testServices[0]) {
+		test.Error("the changed clone should not be equal")
+	}
+
+	// order does not matter
+	reversed := Ipvs{Tcp: 900, Services: []Service{testServices[1], testServices[0]}}
+	if !ipvs.Equal(reversed) {
+		test.Error("services in a different order should be equal")
+	}
+	if testServices[0].Equal(testServices[1]) {
+		test.Error("different services should not be equal")
+	}
+}
+
+func TestDiff(test *testing.T) {
+	from := Ipvs{Services: []Service{
+		{Type: "tcp", Host: "10.0.0.1", Port: 80, Scheduler: "rr", Servers: []Server{
+			{Host: "10.0.1.1", Port: 80, Forwarder: "g", Weight: 1},
+			{Host: "10.0.1.2", Port: 80, Forwarder: "g", Weight: 1},
+		}},
+		{Type: "udp", Host: "10.0.0.1", Port: 53, Scheduler: "rr"},
+	}}
+	to := from.Clone()
+	to.Tcp = 900
+	to.Services[0].Scheduler = "wlc"
+	to.Services[0].Persistence = 300
+	to.Services[0].Servers[0].Weight = 5
+	to.Services[0].Servers[0].Forwarder = "m"
+	to.Services[0].Servers[1] = Server{Host: "10.0.1.3", Port: 80, Forwarder: "g", Weight: 1}
+	to.Services[1] = Service{Type: "fwmark", FwMark: 7, Scheduler: "sh"}
+
+	diff := from.Diff(to)
+	expected := `tcp_timeout: "0" -> "900"
++ service fwmark 7
+- service udp 10.0.0.1:53
+~ service tcp 10.0.0.1:80
+  scheduler: "rr" -> "wlc"
+  persistence: "0" -> "300"
+  + server 10.0.1.3:80
+  - server 10.0.1.2:80
+  ~ server 10.0.1.1:80
+    forwarder: "g" -> "m"
+    weight: "1" -> "5"
+`
+	if diff.String() != expected {
+		test.Errorf("unexpected diff:\n%s", diff)
+	}
+
+	out, err := diff.ToJson()
+	if err != nil {
+		test.Fatal(err)
+	}
+	decoded := IpvsDiff{}
+	if err := json.Unmarshal(out, &decoded); err != nil || decoded.String() != expected {
+		test.Errorf("json did not round trip: %s", out)
+	}
+	if len(decoded.ChangedServices[0].ChangedServers[0].Changes) != 2 || decoded.ChangedServices[0].ChangedServers[0].Changes[1].Field != "weight" {
+		test.Errorf("unexpected json %s", out)
+	}
+	if !from.Diff(from.Clone()).Empty() || from.Diff(from).String() != "" {
+		test.Error("a snapshot should not differ from itself")
+	}
+}
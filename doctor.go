@@ -0,0 +1,306 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type (
+	Severity string
+
+	// Finding is the result of a single readiness check. Fix, when set, is
+	// a command that resolves the finding and can be run with Repair.
+	Finding struct {
+		Check    string   `json:"check"`
+		Severity Severity `json:"severity"`
+		Message  string   `json:"message"`
+		Fix      []string `json:"fix,omitempty"`
+	}
+
+	Report []Finding
+)
+
+const (
+	SeverityOk      Severity = "ok"
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+)
+
+var (
+	// DoctorSysctls are the sysctls a director should have, and the value
+	// they should be set to.
+	DoctorSysctls = map[string]string{
+		"net.ipv4.vs.expire_nodest_conn":        "1",
+		"net.ipv4.vs.expire_quiescent_template": "1",
+	}
+)
+
+func Doctor() Report {
+	return DoctorContext(context.Background())
+}
+
+func DoctorContext(ctx context.Context) Report {
+	return DefaultIpvs.DoctorContext(ctx)
+}
+
+// Doctor checks that the host is ready to direct traffic for i.
+func (i Ipvs) Doctor() Report {
+	return i.DoctorContext(context.Background())
+}
+
+func (i Ipvs) DoctorContext(ctx context.Context) Report {
+	report := make(Report, 0, 0)
+	report = append(report, i.doctorIpvsadm(ctx))
+	report = append(report, i.doctorModules(ctx)...)
+	report = append(report, i.doctorSysctls(ctx)...)
+	report = append(report, i.doctorVips(ctx)...)
+	report = append(report, i.doctorDaemon(ctx)...)
+	return report
+}
+
+// Ok reports whether nothing in the report is an error.
+func (r Report) Ok() bool {
+	for i := range r {
+		if r[i].Severity == SeverityError {
+			return false
+		}
+	}
+	return true
+}
+
+func (r Report) String() string {
+	a := make([]string, 0, len(r))
+	for i := range r {
+		a = append(a, r[i].String())
+	}
+	return strings.Join(a, "\n")
+}
+
+func (f Finding) String() string {
+	s := fmt.Sprintf("[%s] %s: %s", f.Severity, f.Check, f.Message)
+	if len(f.Fix) != 0 {
+		s += " (fix: " + strings.Join(f.Fix, " ") + ")"
+	}
+	return s
+}
+
+// Repair runs the finding's fix.
+func (f Finding) Repair() error {
+	return f.RepairContext(context.Background())
+}
+
+func (f Finding) RepairContext(ctx context.Context) error {
+	if len(f.Fix) == 0 {
+		return nil
+	}
+	return command(ctx, f.Fix[0], f.Fix[1:]...)
+}
+
+// doctorIpvsadm checks that ipvsadm is installed and new enough for the
+// features the services use.
+func (i Ipvs) doctorIpvsadm(ctx context.Context) Finding {
+	finding := Finding{Check: "ipvsadm"}
+	if err := check(ctx); err != nil {
+		finding.Severity, finding.Message = SeverityError, err.Error()
+		return finding
+	}
+	out, err := commandOutput(ctx, []string{"ipvsadm", "-v"})
+	if err != nil {
+		finding.Severity, finding.Message = SeverityError, err.Error()
+		return finding
+	}
+	version, err := ParseVersion(string(out))
+	if err != nil {
+		finding.Severity, finding.Message = SeverityWarning, "unable to read version: "+err.Error()
+		return finding
+	}
+	capabilities := Capabilities{Ipvsadm: version}
+	for _, feature := range i.features() {
+		if err := capabilities.checkFeature(feature); err != nil {
+			finding.Severity, finding.Message = SeverityError, err.Error()
+			return finding
+		}
+	}
+	finding.Severity, finding.Message = SeverityOk, strings.TrimSpace(string(out))
+	return finding
+}
+
+// features returns the ipvsadm features the services use, the one needing the
+// newest ipvsadm first.
+func (i Ipvs) features() []Feature {
+	used := make(map[Feature]bool)
+	for j := range i.Services {
+		s := i.Services[j]
+		if len(s.SchedulerFlags) != 0 {
+			used[FeatureSchedulerFlags] = true
+		}
+		if s.PersistenceEngine != "" {
+			used[FeaturePersistenceEngine] = true
+		}
+		for k := range s.Servers {
+			if s.Servers[k].TunnelType != "" {
+				used[FeatureTunnelType] = true
+			}
+		}
+	}
+	features := make([]Feature, 0, len(used))
+	for feature := range used {
+		features = append(features, feature)
+	}
+	sort.Slice(features, func(a, b int) bool {
+		return FeatureIpvsadmVersion[features[b]].Less(FeatureIpvsadmVersion[features[a]])
+	})
+	return features
+}
+
+func (i Ipvs) doctorModules(ctx context.Context) []Finding {
+	out, err := commandOutput(ctx, []string{"lsmod"})
+	if err != nil {
+		return []Finding{{Check: "modules", Severity: SeverityWarning, Message: "unable to list kernel modules: " + err.Error()}}
+	}
+	loaded := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 0 {
+			loaded[fields[0]] = true
+		}
+	}
+
+	findings := make([]Finding, 0, 0)
+	if loaded["ip_vs"] {
+		findings = append(findings, Finding{Check: "module ip_vs", Severity: SeverityOk, Message: "loaded"})
+	} else {
+		findings = append(findings, Finding{Check: "module ip_vs", Severity: SeverityError, Message: "not loaded", Fix: []string{"modprobe", "ip_vs"}})
+	}
+
+	// the kernel loads schedulers on first use, so a missing one is only
+	// worth a warning
+	for _, scheduler := range i.schedulers() {
+		module := "ip_vs_" + scheduler
+		if loaded[module] {
+			findings = append(findings, Finding{Check: "module " + module, Severity: SeverityOk, Message: "loaded"})
+		} else {
+			findings = append(findings, Finding{Check: "module " + module, Severity: SeverityWarning, Message: "not loaded", Fix: []string{"modprobe", module}})
+		}
+	}
+	return findings
+}
+
+func (i Ipvs) schedulers() []string {
+	seen := make(map[string]bool)
+	schedulers := make([]string, 0, 0)
+	for j := range i.Services {
+		scheduler := ServiceSchedulerFlag[i.Services[j].Scheduler]
+		if scheduler != "" && !seen[scheduler] {
+			seen[scheduler] = true
+			schedulers = append(schedulers, scheduler)
+		}
+	}
+	sort.Strings(schedulers)
+	return schedulers
+}
+
+func (i Ipvs) doctorSysctls(ctx context.Context) []Finding {
+	wanted := make(map[string]string)
+	for name, value := range DoctorSysctls {
+		wanted[name] = value
+	}
+	for _, s := range i.masqueradingServers() {
+		wanted[natForwardSysctl[ipFamily(s.server.Host)]] = "1"
+	}
+	names := make([]string, 0, len(wanted))
+	for name := range wanted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	findings := make([]Finding, 0, 0)
+	for _, name := range names {
+		finding := Finding{Check: "sysctl " + name}
+		out, err := commandOutput(ctx, []string{"sysctl", "-n", name})
+		value := strings.TrimSpace(string(out))
+		switch {
+		case err != nil:
+			finding.Severity, finding.Message = SeverityWarning, "unable to read: "+err.Error()
+		case value == wanted[name]:
+			finding.Severity, finding.Message = SeverityOk, value
+		default:
+			finding.Severity = SeverityWarning
+			finding.Message = fmt.Sprintf("is %s, should be %s", value, wanted[name])
+			finding.Fix = []string{"sysctl", "-w", name + "=" + wanted[name]}
+		}
+		// masquerading does not work at all without forwarding
+		if finding.Severity != SeverityOk && (strings.HasSuffix(name, ".ip_forward") || strings.HasSuffix(name, ".forwarding")) {
+			finding.Severity = SeverityError
+		}
+		findings = append(findings, finding)
+	}
+	return findings
+}
+
+func (i Ipvs) doctorVips(ctx context.Context) []Finding {
+	findings := make([]Finding, 0, 0)
+	hosts := make([]string, 0, 0)
+	seen := make(map[string]bool)
+	for j := range i.Services {
+		host := i.Services[j].Host
+		if i.Services[j].Type == "fwmark" || host == "" || seen[host] {
+			continue
+		}
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		return findings
+	}
+
+	out, err := commandOutput(ctx, []string{"ip", "-o", "addr", "show"})
+	if err != nil {
+		return append(findings, Finding{Check: "vips", Severity: SeverityWarning, Message: "unable to list addresses: " + err.Error()})
+	}
+	assigned := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		for k := range fields {
+			if (fields[k] == "inet" || fields[k] == "inet6") && k+1 < len(fields) {
+				assigned[strings.SplitN(fields[k+1], "/", 2)[0]] = true
+			}
+		}
+	}
+	for _, host := range hosts {
+		if assigned[host] {
+			findings = append(findings, Finding{Check: "vip " + host, Severity: SeverityOk, Message: "assigned"})
+		} else {
+			findings = append(findings, Finding{Check: "vip " + host, Severity: SeverityError, Message: "not assigned to any interface"})
+		}
+	}
+	return findings
+}
+
+func (i Ipvs) doctorDaemon(ctx context.Context) []Finding {
+	if i.MulticastInterface == "" {
+		return []Finding{}
+	}
+	finding := Finding{Check: "sync daemon " + i.MulticastInterface}
+	out, err := commandOutput(ctx, []string{"ip", "-o", "link", "show", "dev", i.MulticastInterface})
+	switch {
+	case err != nil:
+		finding.Severity, finding.Message = SeverityError, "interface does not exist"
+	case !strings.Contains(string(out), ",UP") && !strings.Contains(string(out), "<UP"):
+		finding.Severity, finding.Message = SeverityError, "interface is down"
+		finding.Fix = []string{"ip", "link", "set", "dev", i.MulticastInterface, "up"}
+	case !strings.Contains(string(out), "MULTICAST"):
+		finding.Severity, finding.Message = SeverityError, "interface does not support multicast"
+	default:
+		finding.Severity, finding.Message = SeverityOk, "up"
+	}
+	return []Finding{finding}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDoctor(test *testing.T) {
+	backend, backendRun = fakeExecute, fakeRun
+	fakeCommands = nil
+	fakeRunOutputs = map[string][]byte{
+		"ipvsadm -v": []byte("ipvsadm v1.31 2019/12/24 (compiled with popt and IPVS v1.2.1)\n"),
+		"lsmod": []byte(`Module                  Size  Used by
+ip_vs_rr               16384  1
+ip_vs                 176128  3 ip_vs_rr
+`),
+		"sysctl -n net.ipv4.vs.expire_nodest_conn":        []byte("0\n"),
+		"sysctl -n net.ipv4.vs.expire_quiescent_template": []byte("1\n"),
+		"sysctl -n net.ipv4.ip_forward":                   []byte("0\n"),
+		"ip -o addr show": []byte(`1: lo    inet 127.0.0.1/8 scope host lo\       valid_lft forever preferred_lft forever
+2: eth0    inet 192.168.0.1/32 scope global eth0\       valid_lft forever preferred_lft forever
+`),
+		"ip -o link show dev eth1": []byte("3: eth1: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc mq state UP\n"),
+	}
+	defer func() { fakeRunOutputs = map[string][]byte{} }()
+
+	ipvs := Ipvs{MulticastInterface: "eth1", Services: []Service{
+		{Host: "192.168.0.1", Port: 80, Scheduler: "rr", Servers: []Server{{Host: "10.0.0.2", Port: 80, Forwarder: "m"}}},
+		{Host: "192.168.0.2", Port: 80, Scheduler: "wrr"},
+	}}
+	report := ipvs.Doctor()
+	if report.Ok() {
+		test.Errorf("report should contain errors:\n%s", report)
+	}
+
+	severities := make(map[string]Severity)
+	for i := range report {
+		severities[report[i].Check] = report[i].Severity
+	}
+	expected := map[string]Severity{
+		"ipvsadm":                               SeverityOk,
+		"module ip_vs":                          SeverityOk,
+		"module ip_vs_rr":                       SeverityOk,
+		"module ip_vs_wrr":                      SeverityWarning,
+		"sysctl net.ipv4.vs.expire_nodest_conn": SeverityWarning,
+		"sysctl net.ipv4.vs.expire_quiescent_template": SeverityOk,
+		"sysctl net.ipv4.ip_forward":                   SeverityError,
+		"vip 192.168.0.1":                              SeverityOk,
+		"vip 192.168.0.2":                              SeverityError,
+		"sync daemon eth1":                             SeverityOk,
+	}
+	for check, severity := range expected {
+		if severities[check] != severity {
+			test.Errorf("%s: expected %s got %q", check, severity, severities[check])
+		}
+	}
+
+	fakeCommands = nil
+	for i := range report {
+		if report[i].Check == "module ip_vs_wrr" {
+			report[i].Repair()
+		}
+	}
+	if len(fakeCommands) != 1 || strings.Join(fakeCommands[0], " ") != "modprobe ip_vs_wrr" {
+		test.Errorf("unexpected repair commands %v", fakeCommands)
+	}
+}
+
+func TestDoctorIpvsadmVersion(test *testing.T) {
+	simulator := useSimulator()
+	defer useFakes()
+
+	ipvs := Ipvs{Services: []Service{
+		{Host: "192.168.0.1", Port: 80, Scheduler: "sh", SchedulerFlags: []string{"sh-port"}},
+		{Host: "192.168.0.2", Port: 80, Scheduler: "rr", Servers: []Server{{Host: "10.0.0.2", Port: 80, Forwarder: "i", TunnelType: "gue"}}},
+	}}
+	finding := ipvs.doctorIpvsadm(context.Background())
+	if finding.Severity != SeverityOk || finding.Message != simulator.Version {
+		test.Errorf("unexpected finding %s", finding)
+	}
+
+	// scheduler flags came with 1.27 and tunnel types with 1.30
+	simulator.Version = "ipvsadm v1.28 2015/02/09 (compiled with popt and IPVS v1.2.1)"
+	finding = ipvs.doctorIpvsadm(context.Background())
+	if finding.Severity != SeverityError || !strings.Contains(finding.Message, "--tun-type needs ipvsadm 1.30.0, have 1.28.0") {
+		test.Errorf("unexpected finding %s", finding)
+	}
+	ipvs.Services = ipvs.Services[:1]
+	if finding = ipvs.doctorIpvsadm(context.Background()); finding.Severity != SeverityOk {
+		test.Errorf("unexpected finding %s", finding)
+	}
+
+	simulator.Version = "ipvsadm"
+	if finding = ipvs.doctorIpvsadm(context.Background()); finding.Severity != SeverityWarning {
+		test.Errorf("unexpected finding %s", finding)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+type (
+	// DryRun is a Backend that records commands instead of running them,
+	// so operations update the Ipvs model without touching the host. Reads,
+	// when set, answers commands run for their output (like Save), which
+	// otherwise are recorded and fail with DryRunNoReads so that an empty
+	// table is never read in place of the host's.
+	DryRun struct {
+		Reads Backend
+
+		mutex    sync.Mutex
+		commands []DryRunCommand
+	}
+
+	DryRunCommand struct {
+		Command []string `json:"command"`
+		Stdin   string   `json:"stdin,omitempty"`
+	}
+)
+
+var (
+	DryRunNoReads = errors.New("dry run needs a Reads backend to read state")
+)
+
+func (d *DryRun) Execute(ctx context.Context, exe string, args ...string) error {
+	d.record(append([]string{exe}, args...), "")
+	return nil
+}
+
+func (d *DryRun) Run(ctx context.Context, args []string) ([]byte, error) {
+	if d.Reads != nil {
+		return d.Reads.Run(ctx, args)
+	}
+	d.record(args, "")
+	return nil, DryRunNoReads
+}
+
+func (d *DryRun) ExecuteStdin(ctx context.Context, in, exe string, args ...string) error {
+	d.record(append([]string{exe}, args...), in)
+	return nil
+}
+
+func (d *DryRun) record(command []string, in string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.commands = append(d.commands, DryRunCommand{Command: append([]string{}, command...), Stdin: in})
+}
+
+// Commands returns every command recorded so far, in order.
+func (d *DryRun) Commands() []DryRunCommand {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]DryRunCommand{}, d.commands...)
+}
+
+// Reset forgets the recorded commands.
+func (d *DryRun) Reset() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.commands = nil
+}
+
+// Script renders the recorded ipvsadm commands as input for `ipvsadm -R`.
+// Commands that only read state, and commands for other tools, are left out.
+func (d *DryRun) Script() string {
+	a := make([]string, 0, 0)
+	for _, c := range d.Commands() {
+		if len(c.Command) < 2 || c.Command[0] != "ipvsadm" {
+			continue
+		}
+		switch c.Command[1] {
+		case "-R", "--restore":
+			a = append(a, strings.TrimSuffix(c.Stdin, "\n"))
+		case "-S", "--save", "-L", "-l", "--list", "-v", "--version", "-h", "--help":
+		default:
+			a = append(a, strings.Join(c.Command[1:], " "))
+		}
+	}
+	if len(a) == 0 {
+		return ""
+	}
+	return strings.Join(a, "\n") + "\n"
+}
+
+func (c DryRunCommand) String() string {
+	return strings.Join(c.Command, " ")
+}
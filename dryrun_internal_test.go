@@ -0,0 +1,79 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestDryRun(test *testing.T) {
+	dryRun := &DryRun{}
+	SetBackend(dryRun)
+	defer useFakes()
+
+	ipvs := &Ipvs{}
+	err := ipvs.AddService(Service{Host: "10.0.0.1", Port: 80, Scheduler: "rr", Servers: []Server{{Host: "10.0.0.2", Port: 80, Weight: 1}}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	err = ipvs.Services[0].EditServer(Server{Host: "10.0.0.2", Port: 80, Weight: 5})
+	if err != nil {
+		test.Fatal(err)
+	}
+	err = ipvs.Restore([]Service{{Host: "10.0.0.3", Port: 53, Type: "udp", Scheduler: "rr"}})
+	if err != nil {
+		test.Fatal(err)
+	}
+	ipvs.Clear()
+
+	commands := dryRun.Commands()
+	if len(commands) != 5 {
+		test.Fatalf("expected 5 commands, got %v", commands)
+	}
+	if commands[0].String() != "ipvsadm -A -t 10.0.0.1:80 -s rr" {
+		test.Errorf("unexpected command %q", commands[0])
+	}
+	if commands[3].String() != "ipvsadm -R" || commands[3].Stdin == "" {
+		test.Errorf("unexpected restore %+v", commands[3])
+	}
+
+	expected := `-A -t 10.0.0.1:80 -s rr
+-a -t 10.0.0.1:80 -r 10.0.0.2:80 -g -y 0 -x 0 -w 1
+-e -t 10.0.0.1:80 -r 10.0.0.2:80 -g -y 0 -x 0 -w 5
+-A -u 10.0.0.3:53 -s rr
+-C
+`
+	if dryRun.Script() != expected {
+		test.Errorf("unexpected script:\n%q\nexpected:\n%q", dryRun.Script(), expected)
+	}
+	if len(ipvs.Services) != 0 {
+		test.Errorf("the model should have been cleared, has %v", ipvs.Services)
+	}
+
+	dryRun.Reset()
+	if len(dryRun.Commands()) != 0 {
+		test.Error("Reset should forget recorded commands")
+	}
+
+	// without Reads nothing is read, so Save leaves the model alone
+	ipvs.AddService(Service{Host: "10.0.0.1", Port: 80, Scheduler: "rr"})
+	if err := ipvs.Save(); !errors.Is(err, DryRunNoReads) {
+		test.Errorf("expected DryRunNoReads, got %v", err)
+	}
+	if len(ipvs.Services) != 1 {
+		test.Errorf("Save should leave the model alone, has %v", ipvs.Services)
+	}
+
+	simulator := NewSimulator()
+	simulator.Run(context.Background(), []string{"ipvsadm", "-A", "-t", "10.0.0.9:80"})
+	dryRun.Reads = simulator
+	if err := ipvs.Save(); err != nil || len(ipvs.Services) != 1 || ipvs.Services[0].Host != "10.0.0.9" {
+		test.Errorf("Save should read from Reads: %v %v", err, ipvs.Services)
+	}
+}
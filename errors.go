@@ -0,0 +1,120 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+type (
+	// IpvsError is returned when a command fails. Kind is one of Conflict,
+	// NotFound or DeleteFailed when the failure could be classified, so
+	// errors.Is(err, NotFound) can be used on the result of any operation.
+	// errors.Is(err, Transient) holds when the kernel reported a failure
+	// that may not happen again and the object was not found to exist or be
+	// missing.
+	IpvsError struct {
+		Command  []string
+		ExitCode int
+		Output   string
+		Kind     error
+		Err      error
+	}
+)
+
+var (
+	// ipvsErrorMessages maps the messages ipvsadm prints for kernel errors
+	// to the error they represent.
+	ipvsErrorMessages = []struct {
+		message string
+		kind    error
+	}{
+		{"Service already exists", Conflict},
+		{"Destination already exists", Conflict},
+		{"No such service", NotFound},
+		{"Service not defined", NotFound},
+		{"No such destination", NotFound},
+	}
+
+	// transientMessages are the messages ipvsadm prints for kernel errors
+	// worth retrying
+	transientMessages = []string{
+		"Device or resource busy",
+		"Resource temporarily unavailable",
+		"Interrupted system call",
+		"Memory allocation problem",
+		"netlink",
+	}
+)
+
+func (e *IpvsError) Error() string {
+	msg := strings.Join(e.Command, " ")
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	if output := strings.TrimSpace(e.Output); output != "" {
+		msg += ": " + output
+	}
+	return msg
+}
+
+func (e *IpvsError) Unwrap() error {
+	return e.Err
+}
+
+func (e *IpvsError) Is(target error) bool {
+	if target == Transient {
+		if e.Kind == Conflict || e.Kind == NotFound {
+			return false
+		}
+		for _, message := range transientMessages {
+			if strings.Contains(e.Output, message) {
+				return true
+			}
+		}
+		return false
+	}
+	return e.Kind != nil && e.Kind == target
+}
+
+// newIpvsError wraps the failure of command, classifying it by the output it
+// produced.
+func newIpvsError(command []string, err error, output []byte) error {
+	e := &IpvsError{
+		Command:  command,
+		ExitCode: -1,
+		Output:   string(output),
+		Err:      err,
+		Kind:     classify(command, string(output)),
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		e.ExitCode = exitErr.ExitCode()
+	}
+	return e
+}
+
+func classify(command []string, output string) error {
+	for _, m := range ipvsErrorMessages {
+		if strings.Contains(output, m.message) {
+			return m.kind
+		}
+	}
+	// any other failure to delete still leaves the object in place
+	if len(command) == 0 || !strings.HasSuffix(command[0], "ipvsadm") {
+		return nil
+	}
+	for _, arg := range command[1:] {
+		switch arg {
+		case "-D", "--delete-service", "-d", "--delete-server", "-C", "--clear":
+			return DeleteFailed
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestExecuteErrors(test *testing.T) {
+	err := execute(context.Background(), "sh", "-c", "echo 'Service already exists' >&2; exit 2")
+	var ipvsErr *IpvsError
+	if !errors.As(err, &ipvsErr) {
+		test.Fatalf("expected an *IpvsError, got %#v", err)
+	}
+	if ipvsErr.ExitCode != 2 || ipvsErr.Command[0] != "sh" {
+		test.Errorf("unexpected error %#v", ipvsErr)
+	}
+	if !errors.Is(err, Conflict) || errors.Is(err, NotFound) {
+		test.Errorf("error was misclassified: %v", err)
+	}
+
+	err = executeStdin(context.Background(), "", "sh", "-c", "cat >/dev/null; echo 'No such destination'; exit 1")
+	if !errors.Is(err, NotFound) {
+		test.Errorf("expected NotFound, got %v", err)
+	}
+
+	_, err = run(context.Background(), []string{"sh", "-c", "echo 'Service not defined'; exit 1"})
+	if !errors.Is(err, NotFound) {
+		test.Errorf("expected NotFound, got %v", err)
+	}
+}
+
+func TestClassify(test *testing.T) {
+	cases := []struct {
+		command []string
+		output  string
+		kind    error
+	}{
+		{[]string{"ipvsadm", "-a", "-t", "10.0.0.1:80", "-r", "10.0.0.2:80"}, "Destination already exists\n", Conflict},
+		{[]string{"ipvsadm", "-E", "-t", "10.0.0.1:80", "-s", "rr"}, "Memory allocation problem\nNo such service\n", NotFound},
+		{[]string{"ipvsadm", "-D", "-t", "10.0.0.1:80"}, "Device or resource busy\n", DeleteFailed},
+		{[]string{"iptables", "-d", "10.0.0.1"}, "Bad argument\n", nil},
+	}
+	for i := range cases {
+		if kind := classify(cases[i].command, cases[i].output); kind != cases[i].kind {
+			test.Errorf("case %d: expected %v got %v", i, cases[i].kind, kind)
+		}
+	}
+}
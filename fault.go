@@ -0,0 +1,183 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// FaultBackend wraps another Backend and injects faults into the
+	// commands sent to it, for testing how callers cope with failures.
+	FaultBackend struct {
+		Backend Backend
+		// Seed makes Percent faults repeatable.
+		Seed int64
+
+		mutex    sync.Mutex
+		faults   []*Fault
+		commands int
+		random   *rand.Rand
+	}
+
+	// Fault describes which commands to disturb and how. A fault applies to
+	// a command when every condition that is set holds: Nth is the 1 based
+	// position of the command among all commands the backend has seen,
+	// Match is tested against the space joined command line and Percent is
+	// the chance of applying. Times limits how often it applies, 0 means
+	// no limit.
+	//
+	// An applied fault waits Latency, then fails with Err if set, before the
+	// command runs or, with AfterRun, after it has taken effect. Truncate
+	// cuts the output of commands run for their output, like Save, to that
+	// many bytes.
+	Fault struct {
+		Nth      int
+		Match    *regexp.Regexp
+		Percent  float64
+		Times    int
+		Latency  time.Duration
+		Err      error
+		AfterRun bool
+		Truncate int
+
+		applied int
+	}
+)
+
+var (
+	InjectedFault = errors.New("injected fault")
+)
+
+func NewFaultBackend(b Backend, faults ...Fault) *FaultBackend {
+	f := &FaultBackend{Backend: b}
+	for i := range faults {
+		f.Add(faults[i])
+	}
+	return f
+}
+
+// Add adds a fault to the backend.
+func (f *FaultBackend) Add(fault Fault) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.faults = append(f.faults, &fault)
+}
+
+// Reset removes every fault and restarts the command count.
+func (f *FaultBackend) Reset() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.faults = nil
+	f.commands = 0
+}
+
+// Commands returns how many commands the backend has seen.
+func (f *FaultBackend) Commands() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.commands
+}
+
+func (f *FaultBackend) Execute(ctx context.Context, exe string, args ...string) error {
+	_, err := f.do(ctx, append([]string{exe}, args...), func() ([]byte, error) {
+		return nil, f.Backend.Execute(ctx, exe, args...)
+	})
+	return err
+}
+
+func (f *FaultBackend) ExecuteOutput(ctx context.Context, exe string, args ...string) ([]byte, error) {
+	return f.do(ctx, append([]string{exe}, args...), func() ([]byte, error) {
+		return executeOutputOf(f.Backend, ctx, exe, args...)
+	})
+}
+
+func (f *FaultBackend) Run(ctx context.Context, args []string) ([]byte, error) {
+	return f.do(ctx, args, func() ([]byte, error) {
+		return f.Backend.Run(ctx, args)
+	})
+}
+
+func (f *FaultBackend) ExecuteStdin(ctx context.Context, in, exe string, args ...string) error {
+	_, err := f.do(ctx, append([]string{exe}, args...), func() ([]byte, error) {
+		return nil, f.Backend.ExecuteStdin(ctx, in, exe, args...)
+	})
+	return err
+}
+
+func (f *FaultBackend) ExecuteStdinOutput(ctx context.Context, in, exe string, args ...string) ([]byte, error) {
+	return f.do(ctx, append([]string{exe}, args...), func() ([]byte, error) {
+		return executeStdinOutputOf(f.Backend, ctx, in, exe, args...)
+	})
+}
+
+func (f *FaultBackend) do(ctx context.Context, command []string, call func() ([]byte, error)) ([]byte, error) {
+	faults := f.match(command)
+
+	for _, fault := range faults {
+		if fault.Latency > 0 {
+			select {
+			case <-time.After(fault.Latency):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if fault.Err != nil && !fault.AfterRun {
+			return nil, fault.Err
+		}
+	}
+
+	out, err := call()
+	if err != nil {
+		return out, err
+	}
+	for _, fault := range faults {
+		if fault.Err != nil && fault.AfterRun {
+			return nil, fault.Err
+		}
+		if fault.Truncate > 0 && fault.Truncate < len(out) {
+			out = out[:fault.Truncate]
+		}
+	}
+	return out, nil
+}
+
+// match counts the command and returns the faults that apply to it.
+func (f *FaultBackend) match(command []string) []*Fault {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.commands++
+	if f.random == nil {
+		f.random = rand.New(rand.NewSource(f.Seed))
+	}
+
+	line := strings.Join(command, " ")
+	faults := make([]*Fault, 0, 0)
+	for _, fault := range f.faults {
+		if fault.Times > 0 && fault.applied >= fault.Times {
+			continue
+		}
+		if fault.Nth > 0 && fault.Nth != f.commands {
+			continue
+		}
+		if fault.Match != nil && !fault.Match.MatchString(line) {
+			continue
+		}
+		if fault.Percent > 0 && f.random.Float64()*100 >= fault.Percent {
+			continue
+		}
+		fault.applied++
+		faults = append(faults, fault)
+	}
+	return faults
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestFaultNth(test *testing.T) {
+	simulator := NewSimulator()
+	SetBackend(NewFaultBackend(simulator, Fault{Nth: 3, Err: InjectedFault}))
+	defer useFakes()
+
+	ipvs := &Ipvs{}
+	err := ipvs.AddService(testServices[0])
+	if !errors.Is(err, InjectedFault) {
+		test.Fatalf("expected InjectedFault, got %v", err)
+	}
+	// the service and first server made it into the kernel, the model
+	// was left alone
+	table := simulator.Ipvs()
+	if len(table.Services) != 1 || len(table.Services[0].Servers) != 1 {
+		test.Errorf("unexpected table %+v", table.Services)
+	}
+	if len(ipvs.Services) != 0 {
+		test.Errorf("model should not have been updated: %+v", ipvs.Services)
+	}
+}
+
+func TestFaultMatchAfterRun(test *testing.T) {
+	simulator := NewSimulator()
+	faults := NewFaultBackend(simulator, Fault{Match: regexp.MustCompile(`^ipvsadm -R`), Err: InjectedFault, AfterRun: true, Times: 1})
+	SetBackend(faults)
+	defer useFakes()
+
+	ipvs := &Ipvs{}
+	if err := ipvs.Restore(testServices); !errors.Is(err, InjectedFault) {
+		test.Fatalf("expected InjectedFault, got %v", err)
+	}
+	if len(simulator.Ipvs().Services) != 2 {
+		test.Error("the restore should have taken effect")
+	}
+	// Times limits the fault to the first restore
+	if err := ipvs.Restore(testServices[:1]); !errors.Is(err, Conflict) {
+		test.Errorf("expected the simulator's Conflict, got %v", err)
+	}
+	if faults.Commands() != 2 {
+		test.Errorf("expected 2 commands, got %d", faults.Commands())
+	}
+}
+
+func TestFaultPercent(test *testing.T) {
+	count := func() int {
+		faults := NewFaultBackend(NewSimulator(), Fault{Percent: 25, Err: InjectedFault})
+		faults.Seed = 42
+		failed := 0
+		for i := 0; i < 400; i++ {
+			if faults.Execute(context.Background(), "ipvsadm", "-C") != nil {
+				failed++
+			}
+		}
+		return failed
+	}
+	failed := count()
+	if failed < 60 || failed > 140 {
+		test.Errorf("expected about 100 failures, got %d", failed)
+	}
+	if count() != failed {
+		test.Error("the same seed should fail the same commands")
+	}
+}
+
+func TestFaultLatencyAndTruncate(test *testing.T) {
+	simulator := NewSimulator()
+	simulator.ExecuteStdin(context.Background(), "-A -t 10.0.0.1:80 -s rr\n-A -t 10.0.0.2:80 -s rr\n", "ipvsadm", "-R")
+	SetBackend(NewFaultBackend(simulator,
+		Fault{Match: regexp.MustCompile(`-S`), Truncate: len("-A -t 10.0.0.1:80 -s rr\n")},
+		Fault{Match: regexp.MustCompile(`-Z`), Latency: time.Second},
+	))
+	defer useFakes()
+
+	ipvs := &Ipvs{}
+	if err := ipvs.Save(); err != nil {
+		test.Fatal(err)
+	}
+	if len(ipvs.Services) != 1 {
+		test.Errorf("expected the truncated save to hold 1 service, got %+v", ipvs.Services)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := ipvs.ZeroContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		test.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+}
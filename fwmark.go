@@ -0,0 +1,367 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type (
+	// FwMarkRule describes traffic that the firewall should mark so that it
+	// is picked up by the fwmark service with the same mark.
+	FwMarkRule struct {
+		FwMark   int    `json:"fwmark"`
+		Host     string `json:"host"`
+		Protocol string `json:"protocol"`
+		Ports    string `json:"ports"`
+	}
+
+	portRange struct {
+		first int
+		last  int
+	}
+)
+
+var (
+	// FwMarkFirewall is the tool used to install fwmark rules, either "nft"
+	// or "iptables".
+	FwMarkFirewall = "nft"
+	// FwMarkComment tags every rule this package manages, rules without it
+	// are never touched. It must not contain spaces.
+	FwMarkComment = "golang-lvs"
+
+	FwMarkTable = "lvs"
+	FwMarkChain = "prerouting"
+
+	InvalidFwMark         = errors.New("Invalid Firewall Mark")
+	InvalidFwMarkHost     = errors.New("Invalid Firewall Mark Host")
+	InvalidFwMarkProtocol = errors.New("Invalid Firewall Mark Protocol")
+	InvalidFwMarkPorts    = errors.New("Invalid Firewall Mark Ports")
+	InvalidFwMarkFirewall = errors.New("Invalid Firewall Mark Firewall")
+)
+
+func (r FwMarkRule) Validate() error {
+	if r.FwMark <= 0 {
+		return InvalidFwMark
+	}
+	if _, err := r.family(); err != nil {
+		return err
+	}
+	switch r.Protocol {
+	case "", "tcp", "udp", "sctp":
+	default:
+		return InvalidFwMarkProtocol
+	}
+	ports, err := r.portRanges()
+	if err != nil {
+		return err
+	}
+	if len(ports) != 0 && r.Protocol == "" {
+		return InvalidFwMarkProtocol
+	}
+	return nil
+}
+
+// family returns 4 or 6 depending on the address family of the rule's host,
+// which may be a single address or a network in cidr notation.
+func (r FwMarkRule) family() (int, error) {
+	ip := net.ParseIP(r.Host)
+	if ip == nil {
+		var err error
+		ip, _, err = net.ParseCIDR(r.Host)
+		if err != nil {
+			return 0, InvalidFwMarkHost
+		}
+	}
+	if ip.To4() != nil {
+		return 4, nil
+	}
+	return 6, nil
+}
+
+// portRanges parses a list like "80,443,8000-8100" into sorted ranges.
+func (r FwMarkRule) portRanges() ([]portRange, error) {
+	ranges := make([]portRange, 0, 0)
+	if strings.TrimSpace(r.Ports) == "" {
+		return ranges, nil
+	}
+	for _, part := range strings.Split(r.Ports, ",") {
+		bounds := strings.FieldsFunc(strings.TrimSpace(part), func(c rune) bool { return c == '-' || c == ':' })
+		if len(bounds) < 1 || len(bounds) > 2 {
+			return nil, InvalidFwMarkPorts
+		}
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, InvalidFwMarkPorts
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, InvalidFwMarkPorts
+			}
+		}
+		if first < 1 || last > 65535 || first > last {
+			return nil, InvalidFwMarkPorts
+		}
+		ranges = append(ranges, portRange{first, last})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].first < ranges[j].first })
+	return ranges, nil
+}
+
+func (p portRange) format(sep string) string {
+	if p.first == p.last {
+		return strconv.Itoa(p.first)
+	}
+	return fmt.Sprintf("%d%s%d", p.first, sep, p.last)
+}
+
+// nft renders the rule the way `nft list chain` prints it back.
+func (r FwMarkRule) nft() (string, error) {
+	if err := r.Validate(); err != nil {
+		return "", err
+	}
+	family, _ := r.family()
+	ports, _ := r.portRanges()
+
+	a := make([]string, 0, 0)
+	if family == 4 {
+		a = append(a, "ip", "daddr", r.Host)
+	} else {
+		a = append(a, "ip6", "daddr", r.Host)
+	}
+	switch {
+	case len(ports) == 1:
+		a = append(a, r.Protocol, "dport", ports[0].format("-"))
+	case len(ports) > 1:
+		set := make([]string, 0, len(ports))
+		for i := range ports {
+			set = append(set, ports[i].format("-"))
+		}
+		a = append(a, r.Protocol, "dport", "{ "+strings.Join(set, ", ")+" }")
+	case r.Protocol != "":
+		a = append(a, "meta", "l4proto", r.Protocol)
+	}
+	a = append(a, "meta", "mark", "set", fmt.Sprintf("0x%08x", r.FwMark), "comment", `"`+FwMarkComment+`"`)
+	return strings.Join(a, " "), nil
+}
+
+// iptables renders the rule the way `iptables -S` prints it back.
+func (r FwMarkRule) iptables() (string, error) {
+	if err := r.Validate(); err != nil {
+		return "", err
+	}
+	family, _ := r.family()
+	ports, _ := r.portRanges()
+
+	host := r.Host
+	if !strings.Contains(host, "/") {
+		if family == 4 {
+			host += "/32"
+		} else {
+			host += "/128"
+		}
+	}
+	a := []string{"-A", strings.ToUpper(FwMarkChain), "-d", host}
+	if r.Protocol != "" {
+		a = append(a, "-p", r.Protocol)
+	}
+	if len(ports) != 0 {
+		list := make([]string, 0, len(ports))
+		for i := range ports {
+			list = append(list, ports[i].format(":"))
+		}
+		a = append(a, "-m", "multiport", "--dports", strings.Join(list, ","))
+	}
+	a = append(a, "-m", "comment", "--comment", FwMarkComment,
+		"-j", "MARK", "--set-xmark", fmt.Sprintf("0x%x/0xffffffff", r.FwMark))
+	return strings.Join(a, " "), nil
+}
+
+func (r FwMarkRule) iptablesTool() string {
+	family, _ := r.family()
+	if family == 6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+// RenderFwMarkRules returns the rules as FwMarkFirewall would list them.
+func RenderFwMarkRules(rules []FwMarkRule) ([]string, error) {
+	rendered := make([]string, 0, len(rules))
+	for i := range rules {
+		var rule string
+		var err error
+		switch FwMarkFirewall {
+		case "nft":
+			rule, err = rules[i].nft()
+		case "iptables":
+			rule, err = rules[i].iptables()
+		default:
+			err = InvalidFwMarkFirewall
+		}
+		if err != nil {
+			return nil, err
+		}
+		rendered = append(rendered, rule)
+	}
+	return rendered, nil
+}
+
+// ApplyFwMarkRules makes the firewall mark exactly the traffic described by
+// rules. Existing rules that carry FwMarkComment but are no longer wanted are
+// removed, rules that are already present are left alone.
+func ApplyFwMarkRules(rules []FwMarkRule) error {
+	return ApplyFwMarkRulesContext(context.Background(), rules)
+}
+
+func ApplyFwMarkRulesContext(ctx context.Context, rules []FwMarkRule) error {
+	switch FwMarkFirewall {
+	case "nft":
+		return applyNftRules(ctx, rules)
+	case "iptables":
+		return applyIptablesRules(ctx, rules)
+	}
+	return InvalidFwMarkFirewall
+}
+
+func applyNftRules(ctx context.Context, rules []FwMarkRule) error {
+	wanted := make(map[string]bool)
+	order := make([]string, 0, len(rules))
+	for i := range rules {
+		rule, err := rules[i].nft()
+		if err != nil {
+			return err
+		}
+		if !wanted[rule] {
+			order = append(order, rule)
+		}
+		wanted[rule] = true
+	}
+
+	// adding an existing table or chain is a no-op in nftables
+	err := command(ctx, "nft", "add", "table", "inet", FwMarkTable)
+	if err != nil {
+		return err
+	}
+	err = command(ctx, "nft", "add", "chain", "inet", FwMarkTable, FwMarkChain,
+		"{ type filter hook prerouting priority mangle; }")
+	if err != nil {
+		return err
+	}
+	out, err := commandOutput(ctx, []string{"nft", "-a", "list", "chain", "inet", FwMarkTable, FwMarkChain})
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		idx := strings.LastIndex(line, " # handle ")
+		if idx == -1 || !strings.Contains(line, `comment "`+FwMarkComment+`"`) {
+			continue
+		}
+		rule, handle := line[:idx], strings.TrimSpace(line[idx+len(" # handle "):])
+		if wanted[rule] && !existing[rule] {
+			existing[rule] = true
+			continue
+		}
+		err = command(ctx, "nft", "delete", "rule", "inet", FwMarkTable, FwMarkChain, "handle", handle)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range order {
+		if existing[rule] {
+			continue
+		}
+		err = command(ctx, "nft", "add", "rule", "inet", FwMarkTable, FwMarkChain, rule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyIptablesRules(ctx context.Context, rules []FwMarkRule) error {
+	wanted := map[string]map[string]bool{"iptables": {}, "ip6tables": {}}
+	order := map[string][]string{}
+	for i := range rules {
+		rule, err := rules[i].iptables()
+		if err != nil {
+			return err
+		}
+		tool := rules[i].iptablesTool()
+		if !wanted[tool][rule] {
+			order[tool] = append(order[tool], rule)
+		}
+		wanted[tool][rule] = true
+	}
+
+	chain := strings.ToUpper(FwMarkChain)
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		out, err := commandOutput(ctx, []string{tool, "-t", "mangle", "-S", chain})
+		if err != nil {
+			// a host without ip6tables is fine as long as nothing needs it
+			if len(order[tool]) == 0 {
+				continue
+			}
+			return err
+		}
+
+		existing := make(map[string]bool)
+		for _, line := range strings.Split(string(out), "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "-A "+chain+" ") || !strings.Contains(line, "--comment "+FwMarkComment+" ") {
+				continue
+			}
+			if wanted[tool][line] && !existing[line] {
+				existing[line] = true
+				continue
+			}
+			spec := strings.Fields(line)[2:]
+			err = command(ctx, tool, append([]string{"-t", "mangle", "-D", chain}, spec...)...)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, rule := range order[tool] {
+			if existing[rule] {
+				continue
+			}
+			err = command(ctx, tool, append([]string{"-t", "mangle"}, strings.Fields(rule)...)...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyFwMarkRules applies rules after checking that every mark belongs to
+// one of the fwmark services in i.
+func (i Ipvs) ApplyFwMarkRules(rules []FwMarkRule) error {
+	return i.ApplyFwMarkRulesContext(context.Background(), rules)
+}
+
+func (i Ipvs) ApplyFwMarkRulesContext(ctx context.Context, rules []FwMarkRule) error {
+	for j := range rules {
+		if i.FindService("fwmark", strconv.Itoa(rules[j].FwMark), 0) == nil {
+			return NotFound
+		}
+	}
+	return ApplyFwMarkRulesContext(ctx, rules)
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFwMarkRender(test *testing.T) {
+	rules := []FwMarkRule{
+		{FwMark: 1, Host: "10.0.0.1", Protocol: "tcp", Ports: "8000-8100,80"},
+		{FwMark: 2, Host: "fd00::1", Protocol: "udp", Ports: "53"},
+		{FwMark: 3, Host: "10.0.1.0/24"},
+	}
+
+	FwMarkFirewall = "nft"
+	rendered, err := RenderFwMarkRules(rules)
+	if err != nil {
+		test.Fatal(err)
+	}
+	expected := []string{
+		`ip daddr 10.0.0.1 tcp dport { 80, 8000-8100 } meta mark set 0x00000001 comment "golang-lvs"`,
+		`ip6 daddr fd00::1 udp dport 53 meta mark set 0x00000002 comment "golang-lvs"`,
+		`ip daddr 10.0.1.0/24 meta mark set 0x00000003 comment "golang-lvs"`,
+	}
+	for i := range expected {
+		if rendered[i] != expected[i] {
+			test.Errorf("nft rule %d: expected %q got %q", i, expected[i], rendered[i])
+		}
+	}
+
+	FwMarkFirewall = "iptables"
+	defer func() { FwMarkFirewall = "nft" }()
+	rendered, err = RenderFwMarkRules(rules[:1])
+	if err != nil {
+		test.Fatal(err)
+	}
+	if rendered[0] != "-A PREROUTING -d 10.0.0.1/32 -p tcp -m multiport --dports 80,8000:8100 -m comment --comment golang-lvs -j MARK --set-xmark 0x1/0xffffffff" {
+		test.Errorf("unexpected iptables rule %q", rendered[0])
+	}
+}
+
+func TestFwMarkValidate(test *testing.T) {
+	invalid := []FwMarkRule{
+		{FwMark: 0, Host: "10.0.0.1"},
+		{FwMark: 1, Host: "nope"},
+		{FwMark: 1, Host: "10.0.0.1", Ports: "80"},
+		{FwMark: 1, Host: "10.0.0.1", Protocol: "tcp", Ports: "90-80"},
+		{FwMark: 1, Host: "10.0.0.1", Protocol: "icmp"},
+	}
+	for i := range invalid {
+		if invalid[i].Validate() == nil {
+			test.Errorf("rule %d should not validate", i)
+		}
+	}
+}
+
+func TestFwMarkApplyNft(test *testing.T) {
+	backend, backendRun = fakeExecute, fakeRun
+	fakeCommands = nil
+	fakeRunOutput = []byte(`table inet lvs {
+	chain prerouting {
+		type filter hook prerouting priority mangle; policy accept;
+		ip daddr 10.0.0.1 tcp dport 80 meta mark set 0x00000001 comment "golang-lvs" # handle 4
+		ip daddr 10.0.0.9 tcp dport 80 meta mark set 0x00000009 comment "golang-lvs" # handle 5
+		ip daddr 10.0.0.9 tcp dport 80 meta mark set 0x00000009 comment "someone-else" # handle 6
+	}
+}
+`)
+	defer func() { fakeRunOutput = nil }()
+
+	err := ApplyFwMarkRules([]FwMarkRule{
+		{FwMark: 1, Host: "10.0.0.1", Protocol: "tcp", Ports: "80"},
+		{FwMark: 2, Host: "10.0.0.2", Protocol: "tcp", Ports: "443"},
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	commands := make([]string, 0, 0)
+	for i := range fakeCommands {
+		commands = append(commands, strings.Join(fakeCommands[i], " "))
+	}
+	expected := []string{
+		"nft add table inet lvs",
+		"nft add chain inet lvs prerouting { type filter hook prerouting priority mangle; }",
+		"nft -a list chain inet lvs prerouting",
+		"nft delete rule inet lvs prerouting handle 5",
+		`nft add rule inet lvs prerouting ip daddr 10.0.0.2 tcp dport 443 meta mark set 0x00000002 comment "golang-lvs"`,
+	}
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		test.Errorf("unexpected commands:\n%s", strings.Join(commands, "\n"))
+	}
+}
+
+func TestFwMarkService(test *testing.T) {
+	service := Service{Type: "fwmark", FwMark: 7, Scheduler: "rr"}
+	if err := service.Validate(); err != nil {
+		test.Fatal(err)
+	}
+	if !strings.HasPrefix(service.String(), "-A -f 7 -s rr") {
+		test.Errorf("unexpected service string %q", service.String())
+	}
+	c, err := parseIpvsadmArgs(strings.Fields("-A -f 7 -s rr"))
+	parsed := c.service
+	if err != nil || parsed.FwMark != 7 || parsed.Type != "fwmark" {
+		test.Errorf("unexpected parsed service %+v %v", parsed, err)
+	}
+	ipvs := Ipvs{Services: []Service{parsed}}
+	if ipvs.FindService("fwmark", "7", 0) == nil {
+		test.Error("failed to find fwmark service by mark")
+	}
+	if (Service{Type: "fwmark"}).Validate() != InvalidFwMark {
+		test.Error("fwmark service without a mark should not validate")
+	}
+}
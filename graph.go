@@ -0,0 +1,170 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type (
+	// GraphOptions changes what WriteDot and WriteMermaid draw.
+	GraphOptions struct {
+		// Stats, if set, returns the traffic to show on a service, or on
+		// one of its servers when server is not nil. Services and servers
+		// it returns false for are drawn without traffic.
+		Stats func(service Service, server *Server) (GraphStats, bool)
+	}
+
+	// GraphStats is the traffic shown on a service or server.
+	GraphStats struct {
+		Connections uint64
+		Packets     uint64
+		Bytes       uint64
+	}
+
+	// graphNode is a service or server as it is drawn.
+	graphNode struct {
+		id       string
+		label    []string
+		edge     string
+		quiesced bool
+	}
+)
+
+var (
+	// the names `ipvsadm -L` gives forwarders
+	graphForwarders = map[string]string{
+		"g": "Route",
+		"i": "Tunnel",
+		"m": "Masq",
+	}
+)
+
+func (s GraphStats) String() string {
+	return fmt.Sprintf("%d conns, %d pkts, %d bytes", s.Connections, s.Packets, s.Bytes)
+}
+
+// WriteDot draws i as a Graphviz digraph: each service is a node in a
+// cluster with its servers, joined to them by edges labelled with the
+// forwarder and weight. Quiesced servers, with a weight of 0, are dashed.
+func (i Ipvs) WriteDot(w io.Writer, options GraphOptions) error {
+	b := bufio.NewWriter(w)
+	b.WriteString("digraph ipvs {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box];\n")
+	i.graph(options, func(service graphNode, servers []graphNode) {
+		fmt.Fprintf(b, "  subgraph %s {\n", dotQuote("cluster_"+service.id))
+		fmt.Fprintf(b, "    label=%s;\n", dotQuote(service.label[0]))
+		fmt.Fprintf(b, "    %s [label=%s, shape=ellipse];\n", dotQuote(service.id), dotQuote(strings.Join(service.label, "\n")))
+		for _, server := range servers {
+			style := ""
+			if server.quiesced {
+				style = ", style=dashed, fontcolor=gray"
+			}
+			fmt.Fprintf(b, "    %s [label=%s%s];\n", dotQuote(server.id), dotQuote(strings.Join(server.label, "\n")), style)
+		}
+		b.WriteString("  }\n")
+		for _, server := range servers {
+			style := ""
+			if server.quiesced {
+				style = ", style=dashed, color=gray"
+			}
+			fmt.Fprintf(b, "  %s -> %s [label=%s%s];\n", dotQuote(service.id), dotQuote(server.id), dotQuote(server.edge), style)
+		}
+	})
+	b.WriteString("}\n")
+	return b.Flush()
+}
+
+// WriteMermaid draws i as a Mermaid flowchart, laid out like WriteDot, with
+// quiesced servers in the quiesced class and joined by dotted edges.
+func (i Ipvs) WriteMermaid(w io.Writer, options GraphOptions) error {
+	b := bufio.NewWriter(w)
+	b.WriteString("flowchart LR\n")
+	i.graph(options, func(service graphNode, servers []graphNode) {
+		fmt.Fprintf(b, "  subgraph %s_group[%s]\n", service.id, mermaidQuote(service.label[0]))
+		fmt.Fprintf(b, "    %s([%s])\n", service.id, mermaidQuote(strings.Join(service.label, "<br/>")))
+		for _, server := range servers {
+			class := ""
+			if server.quiesced {
+				class = ":::quiesced"
+			}
+			fmt.Fprintf(b, "    %s[%s]%s\n", server.id, mermaidQuote(strings.Join(server.label, "<br/>")), class)
+		}
+		b.WriteString("  end\n")
+		for _, server := range servers {
+			if server.quiesced {
+				fmt.Fprintf(b, "  %s -. %s .-> %s\n", service.id, mermaidQuote(server.edge), server.id)
+			} else {
+				fmt.Fprintf(b, "  %s -- %s --> %s\n", service.id, mermaidQuote(server.edge), server.id)
+			}
+		}
+	})
+	b.WriteString("  classDef quiesced stroke-dasharray: 5 5, color:#999\n")
+	return b.Flush()
+}
+
+// graph calls draw with each service of i, normalized, and its servers.
+func (i Ipvs) graph(options GraphOptions, draw func(service graphNode, servers []graphNode)) {
+	i = i.Clone()
+	i.Normalize()
+	for j, service := range i.Services {
+		node := graphNode{id: "s" + strconv.Itoa(j), label: []string{graphName(service)}}
+		scheduling := service.Scheduler
+		if service.Persistence != 0 {
+			scheduling += ", persistent " + strconv.Itoa(service.Persistence) + "s"
+		}
+		node.label = append(node.label, scheduling)
+		if options.Stats != nil {
+			if stats, ok := options.Stats(service, nil); ok {
+				node.label = append(node.label, stats.String())
+			}
+		}
+
+		servers := make([]graphNode, 0, len(service.Servers))
+		for k := range service.Servers {
+			server := service.Servers[k]
+			n := graphNode{
+				id:       fmt.Sprintf("s%d_r%d", j, k),
+				label:    []string{server.getHostPort()},
+				edge:     fmt.Sprintf("%s w=%d", graphForwarders[server.Forwarder], server.Weight),
+				quiesced: server.Weight == 0,
+			}
+			if n.quiesced {
+				n.label = append(n.label, "quiesced")
+			}
+			if options.Stats != nil {
+				if stats, ok := options.Stats(service, &server); ok {
+					n.label = append(n.label, stats.String())
+				}
+			}
+			servers = append(servers, n)
+		}
+		draw(node, servers)
+	}
+}
+
+// graphName is how a service is named in a diagram, such as tcp 10.0.0.1:80.
+func graphName(s Service) string {
+	if s.Type == "fwmark" {
+		return "fwmark " + s.getHost()
+	}
+	return s.Type + " " + s.getHostPort()
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// mermaidQuote quotes a label, mermaid has entity codes rather than escapes.
+func mermaidQuote(s string) string {
+	return `"` + strings.NewReplacer(`"`, "#quot;").Replace(s) + `"`
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var graphTable = Ipvs{Services: []Service{
+	{Type: "udp", Host: "10.0.0.1", Port: 53, Scheduler: "rr", Servers: []Server{{Host: "10.0.1.1", Port: 5353, Forwarder: "m", Weight: 1}}},
+	{Type: "tcp", Host: "10.0.0.1", Port: 80, Scheduler: "wlc", Persistence: 300, Servers: []Server{
+		{Host: "10.0.1.2", Port: 80, Forwarder: "g", Weight: 0},
+		{Host: "10.0.1.1", Port: 80, Forwarder: "g", Weight: 2},
+	}},
+}}
+
+func TestWriteDot(test *testing.T) {
+	out := &bytes.Buffer{}
+	if err := graphTable.WriteDot(out, GraphOptions{}); err != nil {
+		test.Fatal(err)
+	}
+	expected := `digraph ipvs {
+  rankdir=LR;
+  node [shape=box];
+  subgraph "cluster_s0" {
+    label="tcp 10.0.0.1:80";
+    "s0" [label="tcp 10.0.0.1:80\nwlc, persistent 300s", shape=ellipse];
+    "s0_r0" [label="10.0.1.1:80"];
+    "s0_r1" [label="10.0.1.2:80\nquiesced", style=dashed, fontcolor=gray];
+  }
+  "s0" -> "s0_r0" [label="Route w=2"];
+  "s0" -> "s0_r1" [label="Route w=0", style=dashed, color=gray];
+  subgraph "cluster_s1" {
+    label="udp 10.0.0.1:53";
+    "s1" [label="udp 10.0.0.1:53\nrr", shape=ellipse];
+    "s1_r0" [label="10.0.1.1:5353"];
+  }
+  "s1" -> "s1_r0" [label="Masq w=1"];
+}
+`
+	if out.String() != expected {
+		test.Errorf("unexpected dot\n%s", out)
+	}
+}
+
+func TestWriteMermaid(test *testing.T) {
+	out := &bytes.Buffer{}
+	if err := graphTable.WriteMermaid(out, GraphOptions{}); err != nil {
+		test.Fatal(err)
+	}
+	expected := `flowchart LR
+  subgraph s0_group["tcp 10.0.0.1:80"]
+    s0(["tcp 10.0.0.1:80<br/>wlc, persistent 300s"])
+    s0_r0["10.0.1.1:80"]
+    s0_r1["10.0.1.2:80<br/>quiesced"]:::quiesced
+  end
+  s0 -- "Route w=2" --> s0_r0
+  s0 -. "Route w=0" .-> s0_r1
+  subgraph s1_group["udp 10.0.0.1:53"]
+    s1(["udp 10.0.0.1:53<br/>rr"])
+    s1_r0["10.0.1.1:5353"]
+  end
+  s1 -- "Masq w=1" --> s1_r0
+  classDef quiesced stroke-dasharray: 5 5, color:#999
+`
+	if out.String() != expected {
+		test.Errorf("unexpected mermaid\n%s", out)
+	}
+}
+
+func TestGraphStats(test *testing.T) {
+	simulator := NewSimulator()
+	defer useFakes()
+	SetBackend(simulator)
+	ipvs := Ipvs{}
+	if err := ipvs.Restore(graphTable.Clone().Services); err != nil {
+		test.Fatal(err)
+	}
+	if err := simulator.Count("tcp", "10.0.0.1", 80, SimulatorCounters{Connections: 12, Packets: 340, Bytes: 56000}); err != nil {
+		test.Fatal(err)
+	}
+
+	options := GraphOptions{Stats: func(service Service, server *Server) (GraphStats, bool) {
+		if server != nil {
+			return GraphStats{}, false
+		}
+		counters, err := simulator.Counters(service.Type, service.Host, service.Port)
+		return GraphStats(counters), err == nil
+	}}
+	dot, mermaid := &bytes.Buffer{}, &bytes.Buffer{}
+	ipvs.WriteDot(dot, options)
+	ipvs.WriteMermaid(mermaid, options)
+	if !strings.Contains(dot.String(), `"tcp 10.0.0.1:80\nwlc, persistent 300s\n12 conns, 340 pkts, 56000 bytes"`) || !strings.Contains(dot.String(), `"udp 10.0.0.1:53\nrr\n0 conns, 0 pkts, 0 bytes"`) {
+		test.Errorf("expected stats in\n%s", dot)
+	}
+	if !strings.Contains(mermaid.String(), `s0(["tcp 10.0.0.1:80<br/>wlc, persistent 300s<br/>12 conns, 340 pkts, 56000 bytes"])`) {
+		test.Errorf("expected stats in\n%s", mermaid)
+	}
+
+	// labels are quoted for both
+	quoted := Ipvs{Services: []Service{{Type: "tcp", Host: "2001:db8::1", Port: 80, Scheduler: `r"r`}}}
+	dot.Reset()
+	mermaid.Reset()
+	quoted.WriteDot(dot, GraphOptions{})
+	quoted.WriteMermaid(mermaid, GraphOptions{})
+	if !strings.Contains(dot.String(), `"tcp [2001:db8::1]:80\nr\"r"`) || !strings.Contains(mermaid.String(), `"tcp [2001:db8::1]:80<br/>r#quot;r"`) {
+		test.Errorf("unexpected quoting\n%s\n%s", dot, mermaid)
+	}
+}
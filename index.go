@@ -0,0 +1,127 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"strconv"
+)
+
+type (
+	// keyIndex maps keys to positions in a slice. It belongs to the slice it
+	// was built for, identified by its first element and length, and is
+	// ignored when used with any other. Only the methods that change the
+	// slice update it, lookups never write to it and scan the slice when it
+	// belongs to another.
+	keyIndex[T any] struct {
+		first *T
+		n     int
+		keys  map[string]int
+	}
+)
+
+func (x keyIndex[T]) valid(items []T) bool {
+	if x.keys == nil || x.n != len(items) {
+		return false
+	}
+	return len(items) == 0 || x.first == &items[0]
+}
+
+func (x *keyIndex[T]) build(items []T, keys func(T) []string) {
+	x.keys = make(map[string]int, len(items))
+	for j := range items {
+		for _, key := range keys(items[j]) {
+			if _, ok := x.keys[key]; !ok {
+				x.keys[key] = j
+			}
+		}
+	}
+	x.track(items)
+}
+
+func (x *keyIndex[T]) track(items []T) {
+	x.n = len(items)
+	x.first = nil
+	if len(items) != 0 {
+		x.first = &items[0]
+	}
+}
+
+// find returns the position in items of the first item match accepts, or
+// -1. While the index belongs to items a miss of key is trusted, as the
+// methods changing items keep it up to date, and a hit is checked with
+// match. Anything else, such as an item changed in place, is scanned for.
+func (x keyIndex[T]) find(items []T, key string, match func(T) bool) int {
+	if x.valid(items) {
+		j, ok := x.keys[key]
+		if !ok {
+			return -1
+		}
+		if match(items[j]) {
+			return j
+		}
+	}
+	for j := range items {
+		if match(items[j]) {
+			return j
+		}
+	}
+	return -1
+}
+
+// appended records the last element of items, which was just appended to
+// before.
+func (x *keyIndex[T]) appended(before, items []T, keys func(T) []string) {
+	if !x.valid(before) {
+		x.build(items, keys)
+		return
+	}
+	j := len(items) - 1
+	for _, key := range keys(items[j]) {
+		if _, ok := x.keys[key]; !ok {
+			x.keys[key] = j
+		}
+	}
+	x.track(items)
+}
+
+func serviceKey(netType, host string, port int) string {
+	return canonicalServiceKey(canonicalType(netType), canonicalHost(host), port)
+}
+
+// canonicalServiceKey is serviceKey for a type and host already in
+// canonical form.
+func canonicalServiceKey(netType, host string, port int) string {
+	return netType + " " + host + " " + strconv.Itoa(port)
+}
+
+// serviceKeys returns the keys a service can be found by, fwmark services
+// can be found by their mark or host.
+func serviceKeys(s Service) []string {
+	keys := []string{serviceKey(s.Type, s.getHost(), s.Port)}
+	if s.Host != s.getHost() {
+		keys = append(keys, serviceKey(s.Type, s.Host, s.Port))
+	}
+	return keys
+}
+
+func serverKey(host string, port int) string {
+	return canonicalServerKey(canonicalHost(host), port)
+}
+
+func canonicalServerKey(host string, port int) string {
+	return host + " " + strconv.Itoa(port)
+}
+
+// sameHost reports whether host is canonical, a host already in canonical
+// form, without parsing host when it is written the same way.
+func sameHost(host, canonical string) bool {
+	return host == canonical || canonicalHost(host) == canonical
+}
+
+func serverKeys(s Server) []string {
+	return []string{serverKey(s.Host, s.Port)}
+}
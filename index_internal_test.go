@@ -0,0 +1,220 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func indexedServices(n int) []Service {
+	services := make([]Service, 0, n)
+	for j := 0; j < n; j++ {
+		services = append(services, Service{Host: fmt.Sprintf("10.%d.%d.1", j/250, j%250), Port: 80, Type: "tcp", Scheduler: "rr"})
+	}
+	return services
+}
+
+func TestIndexConsistency(test *testing.T) {
+	ipvs := &Ipvs{}
+	ipvs.Restore(indexedServices(10))
+	if s := ipvs.FindService("tcp", "10.0.5.1", 80); s == nil || s.Host != "10.0.5.1" {
+		test.Fatalf("unexpected service %+v", s)
+	}
+	if err := ipvs.AddService(Service{Host: "10.9.9.9", Port: 443, Type: "tcp", FwMark: 0}); err != nil {
+		test.Fatal(err)
+	}
+	if err := ipvs.RemoveService("tcp", "10.0.2.1", 80); err != nil {
+		test.Fatal(err)
+	}
+	if ipvs.FindService("tcp", "10.0.2.1", 80) != nil || ipvs.FindService("tcp", "10.9.9.9", 443) == nil || ipvs.FindService("tcp", "10.0.9.1", 80).Host != "10.0.9.1" {
+		test.Error("index out of date after add and remove")
+	}
+
+	// changes made directly to the slice
+	ipvs.Services = append(ipvs.Services, Service{Host: "10.8.8.8", Port: 80, Type: "udp"})
+	if ipvs.FindService("udp", "10.8.8.8", 80) == nil {
+		test.Error("appended service not found")
+	}
+	ipvs.Reindex()
+	ipvs.Services[0].Host = "10.7.7.7"
+	if ipvs.FindService("tcp", "10.0.0.1", 80) != nil {
+		test.Error("renamed service should not be found")
+	}
+	// the index is trusted until Reindex
+	if ipvs.FindService("tcp", "10.7.7.7", 80) != nil {
+		test.Error("renamed service found before Reindex")
+	}
+	ipvs.Reindex()
+	if s := ipvs.FindService("tcp", "10.7.7.7", 80); s != &ipvs.Services[0] {
+		test.Error("renamed service not found after Reindex")
+	}
+
+	service := ipvs.FindService("tcp", "10.9.9.9", 443)
+	for j := 0; j < 10; j++ {
+		service.AddServer(Server{Host: fmt.Sprintf("10.1.1.%d", j), Port: 443, Forwarder: "g"})
+	}
+	service.RemoveServer("10.1.1.3", 443)
+	service.EditServer(Server{Host: "10.1.1.4", Port: 443, Forwarder: "g", Weight: 5})
+	if service.FindServer("10.1.1.3", 443) != nil || service.FindServer("10.1.1.4", 443).Weight != 5 || service.FindServer("10.1.1.9", 443) == nil {
+		test.Errorf("unexpected servers %+v", service.Servers)
+	}
+
+	fwmark := Service{Host: "10.0.0.1", Type: "fwmark", FwMark: 7}
+	ipvs.AddService(fwmark)
+	if ipvs.FindService("fwmark", "7", 0) == nil || ipvs.FindService("fwmark", "10.0.0.1", 0) == nil {
+		test.Error("fwmark services should be found by mark and host")
+	}
+}
+
+func TestIndexConcurrentLookups(test *testing.T) {
+	ipvs := &Ipvs{}
+	ipvs.Restore(indexedServices(50))
+	ipvs.Services = append(ipvs.Services, Service{Host: "10.9.9.9", Port: 80, Type: "tcp"})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if ipvs.FindService("tcp", "10.0.7.1", 80) == nil || ipvs.FindService("tcp", "10.9.9.9", 80) == nil {
+					test.Error("service not found")
+					return
+				}
+				ipvs.Services[3].FindServer("10.1.1.1", 80)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestIndexValues looks up services and servers of values that can't be
+// addressed.
+func TestIndexValues(test *testing.T) {
+	ipvs := Ipvs{}
+	ipvs.Restore(indexedServices(3))
+	value := func() Ipvs { return ipvs }
+	if value().FindService("tcp", "10.0.1.1", 80) == nil {
+		test.Error("service of a value not found")
+	}
+	if (Service{Servers: []Server{{Host: "10.1.1.1", Port: 80}}}).FindServer("10.1.1.1", 80) == nil {
+		test.Error("server of a value not found")
+	}
+}
+
+func TestIndexSave(test *testing.T) {
+	useSimulator()
+	defer useFakes()
+
+	ipvs := &Ipvs{}
+	ipvs.Restore(indexedServices(5))
+	ipvs.FindService("tcp", "10.0.1.1", 80)
+	saved := &Ipvs{}
+	saved.Save()
+	ipvs.Save()
+	for j := range saved.Services {
+		s := ipvs.FindService("tcp", saved.Services[j].Host, 80)
+		if s == nil || s != &ipvs.Services[j] {
+			test.Errorf("service %d not found after save", j)
+		}
+	}
+}
+
+func benchmarkIpvs(n int) *Ipvs {
+	backend = func(ctx context.Context, exe string, args ...string) error { return nil }
+	backendStdin = func(ctx context.Context, in, exe string, args ...string) error { return nil }
+	ipvs := &Ipvs{}
+	ipvs.Restore(indexedServices(n))
+	return ipvs
+}
+
+func BenchmarkFindService(b *testing.B) {
+	ipvs := benchmarkIpvs(5000)
+	defer useFakes()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ipvs.FindService("tcp", ipvs.Services[n%5000].Host, 80)
+	}
+}
+
+// BenchmarkFindServiceLinear is the scan FindService used to do.
+func BenchmarkFindServiceLinear(b *testing.B) {
+	ipvs := benchmarkIpvs(5000)
+	defer useFakes()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		host := ipvs.Services[n%5000].Host
+		for j := range ipvs.Services {
+			if ipvs.Services[j].matches("tcp", host, 80) {
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkReconcile adds and edits 5000 services, each of which looks the
+// service up first.
+func BenchmarkReconcile(b *testing.B) {
+	services := indexedServices(5000)
+	defer useFakes()
+	for n := 0; n < b.N; n++ {
+		ipvs := benchmarkIpvs(0)
+		for j := range services {
+			ipvs.AddService(services[j])
+		}
+		for j := range services {
+			ipvs.EditService(services[j])
+		}
+	}
+}
+
+// BenchmarkAddService adds services that aren't in the table yet, so the
+// lookup before each add misses the index.
+func BenchmarkAddService(b *testing.B) {
+	services := indexedServices(5000)
+	defer useFakes()
+	ipvs := benchmarkIpvs(0)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if n%len(services) == 0 {
+			b.StopTimer()
+			ipvs = benchmarkIpvs(0)
+			b.StartTimer()
+		}
+		ipvs.AddService(services[n%len(services)])
+	}
+}
+
+// BenchmarkAddServiceLinear is the scan for a missing service AddService
+// used to do.
+func BenchmarkAddServiceLinear(b *testing.B) {
+	services := indexedServices(5000)
+	defer useFakes()
+	ipvs := benchmarkIpvs(0)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if n%len(services) == 0 {
+			b.StopTimer()
+			ipvs = benchmarkIpvs(0)
+			b.StartTimer()
+		}
+		service := services[n%len(services)]
+		found := false
+		for j := range ipvs.Services {
+			if ipvs.Services[j].Host == service.Host && ipvs.Services[j].Port == service.Port && ipvs.Services[j].Type == service.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ipvs.Services = append(ipvs.Services, service)
+		}
+	}
+}
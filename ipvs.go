@@ -7,18 +7,22 @@
 package lvs
 
 import (
-	"fmt"
+	"context"
+	"io"
+	"strconv"
 	"strings"
 )
 
 type (
 	Ipvs struct {
-		MulticastInterface string    `json:mcast_interface`
-		Syncid             int       `json:syncid`
-		Tcp                int       `json:tcp_timeout`
-		Tcpfin             int       `json:tcp_fin_timeout`
-		Udp                int       `json:udp_fin_timeout`
-		Services           []Service `json:services`
+		MulticastInterface string    `json:"mcast_interface"`
+		Syncid             int       `json:"syncid"`
+		Tcp                int       `json:"tcp_timeout"`
+		Tcpfin             int       `json:"tcp_fin_timeout"`
+		Udp                int       `json:"udp_fin_timeout"`
+		Services           []Service `json:"services"`
+
+		services keyIndex[Service]
 	}
 )
 
@@ -26,135 +30,197 @@ var (
 	DefaultIpvs = &Ipvs{}
 )
 
+// FindService looks the service up in an index kept up to date by i's
+// methods. Call Reindex after changing a service's type, host or port in
+// place.
 func (i Ipvs) FindService(netType, host string, port int) *Service {
-	for j := range i.Services {
-		if i.Services[j].Host == host && i.Services[j].Port == port && i.Services[j].Type == netType {
-			return &i.Services[j]
-		}
+	if j := i.findService(netType, host, port); j != -1 {
+		return &i.Services[j]
 	}
 	return nil
 }
 
+// Reindex rebuilds the indexes used to find services and their servers.
+func (i *Ipvs) Reindex() {
+	i.services.build(i.Services, serviceKeys)
+	for j := range i.Services {
+		i.Services[j].reindex()
+	}
+}
+
+func (i Ipvs) findService(netType, host string, port int) int {
+	netType, host = canonicalType(netType), canonicalHost(host)
+	return i.services.find(i.Services, canonicalServiceKey(netType, host, port), func(s Service) bool {
+		return s.matchesCanonical(netType, host, port)
+	})
+}
+
+func (i *Ipvs) appendService(service Service) {
+	service.reindex()
+	before := i.Services
+	i.Services = append(i.Services, service)
+	i.services.appended(before, i.Services, serviceKeys)
+}
+
+func (i *Ipvs) removeService(j int) {
+	i.Services = append(i.Services[:j], i.Services[j+1:]...)
+	i.services.build(i.Services, serviceKeys)
+}
+
 func (i *Ipvs) AddService(service Service) error {
+	return i.AddServiceContext(context.Background(), service)
+}
+
+func (i *Ipvs) AddServiceContext(ctx context.Context, service Service) error {
 	err := service.Validate()
 	if err != nil {
 		return err
 	}
-	if i.FindService(service.Type, service.Host, service.Port) != nil {
+	if i.FindService(service.Type, service.getHost(), service.Port) != nil {
 		return nil
 	}
-	err = backend("ipvsadm", append([]string{"-A", ServiceTypeFlag[service.Type], service.getHostPort(), "-s", ServiceSchedulerFlag[service.Scheduler]}, append(service.getPersistence(), service.getNetmask()...)...)...)
+	err = command(ctx, "ipvsadm", append([]string{"-A", ServiceTypeFlag[service.Type], service.getHostPort()}, service.getOptions()...)...)
 	if err != nil {
 		return err
 	}
 	for i := range service.Servers {
-		err := backend("ipvsadm", append([]string{"-a", ServiceTypeFlag[service.Type], service.getHostPort(), "-r"}, strings.Split(service.Servers[i].String(), " ")...)...)
+		err := command(ctx, "ipvsadm", append([]string{"-a", ServiceTypeFlag[service.Type], service.getHostPort(), "-r"}, strings.Split(service.Servers[i].String(), " ")...)...)
 		if err != nil {
 			return err
 		}
 	}
-	i.Services = append(i.Services, service)
+	i.appendService(service)
 	return nil
 }
 
 func (i *Ipvs) EditService(service Service) error {
-	err := backend("ipvsadm", append([]string{"-E", ServiceTypeFlag[service.Type], service.getHostPort(), ServiceSchedulerFlag[service.Scheduler]}, append(service.getPersistence(), service.getNetmask()...)...)...)
+	return i.EditServiceContext(context.Background(), service)
+}
+
+func (i *Ipvs) EditServiceContext(ctx context.Context, service Service) error {
+	err := service.Validate()
+	if err != nil {
+		return err
+	}
+	err = command(ctx, "ipvsadm", append([]string{"-E", ServiceTypeFlag[service.Type], service.getHostPort()}, service.getOptions()...)...)
 	if err != nil {
 		return err
 	}
 
-	for j := range i.Services {
-		if i.Services[j].Host == service.Host && i.Services[j].Port == service.Port && i.Services[j].Type == service.Type {
-			i.Services = append(i.Services[:j], append([]Service{service}, i.Services[j+1:]...)...)
-			break
-		}
+	if j := i.findService(service.Type, service.getHost(), service.Port); j != -1 {
+		service.reindex()
+		i.Services[j] = service
 	}
 	return nil
 }
 
 func (i *Ipvs) RemoveService(netType, host string, port int) error {
-	err := backend("ipvsadm", "-D", ServiceTypeFlag[netType], fmt.Sprintf("%s:%d", host, port))
+	return i.RemoveServiceContext(context.Background(), netType, host, port)
+}
+
+func (i *Ipvs) RemoveServiceContext(ctx context.Context, netType, host string, port int) error {
+	service := Service{Type: netType, Host: host, Port: port}
+	err := command(ctx, "ipvsadm", "-D", ServiceTypeFlag[netType], service.getHostPort())
 	if err != nil {
 		return err
 	}
 
-	for j := range i.Services {
-		if i.Services[j].Host == host && i.Services[j].Port == port && i.Services[j].Type == netType {
-			i.Services = append(i.Services[:j], i.Services[j+1:]...)
-			break
-		}
+	if j := i.findService(netType, host, port); j != -1 {
+		i.removeService(j)
 	}
 	return nil
 }
 
 func (i *Ipvs) Clear() error {
-	err := backend("ipvsadm", "-C")
+	return i.ClearContext(context.Background())
+}
+
+func (i *Ipvs) ClearContext(ctx context.Context) error {
+	err := command(ctx, "ipvsadm", "-C")
 	if err != nil {
 		return err
 	}
 
 	i.Services = make([]Service, 0, 0)
+	i.Reindex()
 	return nil
 }
 
 func (i Ipvs) SetTimeouts() error {
+	return i.SetTimeoutsContext(context.Background())
+}
+
+func (i Ipvs) SetTimeoutsContext(ctx context.Context) error {
 	if i.Tcp > 0 || i.Tcpfin > 0 || i.Udp > 0 {
-		return backend("ipvsadm", "--set", string(i.Tcp), string(i.Tcpfin), string(i.Udp))
+		return command(ctx, "ipvsadm", "--set", strconv.Itoa(i.Tcp), strconv.Itoa(i.Tcpfin), strconv.Itoa(i.Udp))
 	}
 	return nil
 }
 
 func (i *Ipvs) Restore(services []Service) error {
+	return i.RestoreContext(context.Background(), services)
+}
+
+func (i *Ipvs) RestoreContext(ctx context.Context, services []Service) error {
 	in := make([]string, 0, 0)
 	for i := range services {
 		in = append(in, services[i].String())
 	}
-	err := backendStdin(strings.Join(in, ""), "ipvsadm", "-R")
+	err := commandStdin(ctx, strings.Join(in, ""), "ipvsadm", "-R")
 	if err != nil {
 		return err
 	}
 
 	i.Services = services
+	i.Reindex()
 	return nil
 }
 
 // save reads the applied ipvsadm rules from the host and saves them as i.Services
 func (i *Ipvs) Save() error {
-	out, err := backendRun([]string{"ipvsadm", "-S", "-n"})
+	return i.SaveContext(context.Background())
+}
+
+func (i *Ipvs) SaveContext(ctx context.Context) error {
+	services := make([]Service, 0, 0)
+	err := i.SaveFuncContext(ctx, func(service Service) error {
+		services = append(services, service)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	i.Services = make([]Service, 0, 0)
-	serviceStrings := strings.Split(string(out), "-A")
-	for j := range serviceStrings {
-		if serviceStrings[j] == "" {
-			continue
-		}
-		serverStrings := strings.Split(serviceStrings[j], "-a")
-		serviceString := serverStrings[0]
-		serverStrings = serverStrings[1:]
-		// fmt.Println("Service: ", serviceString)
-		service := parseService(serviceString)
-		for k := range serverStrings {
-			// fmt.Println("Server: ", serverStrings[j])
-			server := parseServer(serverStrings[k])
-			service.Servers = append(service.Servers, server)
-		}
-		i.Services = append(i.Services, service)
-	}
+	i.Services = services
+	i.Reindex()
 	return nil
 }
 
+// SaveFunc reads the applied rules from the host like Save, but passes each
+// service to fn as it is read instead of keeping them in i.
+func (i *Ipvs) SaveFunc(fn func(Service) error) error {
+	return i.SaveFuncContext(context.Background(), fn)
+}
+
+func (i *Ipvs) SaveFuncContext(ctx context.Context, fn func(Service) error) error {
+	return commandStream(ctx, []string{"ipvsadm", "-S", "-n"}, func(out io.Reader) error {
+		return ParseSave(out, fn)
+	})
+}
+
 func (i Ipvs) StartDaemon() (error, error) {
+	return i.StartDaemonContext(context.Background())
+}
+
+func (i Ipvs) StartDaemonContext(ctx context.Context) (error, error) {
 	if i.MulticastInterface != "" {
 		var err1, err2 error
 		if i.Syncid > 0 {
-			err1 = backend("ipvsadm", "--start-daemon", "master", "--mcast-interface", i.MulticastInterface, "--syncid", string(i.Syncid))
-			err2 = backend("ipvsadm", "--start-daemon", "backup", "--mcast-interface", i.MulticastInterface, "--syncid", string(i.Syncid))
+			err1 = command(ctx, "ipvsadm", "--start-daemon", "master", "--mcast-interface", i.MulticastInterface, "--syncid", strconv.Itoa(i.Syncid))
+			err2 = command(ctx, "ipvsadm", "--start-daemon", "backup", "--mcast-interface", i.MulticastInterface, "--syncid", strconv.Itoa(i.Syncid))
 		} else {
-			err1 = backend("ipvsadm", "--start-daemon", "master", "--mcast-interface", i.MulticastInterface)
-			err2 = backend("ipvsadm", "--start-daemon", "backup", "--mcast-interface", i.MulticastInterface)
+			err1 = command(ctx, "ipvsadm", "--start-daemon", "master", "--mcast-interface", i.MulticastInterface)
+			err2 = command(ctx, "ipvsadm", "--start-daemon", "backup", "--mcast-interface", i.MulticastInterface)
 		}
 		return err1, err2
 	}
@@ -162,15 +228,23 @@ func (i Ipvs) StartDaemon() (error, error) {
 }
 
 func (i Ipvs) StopDaemon() (error, error) {
+	return i.StopDaemonContext(context.Background())
+}
+
+func (i Ipvs) StopDaemonContext(ctx context.Context) (error, error) {
 	if i.MulticastInterface != "" {
 		var err1, err2 error
-		err1 = backend("ipvsadm", "--stop-daemon", "master")
-		err2 = backend("ipvsadm", "--stop-daemon", "backup")
+		err1 = command(ctx, "ipvsadm", "--stop-daemon", "master")
+		err2 = command(ctx, "ipvsadm", "--stop-daemon", "backup")
 		return err1, err2
 	}
 	return nil, nil
 }
 
 func (i Ipvs) Zero() error {
-	return backend("ipvsadm", "-Z")
+	return i.ZeroContext(context.Background())
+}
+
+func (i Ipvs) ZeroContext(ctx context.Context) error {
+	return command(ctx, "ipvsadm", "-Z")
 }
@@ -5,3 +5,121 @@
 // at http://mozilla.org/MPL/2.0/.
 //
 package lvs
+
+import (
+	"errors"
+	"testing"
+)
+
+var testServices = []Service{
+	{Host: "10.0.0.1", Port: 80, Type: "tcp", Scheduler: "rr", Servers: []Server{
+		{Host: "10.0.1.1", Port: 80, Forwarder: "g", Weight: 1},
+		{Host: "10.0.1.2", Port: 80, Forwarder: "g", Weight: 2},
+	}},
+	{Host: "10.0.0.1", Port: 53, Type: "udp", Scheduler: "sh", Persistence: 60, Servers: []Server{
+		{Host: "10.0.1.1", Port: 5353, Forwarder: "m", Weight: 1, UpperThreshold: 100, LowerThreshold: 10},
+	}},
+}
+
+func TestIpvsAddEditRemove(test *testing.T) {
+	simulator := useSimulator()
+	defer useFakes()
+
+	ipvs := &Ipvs{}
+	for i := range testServices {
+		if err := ipvs.AddService(testServices[i]); err != nil {
+			test.Fatal(err)
+		}
+	}
+	table := simulator.Ipvs()
+	if len(table.Services) != 2 || len(table.Services[0].Servers) != 2 || table.Services[1].Servers[0].Port != 5353 {
+		test.Fatalf("unexpected table %+v", table.Services)
+	}
+
+	edited := testServices[0]
+	edited.Scheduler = "wlc"
+	edited.Persistence = 300
+	if err := ipvs.EditService(edited); err != nil {
+		test.Fatal(err)
+	}
+	if ipvs.FindService("tcp", "10.0.0.1", 80).Scheduler != "wlc" || simulator.Ipvs().Services[0].Persistence != 300 {
+		test.Errorf("service was not edited")
+	}
+
+	if err := ipvs.RemoveService("udp", "10.0.0.1", 53); err != nil {
+		test.Fatal(err)
+	}
+	if len(ipvs.Services) != 1 || len(simulator.Ipvs().Services) != 1 {
+		test.Errorf("service was not removed")
+	}
+	if err := ipvs.RemoveService("udp", "10.0.0.1", 53); !errors.Is(err, NotFound) {
+		test.Errorf("expected NotFound, got %v", err)
+	}
+	missing := testServices[1]
+	if err := ipvs.EditService(missing); !errors.Is(err, NotFound) {
+		test.Errorf("expected NotFound, got %v", err)
+	}
+
+	if err := ipvs.Clear(); err != nil {
+		test.Fatal(err)
+	}
+	if len(ipvs.Services) != 0 || len(simulator.Ipvs().Services) != 0 {
+		test.Errorf("table was not cleared")
+	}
+}
+
+func TestIpvsRestoreSave(test *testing.T) {
+	simulator := useSimulator()
+	defer useFakes()
+
+	ipvs := &Ipvs{}
+	if err := ipvs.Restore(testServices); err != nil {
+		test.Fatal(err)
+	}
+	if len(simulator.Ipvs().Services) != 2 {
+		test.Fatalf("unexpected table %+v", simulator.Ipvs())
+	}
+
+	saved := &Ipvs{}
+	if err := saved.Save(); err != nil {
+		test.Fatal(err)
+	}
+	if len(saved.Services) != 2 {
+		test.Fatalf("unexpected saved services %+v", saved.Services)
+	}
+	udp := saved.FindService("udp", "10.0.0.1", 53)
+	if udp == nil || udp.Scheduler != "sh" || udp.Persistence != 60 {
+		test.Fatalf("unexpected saved service %+v", udp)
+	}
+	if udp.Servers[0] != testServices[1].Servers[0] {
+		test.Errorf("expected server %+v, got %+v", testServices[1].Servers[0], udp.Servers[0])
+	}
+	if tcp := saved.FindService("tcp", "10.0.0.1", 80); tcp == nil || tcp.Persistence != 0 || len(tcp.Servers) != 2 {
+		test.Errorf("unexpected saved service %+v", tcp)
+	}
+}
+
+func TestIpvsTimeoutsAndDaemon(test *testing.T) {
+	simulator := useSimulator()
+	defer useFakes()
+
+	ipvs := Ipvs{MulticastInterface: "eth1", Syncid: 5, Tcp: 900, Tcpfin: 120, Udp: 300}
+	if err := ipvs.SetTimeouts(); err != nil {
+		test.Fatal(err)
+	}
+	master, backup := ipvs.StartDaemon()
+	if master != nil || backup != nil {
+		test.Fatal(master, backup)
+	}
+	table := simulator.Ipvs()
+	if table.Tcp != 900 || table.Tcpfin != 120 || table.Udp != 300 || table.Syncid != 5 {
+		test.Errorf("unexpected table %+v", table)
+	}
+	if !simulator.Daemon("master") || !simulator.Daemon("backup") {
+		test.Error("sync daemons were not started")
+	}
+	master, backup = ipvs.StopDaemon()
+	if master != nil || backup != nil || simulator.Daemon("master") {
+		test.Error("sync daemons were not stopped")
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// JsonVersion is the version of the Ipvs json document written by
+	// ToJson. Documents without a version are from before the json field
+	// names were fixed and are still read.
+	JsonVersion = 1
+)
+
+var (
+	UnsupportedJsonVersion = errors.New("Unsupported Json Version")
+)
+
+func (i *Ipvs) FromJson(bytes []byte) error {
+	return json.Unmarshal(bytes, i)
+}
+
+// ToJson encodes i normalized, as a version JsonVersion document.
+func (i Ipvs) ToJson() ([]byte, error) {
+	i = i.Clone()
+	i.Normalize()
+	return json.Marshal(i)
+}
+
+func (i Ipvs) MarshalJSON() ([]byte, error) {
+	type ipvs Ipvs
+	if i.Services == nil {
+		i.Services = []Service{}
+	}
+	return json.Marshal(struct {
+		Version int `json:"version"`
+		ipvs
+	}{JsonVersion, ipvs(i)})
+}
+
+func (i *Ipvs) UnmarshalJSON(bytes []byte) error {
+	type ipvs Ipvs
+	doc := struct {
+		Version int `json:"version"`
+		*ipvs
+		// the Go field names, used before the json tags were fixed
+		OldMulticastInterface *string    `json:"MulticastInterface"`
+		OldSyncid             *int       `json:"Syncid"`
+		OldTcp                *int       `json:"Tcp"`
+		OldTcpfin             *int       `json:"Tcpfin"`
+		OldUdp                *int       `json:"Udp"`
+		OldServices           *[]Service `json:"Services"`
+	}{ipvs: (*ipvs)(i)}
+	if err := json.Unmarshal(bytes, &doc); err != nil {
+		return err
+	}
+	if doc.Version > JsonVersion {
+		return fmt.Errorf("%w: %d", UnsupportedJsonVersion, doc.Version)
+	}
+
+	if doc.OldMulticastInterface != nil {
+		i.MulticastInterface = *doc.OldMulticastInterface
+	}
+	if doc.OldSyncid != nil {
+		i.Syncid = *doc.OldSyncid
+	}
+	if doc.OldTcp != nil {
+		i.Tcp = *doc.OldTcp
+	}
+	if doc.OldTcpfin != nil {
+		i.Tcpfin = *doc.OldTcpfin
+	}
+	if doc.OldUdp != nil {
+		i.Udp = *doc.OldUdp
+	}
+	if doc.OldServices != nil {
+		i.Services = *doc.OldServices
+	}
+	i.Reindex()
+	return nil
+}
+
+func (s *Server) UnmarshalJSON(bytes []byte) error {
+	type server Server
+	doc := struct {
+		*server
+		// the Go field names, used before the json tags were fixed
+		OldUpperThreshold *int `json:"UpperThreshold"`
+		OldLowerThreshold *int `json:"LowerThreshold"`
+	}{server: (*server)(s)}
+	if err := json.Unmarshal(bytes, &doc); err != nil {
+		return err
+	}
+	if doc.OldUpperThreshold != nil {
+		s.UpperThreshold = *doc.OldUpperThreshold
+	}
+	if doc.OldLowerThreshold != nil {
+		s.LowerThreshold = *doc.OldLowerThreshold
+	}
+	return nil
+}
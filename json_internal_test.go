@@ -0,0 +1,63 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestIpvsJson(test *testing.T) {
+	ipvs := Ipvs{MulticastInterface: "eth1", Syncid: 4, Tcp: 900, Tcpfin: 120, Udp: 300, Services: testServices}
+	out, err := ipvs.ToJson()
+	if err != nil {
+		test.Fatal(err)
+	}
+	for _, field := range []string{`"version":1`, `"mcast_interface":"eth1"`, `"syncid":4`, `"tcp_timeout":900`, `"tcp_fin_timeout":120`, `"udp_fin_timeout":300`, `"services":[`, `"upper_threshold":`, `"lower_threshold":`} {
+		if !strings.Contains(string(out), field) {
+			test.Errorf("expected %s in %s", field, out)
+		}
+	}
+
+	decoded := Ipvs{}
+	if err := decoded.FromJson(out); err != nil {
+		test.Fatal(err)
+	}
+	if !decoded.Equal(ipvs) || decoded.MulticastInterface != "eth1" {
+		test.Errorf("json did not round trip: %s", decoded.Diff(ipvs))
+	}
+	if decoded.FindService("udp", "10.0.0.1", 53) == nil {
+		test.Error("decoded services should be indexed")
+	}
+
+	empty, _ := Ipvs{}.ToJson()
+	if string(empty) != `{"version":1,"mcast_interface":"","syncid":0,"tcp_timeout":0,"tcp_fin_timeout":0,"udp_fin_timeout":0,"services":[]}` {
+		test.Errorf("unexpected empty document %s", empty)
+	}
+}
+
+func TestIpvsJsonLegacy(test *testing.T) {
+	legacy := `{"MulticastInterface":"eth0","Syncid":2,"Tcp":900,"Tcpfin":120,"Udp":300,"Services":[
+		{"host":"10.0.0.1","port":80,"type":"tcp","scheduler":"wlc","persistence":0,"netmask":"","servers":[
+			{"host":"10.0.1.1","port":80,"forwarder":"g","weight":1,"UpperThreshold":100,"LowerThreshold":10}]}]}`
+	ipvs := Ipvs{}
+	if err := ipvs.FromJson([]byte(legacy)); err != nil {
+		test.Fatal(err)
+	}
+	if ipvs.MulticastInterface != "eth0" || ipvs.Syncid != 2 || ipvs.Tcp != 900 || ipvs.Tcpfin != 120 || ipvs.Udp != 300 || len(ipvs.Services) != 1 {
+		test.Fatalf("legacy document decoded as %+v", ipvs)
+	}
+	server := ipvs.Services[0].Servers[0]
+	if server.UpperThreshold != 100 || server.LowerThreshold != 10 {
+		test.Errorf("legacy thresholds decoded as %+v", server)
+	}
+
+	if err := ipvs.FromJson([]byte(`{"version":2}`)); !errors.Is(err, UnsupportedJsonVersion) {
+		test.Errorf("expected UnsupportedJsonVersion, got %v", err)
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type (
+	// keepalivedStatement is a line of keepalived.conf, with the statements
+	// of the block it opens.
+	keepalivedStatement struct {
+		line  int
+		words []string
+		block []keepalivedStatement
+	}
+
+	keepalivedToken struct {
+		line int
+		text string
+		// the first token of a line
+		first bool
+	}
+)
+
+var (
+	// keepalived's lb_kind and the forwarder it stands for
+	keepalivedForwarders = map[string]string{
+		"NAT": "m",
+		"DR":  "g",
+		"TUN": "i",
+	}
+
+	// keepalived keywords that set a scheduler flag
+	keepalivedSchedulerFlags = map[string]bool{
+		"flag-1": true, "flag-2": true, "flag-3": true,
+		"sh-port": true, "sh-fallback": true,
+		"mh-port": true, "mh-fallback": true,
+	}
+)
+
+// ParseKeepalived reads the virtual_server blocks of a keepalived.conf into
+// services. Health checkers and the rest of the file are skipped, while
+// settings ipvs can't express, such as SCTP services and virtual server
+// groups, return a *ConfigError with their line.
+func ParseKeepalived(r io.Reader) ([]Service, error) {
+	statements, err := parseKeepalivedStatements(r)
+	if err != nil {
+		return nil, err
+	}
+	services := []Service{}
+	for _, statement := range statements {
+		switch statement.words[0] {
+		case "virtual_server":
+			service, err := keepalivedService(statement)
+			if err != nil {
+				return nil, err
+			}
+			services = append(services, service)
+		case "virtual_server_group", "include":
+			return nil, configError(statement.line, "%s is not supported", statement.words[0])
+		}
+	}
+	return services, nil
+}
+
+func keepalivedService(statement keepalivedStatement) (Service, error) {
+	service := Service{Type: "tcp"}
+	words := statement.words
+	switch {
+	case len(words) == 3 && words[1] == "fwmark":
+		mark, err := strconv.Atoi(words[2])
+		if err != nil || mark <= 0 {
+			return service, configError(statement.line, "invalid fwmark %q", words[2])
+		}
+		service.Type, service.FwMark = "fwmark", mark
+	case len(words) == 3 && words[1] == "group":
+		return service, configError(statement.line, "virtual server groups are not supported")
+	case len(words) == 3:
+		port, err := strconv.Atoi(words[2])
+		if err != nil {
+			return service, configError(statement.line, "invalid port %q", words[2])
+		}
+		service.Host, service.Port = words[1], port
+	default:
+		return service, configError(statement.line, "expected virtual_server <ip> <port> or virtual_server fwmark <mark>")
+	}
+
+	// the defaults for servers that don't set their own
+	defaults := Server{Forwarder: "m", Weight: 1}
+	realServers := []keepalivedStatement{}
+	for _, s := range statement.block {
+		var err error
+		switch s.words[0] {
+		case "lb_algo", "lvs_sched":
+			service.Scheduler, err = keepalivedArg(s)
+			if _, ok := ServiceSchedulerFlag[service.Scheduler]; err == nil && !ok {
+				err = configError(s.line, "unknown scheduler %q", service.Scheduler)
+			}
+		case "protocol":
+			var protocol string
+			protocol, err = keepalivedArg(s)
+			if err == nil && service.Type != "fwmark" {
+				service.Type = strings.ToLower(protocol)
+				if _, ok := ServiceTypeFlag[service.Type]; !ok || service.Type == "fwmark" {
+					err = configError(s.line, "protocol %s is not supported", protocol)
+				}
+			}
+		case "persistence_timeout":
+			// keepalived persists for six minutes when no timeout is given
+			service.Persistence = 360
+			if len(s.words) > 1 {
+				service.Persistence, err = keepalivedInt(s)
+			}
+		case "persistence_granularity":
+			service.Netmask, err = keepalivedArg(s)
+		case "persistence_engine":
+			service.PersistenceEngine, err = keepalivedArg(s)
+		case "real_server":
+			realServers = append(realServers, s)
+		default:
+			if keepalivedSchedulerFlags[s.words[0]] {
+				service.SchedulerFlags = append(service.SchedulerFlags, s.words[0])
+				break
+			}
+			err = keepalivedServerSetting(s, &defaults)
+		}
+		if err != nil {
+			return service, err
+		}
+	}
+
+	for _, s := range realServers {
+		server := defaults
+		if len(s.words) < 2 || len(s.words) > 3 {
+			return service, configError(s.line, "expected real_server <ip> <port>")
+		}
+		server.Host = s.words[1]
+		if len(s.words) == 3 {
+			port, err := strconv.Atoi(s.words[2])
+			if err != nil {
+				return service, configError(s.line, "invalid port %q", s.words[2])
+			}
+			server.Port = port
+		}
+		for _, setting := range s.block {
+			if err := keepalivedServerSetting(setting, &server); err != nil {
+				return service, err
+			}
+		}
+		// as with ipvsadm, only masquerading can change the port
+		if (server.Forwarder != "m" && service.Type != "fwmark") || len(s.words) == 2 {
+			server.Port = service.Port
+		}
+		service.Servers = append(service.Servers, server)
+	}
+	service.Normalize()
+	return service, nil
+}
+
+// keepalivedServerSetting applies a real_server setting, which keepalived
+// also accepts in a virtual_server as the default for its servers. Other
+// settings, such as health checkers, are skipped.
+func keepalivedServerSetting(s keepalivedStatement, server *Server) error {
+	var err error
+	switch s.words[0] {
+	case "lb_kind", "lvs_method":
+		var kind string
+		kind, err = keepalivedArg(s)
+		if forwarder, ok := keepalivedForwarders[strings.ToUpper(kind)]; ok {
+			server.Forwarder = forwarder
+		} else if err == nil {
+			err = configError(s.line, "unknown lb_kind %q", kind)
+		}
+	case "weight":
+		server.Weight, err = keepalivedInt(s)
+	case "uthreshold":
+		server.UpperThreshold, err = keepalivedInt(s)
+	case "lthreshold":
+		server.LowerThreshold, err = keepalivedInt(s)
+	case "tun_type":
+		server.TunnelType, err = keepalivedArg(s)
+	case "tun_port":
+		server.TunnelPort, err = keepalivedInt(s)
+	}
+	return err
+}
+
+func keepalivedArg(s keepalivedStatement) (string, error) {
+	if len(s.words) != 2 {
+		return "", configError(s.line, "%s takes one value", s.words[0])
+	}
+	return s.words[1], nil
+}
+
+func keepalivedInt(s keepalivedStatement) (int, error) {
+	arg, err := keepalivedArg(s)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, configError(s.line, "invalid number %q for %s", arg, s.words[0])
+	}
+	return i, nil
+}
+
+// parseKeepalivedStatements splits r into statements, one per line, with
+// the statements between the braces that follow one as its block.
+func parseKeepalivedStatements(r io.Reader) ([]keepalivedStatement, error) {
+	tokens := []keepalivedToken{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		text := scanner.Text()
+		if i := strings.IndexAny(text, "#!"); i != -1 {
+			text = text[:i]
+		}
+		text = strings.NewReplacer("{", " { ", "}", " } ").Replace(text)
+		for i, word := range strings.Fields(text) {
+			tokens = append(tokens, keepalivedToken{line: n, text: word, first: i == 0})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	statements, rest, err := keepalivedBlock(tokens)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, configError(rest[0].line, "unexpected }")
+	}
+	return statements, nil
+}
+
+// keepalivedBlock reads statements up to an unmatched }, returning the
+// tokens from it on.
+func keepalivedBlock(tokens []keepalivedToken) ([]keepalivedStatement, []keepalivedToken, error) {
+	statements := []keepalivedStatement{}
+	for len(tokens) != 0 {
+		switch tokens[0].text {
+		case "}":
+			return statements, tokens, nil
+		case "{":
+			return nil, nil, configError(tokens[0].line, "unexpected {")
+		}
+
+		statement := keepalivedStatement{line: tokens[0].line, words: []string{tokens[0].text}}
+		tokens = tokens[1:]
+		for len(tokens) != 0 && !tokens[0].first && tokens[0].text != "{" && tokens[0].text != "}" {
+			statement.words = append(statement.words, tokens[0].text)
+			tokens = tokens[1:]
+		}
+		// the brace may also start the next line
+		if len(tokens) != 0 && tokens[0].text == "{" {
+			open := tokens[0]
+			block, rest, err := keepalivedBlock(tokens[1:])
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(rest) == 0 {
+				return nil, nil, configError(open.line, "unclosed {")
+			}
+			statement.block, tokens = block, rest[1:]
+		}
+		statements = append(statements, statement)
+	}
+	return statements, tokens, nil
+}
+
+// WriteKeepalived writes the services of i as keepalived.conf
+// virtual_server blocks, without health checkers.
+func (i Ipvs) WriteKeepalived(w io.Writer) error {
+	i = i.Clone()
+	i.Normalize()
+	b := bufio.NewWriter(w)
+	for j, service := range i.Services {
+		if j != 0 {
+			b.WriteString("\n")
+		}
+		writeKeepalivedService(b, service)
+	}
+	return b.Flush()
+}
+
+func writeKeepalivedService(b *bufio.Writer, s Service) {
+	if s.Type == "fwmark" {
+		fmt.Fprintf(b, "virtual_server fwmark %s {\n", s.getHost())
+	} else {
+		fmt.Fprintf(b, "virtual_server %s %d {\n", s.Host, s.Port)
+	}
+	fmt.Fprintf(b, "    lb_algo %s\n", s.Scheduler)
+	// the first server's forwarder is the default for the others
+	var defaults Server
+	if len(s.Servers) != 0 {
+		defaults = s.Servers[0]
+		fmt.Fprintf(b, "    lb_kind %s\n", keepalivedKind(defaults.Forwarder))
+	}
+	if s.Type != "fwmark" {
+		fmt.Fprintf(b, "    protocol %s\n", strings.ToUpper(s.Type))
+	}
+	if s.Persistence != 0 {
+		fmt.Fprintf(b, "    persistence_timeout %d\n", s.Persistence)
+	}
+	if s.Netmask != "" {
+		fmt.Fprintf(b, "    persistence_granularity %s\n", s.Netmask)
+	}
+	if s.PersistenceEngine != "" {
+		fmt.Fprintf(b, "    persistence_engine %s\n", s.PersistenceEngine)
+	}
+	for _, flag := range s.SchedulerFlags {
+		fmt.Fprintf(b, "    %s\n", flag)
+	}
+
+	for _, server := range s.Servers {
+		b.WriteString("\n")
+		if server.Port != 0 {
+			fmt.Fprintf(b, "    real_server %s %d {\n", server.Host, server.Port)
+		} else {
+			fmt.Fprintf(b, "    real_server %s {\n", server.Host)
+		}
+		if server.Forwarder != defaults.Forwarder {
+			fmt.Fprintf(b, "        lb_kind %s\n", keepalivedKind(server.Forwarder))
+		}
+		fmt.Fprintf(b, "        weight %d\n", server.Weight)
+		if server.UpperThreshold != 0 {
+			fmt.Fprintf(b, "        uthreshold %d\n", server.UpperThreshold)
+		}
+		if server.LowerThreshold != 0 {
+			fmt.Fprintf(b, "        lthreshold %d\n", server.LowerThreshold)
+		}
+		if server.TunnelType != "" {
+			fmt.Fprintf(b, "        tun_type %s\n", server.TunnelType)
+		}
+		if server.TunnelPort != 0 {
+			fmt.Fprintf(b, "        tun_port %d\n", server.TunnelPort)
+		}
+		b.WriteString("    }\n")
+	}
+	b.WriteString("}\n")
+}
+
+func keepalivedKind(forwarder string) string {
+	for kind, f := range keepalivedForwarders {
+		if f == forwarder {
+			return kind
+		}
+	}
+	return forwarder
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseKeepalived(test *testing.T) {
+	file, err := os.Open("testdata/keepalived.conf")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer file.Close()
+	services, err := ParseKeepalived(file)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if len(services) != 3 {
+		test.Fatalf("expected 3 services, got %+v", services)
+	}
+
+	web := services[0]
+	if web.Type != "tcp" || web.Host != "192.168.0.10" || web.Port != 80 || web.Scheduler != "wlc" || web.Persistence != 300 || web.Netmask != "255.255.255.0" {
+		test.Errorf("web service parsed as %+v", web)
+	}
+	if len(web.Servers) != 2 || web.Servers[0].Forwarder != "g" || web.Servers[0].Weight != 2 || web.Servers[1].UpperThreshold != 1000 || web.Servers[1].LowerThreshold != 800 {
+		test.Errorf("web servers parsed as %+v", web.Servers)
+	}
+
+	dns := services[1]
+	if dns.Type != "udp" || dns.Scheduler != "sh" || len(dns.SchedulerFlags) != 1 || dns.SchedulerFlags[0] != "sh-port" {
+		test.Errorf("dns service parsed as %+v", dns)
+	}
+	if len(dns.Servers) != 2 || dns.Servers[0].Forwarder != "m" || dns.Servers[0].Port != 5353 || dns.Servers[1].Weight != 0 {
+		test.Errorf("dns servers parsed as %+v", dns.Servers)
+	}
+
+	mark := services[2]
+	if mark.Type != "fwmark" || mark.FwMark != 7 || len(mark.Servers) != 1 {
+		test.Fatalf("fwmark service parsed as %+v", mark)
+	}
+	if server := mark.Servers[0]; server.Host != "2001:db8::1" || server.Forwarder != "i" || server.TunnelType != "gue" || server.TunnelPort != 6080 {
+		test.Errorf("fwmark server parsed as %+v", server)
+	}
+}
+
+func TestKeepalivedRoundTrip(test *testing.T) {
+	file, err := os.ReadFile("testdata/keepalived.conf")
+	if err != nil {
+		test.Fatal(err)
+	}
+	services, err := ParseKeepalived(bytes.NewReader(file))
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	for _, ipvs := range []Ipvs{{Services: services}, {Services: testServices}} {
+		out := &bytes.Buffer{}
+		if err := ipvs.WriteKeepalived(out); err != nil {
+			test.Fatal(err)
+		}
+		parsed, err := ParseKeepalived(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			test.Fatalf("%v\n%s", err, out)
+		}
+		if diff := (Ipvs{Services: parsed}).Diff(ipvs); !diff.Empty() {
+			test.Errorf("keepalived did not round trip: %s\n%s", diff, out)
+		}
+	}
+}
+
+func TestWriteKeepalived(test *testing.T) {
+	ipvs := Ipvs{Services: []Service{{Host: "10.0.0.1", Port: 53, Type: "udp", Scheduler: "sh", Persistence: 60, Servers: []Server{
+		{Host: "10.0.1.1", Port: 5353, Forwarder: "m", Weight: 1, UpperThreshold: 100, LowerThreshold: 10},
+		{Host: "10.0.1.2", Port: 53, Forwarder: "g", Weight: 2},
+	}}}}
+	out := &bytes.Buffer{}
+	if err := ipvs.WriteKeepalived(out); err != nil {
+		test.Fatal(err)
+	}
+	expected := `virtual_server 10.0.0.1 53 {
+    lb_algo sh
+    lb_kind NAT
+    protocol UDP
+    persistence_timeout 60
+
+    real_server 10.0.1.1 5353 {
+        weight 1
+        uthreshold 100
+        lthreshold 10
+    }
+
+    real_server 10.0.1.2 53 {
+        lb_kind DR
+        weight 2
+    }
+}
+`
+	if out.String() != expected {
+		test.Errorf("unexpected keepalived config\n%s", out)
+	}
+}
+
+func TestKeepalivedErrors(test *testing.T) {
+	tests := []struct {
+		conf string
+		line int
+		want string
+	}{
+		{"virtual_server 10.0.0.1 80 {\n  lb_algo rr\n", 1, "unclosed {"},
+		{"virtual_server 10.0.0.1 80 {\n}\n}\n", 3, "unexpected }"},
+		{"virtual_server 10.0.0.1 80 {\n  protocol SCTP\n}\n", 2, "SCTP is not supported"},
+		{"virtual_server group web {\n}\n", 1, "groups are not supported"},
+		{"virtual_server 10.0.0.1 80 {\n  lb_algo fastest\n}\n", 2, "unknown scheduler"},
+		{"virtual_server 10.0.0.1 80 {\n  lb_kind FAST\n}\n", 2, "unknown lb_kind"},
+		{"virtual_server 10.0.0.1 80 {\n  real_server 10.0.1.1 80 {\n    weight heavy\n  }\n}\n", 3, "invalid number"},
+		{"include /etc/keepalived/conf.d/*.conf\n", 1, "include is not supported"},
+	}
+	for _, tt := range tests {
+		_, err := ParseKeepalived(strings.NewReader(tt.conf))
+		configErr := &ConfigError{}
+		if !errors.As(err, &configErr) || configErr.Line != tt.line || !strings.Contains(err.Error(), tt.want) {
+			test.Errorf("%q: expected %q on line %d, got %v", tt.conf, tt.want, tt.line, err)
+		}
+	}
+}
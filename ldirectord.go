@@ -0,0 +1,342 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+type (
+	// LdirectordConfig is what ParseLdirectord read from an ldirectord.cf.
+	LdirectordConfig struct {
+		Virtuals []LdirectordVirtual `json:"virtuals"`
+		// Unsupported are the directives with no equivalent here, in the
+		// order they appear.
+		Unsupported []UnsupportedDirective `json:"unsupported"`
+	}
+
+	// LdirectordVirtual is a virtual= section, the service and how
+	// ldirectord checks its servers.
+	LdirectordVirtual struct {
+		Service Service         `json:"service"`
+		Check   LdirectordCheck `json:"check"`
+	}
+
+	// LdirectordCheck holds the checktype settings of a virtual, with
+	// the global settings filled in for those it doesn't set.
+	LdirectordCheck struct {
+		Type             string `json:"checktype"`
+		Port             int    `json:"checkport,omitempty"`
+		Service          string `json:"service,omitempty"`
+		Request          string `json:"request,omitempty"`
+		Receive          string `json:"receive,omitempty"`
+		VirtualHost      string `json:"virtualhost,omitempty"`
+		Timeout          int    `json:"checktimeout,omitempty"`
+		ConnectTimeout   int    `json:"connecttimeout,omitempty"`
+		NegotiateTimeout int    `json:"negotiatetimeout,omitempty"`
+		Interval         int    `json:"checkinterval,omitempty"`
+	}
+
+	// UnsupportedDirective is a directive of an ldirectord.cf that was not
+	// imported. Virtual is the virtual= it belongs to, or empty for a global
+	// directive.
+	UnsupportedDirective struct {
+		Line    int    `json:"line"`
+		Name    string `json:"name"`
+		Value   string `json:"value"`
+		Virtual string `json:"virtual,omitempty"`
+	}
+)
+
+var (
+	// ldirectord's forwarding methods and the forwarder they stand for
+	ldirectordForwarders = map[string]string{
+		"gate": "g",
+		"masq": "m",
+		"ipip": "i",
+	}
+)
+
+const (
+	// the most servers a real= address range can expand to
+	ldirectordMaxRange = 65536
+)
+
+func (d UnsupportedDirective) String() string {
+	return fmt.Sprintf("line %d: %s=%s", d.Line, d.Name, d.Value)
+}
+
+// Services returns the service of each virtual.
+func (c LdirectordConfig) Services() []Service {
+	services := make([]Service, 0, len(c.Virtuals))
+	for _, virtual := range c.Virtuals {
+		services = append(services, virtual.Service)
+	}
+	return services
+}
+
+// ParseLdirectord reads an ldirectord.cf. Directives that can't be imported,
+// such as fallback servers, email alerts and daemon settings, are listed in
+// Unsupported rather than dropped. Lines that can't be read, or virtuals
+// ipvs can't express, return a *ConfigError with their line.
+func ParseLdirectord(r io.Reader) (*LdirectordConfig, error) {
+	config := &LdirectordConfig{Virtuals: []LdirectordVirtual{}, Unsupported: []UnsupportedDirective{}}
+	// global check settings are the defaults for every virtual
+	defaults := LdirectordCheck{}
+	var virtual *LdirectordVirtual
+	var name string
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(trimmed, "=")
+		if !ok {
+			return nil, configError(n, "expected directive=value, got %q", trimmed)
+		}
+		key, value = strings.TrimSpace(key), ldirectordUnquote(strings.TrimSpace(value))
+
+		// directives of a virtual are indented under it
+		indented := text[0] == ' ' || text[0] == '\t'
+		if !indented {
+			virtual, name = nil, ""
+		}
+		if key == "virtual" {
+			if indented {
+				return nil, configError(n, "virtual can't be indented")
+			}
+			config.Virtuals = append(config.Virtuals, LdirectordVirtual{})
+			virtual, name = &config.Virtuals[len(config.Virtuals)-1], value
+			if err := virtual.setAddress(value, n); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if indented && virtual == nil {
+			return nil, configError(n, "%s is indented but not under a virtual", key)
+		}
+
+		var supported bool
+		var err error
+		if virtual == nil {
+			supported, err = defaults.set(key, value, n)
+		} else {
+			supported, err = virtual.set(key, value, n)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !supported {
+			config.Unsupported = append(config.Unsupported, UnsupportedDirective{Line: n, Name: key, Value: value, Virtual: name})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for j := range config.Virtuals {
+		config.Virtuals[j].finish(defaults)
+	}
+	return config, nil
+}
+
+// setAddress reads virtual=, either an address and port or a firewall mark.
+func (v *LdirectordVirtual) setAddress(value string, line int) error {
+	v.Service = Service{Type: "tcp"}
+	if mark, err := strconv.Atoi(value); err == nil {
+		if mark <= 0 {
+			return configError(line, "invalid fwmark %q", value)
+		}
+		v.Service.Type, v.Service.FwMark = "fwmark", mark
+		return nil
+	}
+	host, port, err := splitHostPort(value)
+	if err != nil || parseIP(host) == nil {
+		return configError(line, "invalid virtual %q", value)
+	}
+	v.Service.Host, v.Service.Port = host, port
+	return nil
+}
+
+// set applies a directive of the virtual, returning whether it is one that
+// can be imported.
+func (v *LdirectordVirtual) set(key, value string, line int) (bool, error) {
+	var err error
+	switch key {
+	case "real":
+		servers, err := ldirectordReal(value, line)
+		if err != nil {
+			return true, err
+		}
+		v.Service.Servers = append(v.Service.Servers, servers...)
+		// the server is imported, but its own request and receive strings
+		// can't be
+		return len(strings.Fields(value)) <= 3, nil
+	case "scheduler":
+		if _, ok := ServiceSchedulerFlag[value]; !ok {
+			return true, configError(line, "unknown scheduler %q", value)
+		}
+		v.Service.Scheduler = value
+	case "persistent":
+		v.Service.Persistence, err = ldirectordInt(key, value, line)
+	case "netmask":
+		v.Service.Netmask = value
+	case "protocol":
+		switch value {
+		case "tcp", "udp":
+			if v.Service.Type != "fwmark" {
+				v.Service.Type = value
+			}
+		case "fwm":
+			if v.Service.Type != "fwmark" {
+				return true, configError(line, "protocol fwm needs a firewall mark virtual")
+			}
+		default:
+			return true, configError(line, "protocol %s is not supported", value)
+		}
+	default:
+		return v.Check.set(key, value, line)
+	}
+	return true, err
+}
+
+// set applies a check setting, returning whether key is one.
+func (c *LdirectordCheck) set(key, value string, line int) (bool, error) {
+	var err error
+	switch key {
+	case "checktype":
+		c.Type = value
+	case "checkport":
+		c.Port, err = ldirectordInt(key, value, line)
+	case "service":
+		c.Service = value
+	case "request":
+		c.Request = value
+	case "receive":
+		c.Receive = value
+	case "virtualhost":
+		c.VirtualHost = value
+	case "checktimeout":
+		c.Timeout, err = ldirectordInt(key, value, line)
+	case "connecttimeout":
+		c.ConnectTimeout, err = ldirectordInt(key, value, line)
+	case "negotiatetimeout":
+		c.NegotiateTimeout, err = ldirectordInt(key, value, line)
+	case "checkinterval":
+		c.Interval, err = ldirectordInt(key, value, line)
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+// finish fills in what ldirectord does for the settings a virtual leaves
+// out and normalizes the service.
+func (v *LdirectordVirtual) finish(defaults LdirectordCheck) {
+	// ldirectord schedules with wrr, not ipvsadm's wlc
+	if v.Service.Scheduler == "" {
+		v.Service.Scheduler = "wrr"
+	}
+	check, global := reflect.ValueOf(&v.Check).Elem(), reflect.ValueOf(defaults)
+	for j := 0; j < check.NumField(); j++ {
+		if check.Field(j).IsZero() {
+			check.Field(j).Set(global.Field(j))
+		}
+	}
+	for j := range v.Service.Servers {
+		server := &v.Service.Servers[j]
+		// as with ipvsadm, only masquerading can change the port
+		if server.Port == 0 || (server.Forwarder != "m" && v.Service.Type != "fwmark") {
+			server.Port = v.Service.Port
+		}
+	}
+	v.Service.Normalize()
+}
+
+// ldirectordReal reads real=address[:port] [gate|masq|ipip] [weight]
+// ["request" "receive"], where the address may be a range first->last.
+func ldirectordReal(value string, line int) ([]Server, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return nil, configError(line, "real needs an address")
+	}
+	server := Server{Forwarder: "g", Weight: 1}
+	if len(fields) > 1 {
+		forwarder, ok := ldirectordForwarders[fields[1]]
+		if !ok {
+			return nil, configError(line, "unknown forwarding method %q", fields[1])
+		}
+		server.Forwarder = forwarder
+	}
+	if len(fields) > 2 {
+		weight, err := ldirectordInt("weight", fields[2], line)
+		if err != nil {
+			return nil, err
+		}
+		server.Weight = weight
+	}
+
+	// the port follows the last address of a range
+	first, last, isRange := strings.Cut(fields[0], "->")
+	address := first
+	if isRange {
+		address = last
+	}
+	host, port, err := splitHostPort(address)
+	if err != nil || parseIP(host) == nil {
+		return nil, configError(line, "invalid real server %q", fields[0])
+	}
+	server.Port = port
+	if !isRange {
+		server.Host = host
+		return []Server{server}, nil
+	}
+	first, last = strings.Trim(first, "[]"), host
+	start, end := parseIP(first).To4(), parseIP(last).To4()
+	if start == nil || end == nil {
+		return nil, configError(line, "invalid real server range %q", fields[0])
+	}
+	from, to := binary.BigEndian.Uint32(start), binary.BigEndian.Uint32(end)
+	if to < from || int(to-from) >= ldirectordMaxRange {
+		return nil, configError(line, "invalid real server range %q", fields[0])
+	}
+	servers := make([]Server, 0, to-from+1)
+	for ip := from; ; ip++ {
+		server.Host = net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)).String()
+		servers = append(servers, server)
+		if ip == to {
+			break
+		}
+	}
+	return servers, nil
+}
+
+func ldirectordInt(key, value string, line int) (int, error) {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, configError(line, "invalid number %q for %s", value, key)
+	}
+	return i, nil
+}
+
+// ldirectordUnquote removes the quotes around a whole value.
+func ldirectordUnquote(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' && strings.Count(value, `"`) == 2 {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
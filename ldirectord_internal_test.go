@@ -0,0 +1,108 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseLdirectord(test *testing.T) {
+	file, err := os.Open("testdata/ldirectord.cf")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer file.Close()
+	config, err := ParseLdirectord(file)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if len(config.Virtuals) != 4 {
+		test.Fatalf("expected 4 virtuals, got %+v", config.Virtuals)
+	}
+
+	http := config.Virtuals[0]
+	if s := http.Service; s.Type != "tcp" || s.Host != "192.168.6.240" || s.Port != 80 || s.Scheduler != "wrr" || s.Persistence != 600 || s.Netmask != "255.255.255.255" {
+		test.Errorf("http service parsed as %+v", s)
+	}
+	servers := http.Service.Servers
+	if len(servers) != 3 || servers[0].Forwarder != "g" || servers[0].Weight != 1 || servers[1].Weight != 5 || servers[2].Forwarder != "m" || servers[2].Port != 8080 || servers[2].Weight != 10 {
+		test.Errorf("http servers parsed as %+v", servers)
+	}
+	if c := http.Check; c.Type != "negotiate" || c.Port != 80 || c.Service != "http" || c.Request != "index.html" || c.Receive != "Test Page" || c.VirtualHost != "www.example.com" || c.Timeout != 3 || c.Interval != 1 {
+		test.Errorf("http check parsed as %+v", c)
+	}
+
+	dns := config.Virtuals[1]
+	if dns.Service.Type != "udp" || len(dns.Service.Servers) != 3 || dns.Service.Servers[2].Host != "192.168.6.12" || dns.Service.Servers[2].Port != 53 {
+		test.Errorf("dns service parsed as %+v", dns.Service)
+	}
+	if dns.Check.Type != "connect" || dns.Check.Timeout != 10 || dns.Check.Interval != 1 {
+		test.Errorf("dns check parsed as %+v", dns.Check)
+	}
+
+	mark := config.Virtuals[2]
+	if mark.Service.Type != "fwmark" || mark.Service.FwMark != 5 || len(mark.Service.Servers) != 1 || mark.Service.Servers[0].Host != "2001:db8::5" || mark.Service.Servers[0].Port != 443 || mark.Service.Servers[0].Forwarder != "i" {
+		test.Errorf("fwmark service parsed as %+v", mark.Service)
+	}
+
+	if https := config.Virtuals[3]; https.Service.Scheduler != "wrr" || https.Service.Port != 443 {
+		test.Errorf("https service parsed as %+v", https.Service)
+	}
+
+	unsupported := []string{}
+	for _, d := range config.Unsupported {
+		unsupported = append(unsupported, d.String())
+	}
+	expected := []string{
+		"line 4: autoreload=yes",
+		"line 5: logfile=/var/log/ldirectord.log",
+		"line 6: quiescent=yes",
+		"line 10: fallback=127.0.0.1:80",
+		`line 13: real=192.168.6.6:8080 masq 10 "status.html" "OK"`,
+		`line 39: emailalert=ops@example.com`,
+	}
+	if strings.Join(unsupported, "\n") != strings.Join(expected, "\n") {
+		test.Errorf("unexpected unsupported directives\n%s", strings.Join(unsupported, "\n"))
+	}
+	if config.Unsupported[3].Virtual != "192.168.6.240:80" || config.Unsupported[0].Virtual != "" {
+		test.Errorf("unsupported directives belong to the wrong virtual: %+v", config.Unsupported)
+	}
+
+	for _, service := range config.Services() {
+		if err := service.ValidateAll(); err != nil {
+			test.Errorf("imported service is invalid: %v", err)
+		}
+	}
+}
+
+func TestLdirectordErrors(test *testing.T) {
+	tests := []struct {
+		conf string
+		line int
+		want string
+	}{
+		{"checktimeout=3\n\treal=10.0.0.1:80\n", 2, "not under a virtual"},
+		{"virtual=10.0.0.1:80\n\treal=10.0.1.1:80 tunnel\n", 2, "unknown forwarding method"},
+		{"virtual=10.0.0.1:80\n\treal=10.0.1.9->10.0.1.1 gate\n", 2, "invalid real server range"},
+		{"virtual=10.0.0.1:80\n\tscheduler=fastest\n", 2, "unknown scheduler"},
+		{"virtual=10.0.0.1:80\n\tprotocol=sctp\n", 2, "sctp is not supported"},
+		{"virtual=10.0.0.1:80\n\tprotocol=fwm\n", 2, "firewall mark"},
+		{"virtual=10.0.0.1:80\n\tpersistent=forever\n", 2, "invalid number"},
+		{"virtual=web:80\n", 1, "invalid virtual"},
+		{"# comment\nvirtual 10.0.0.1:80\n", 2, "expected directive=value"},
+	}
+	for _, tt := range tests {
+		_, err := ParseLdirectord(strings.NewReader(tt.conf))
+		configErr := &ConfigError{}
+		if !errors.As(err, &configErr) || configErr.Line != tt.line || !strings.Contains(err.Error(), tt.want) {
+			test.Errorf("%q: expected %q on line %d, got %v", tt.conf, tt.want, tt.line, err)
+		}
+	}
+}
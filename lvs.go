@@ -7,12 +7,18 @@
 package lvs
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"os/exec"
+	"strings"
+	"time"
 )
 
 var (
+	// returned, wrapped in an *IpvsError, when ipvsadm reports them
 	Conflict       = errors.New("object already exists")
 	NotFound       = errors.New("object was not found")
 	DeleteFailed   = errors.New("object was not deleted")
@@ -23,94 +29,310 @@ var (
 	backend      = execute
 	backendRun   = run
 	backendStdin = executeStdin
+	// nil gives no output for commands fed input
+	backendStdinOutput = executeStdinOutput
+	// nil streams the output of backendRun
+	backendStream = stream
+
+	// CommandTimeout bounds every command run on the host, 0 leaves them
+	// bounded only by the context passed to the *Context operations. A
+	// command stopped by its context returns an error wrapping the
+	// context's error rather than an *IpvsError.
+	CommandTimeout time.Duration
+
+	// how long a stopped command's children may hold its output open
+	commandWaitDelay = 100 * time.Millisecond
 )
 
-// Load verifies that lvs can be used, and populates it with values
-// from the backup file
+// Load verifies that lvs can be used, detects what the host supports, and
+// populates it with values from the backup file
 func Load() error {
-	if err := check(); err != nil {
+	return LoadContext(context.Background())
+}
+
+func LoadContext(ctx context.Context) error {
+	if err := check(ctx); err != nil {
+		return err
+	}
+	capabilities, err := DetectCapabilitiesContext(ctx)
+	if err != nil {
 		return err
 	}
+	HostCapabilities = capabilities
 
 	// NYI
 	// populate the ipvsadm command with what was stored in the backup
 	return nil
 }
 
-func check() error {
-	if err := backend("which", "ipvsadm"); err != nil {
-		return IpvsadmMissing
+// check looks for ipvsadm. A context that stopped the lookup is reported
+// rather than taken for a missing ipvsadm.
+func check(ctx context.Context) error {
+	err := command(ctx, "which", "ipvsadm")
+	if err == nil {
+		return nil
 	}
-	return nil
+	if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return err
+	}
+	return IpvsadmMissing
 }
 
 func SetTimeouts() error {
-	return DefaultIpvs.SetTimeouts()
+	return SetTimeoutsContext(context.Background())
+}
+
+func SetTimeoutsContext(ctx context.Context) error {
+	return DefaultIpvs.SetTimeoutsContext(ctx)
 }
 
 func StartDaemon() (error, error) {
-	return DefaultIpvs.StartDaemon()
+	return StartDaemonContext(context.Background())
+}
+
+func StartDaemonContext(ctx context.Context) (error, error) {
+	return DefaultIpvs.StartDaemonContext(ctx)
 }
 
 func StopDaemon() (error, error) {
-	return DefaultIpvs.StopDaemon()
+	return StopDaemonContext(context.Background())
+}
+
+func StopDaemonContext(ctx context.Context) (error, error) {
+	return DefaultIpvs.StopDaemonContext(ctx)
 }
 
 func Clear() error {
-	return DefaultIpvs.Clear()
+	return ClearContext(context.Background())
+}
+
+func ClearContext(ctx context.Context) error {
+	return DefaultIpvs.ClearContext(ctx)
 }
 
 func Restore(services []Service) error {
-	return DefaultIpvs.Restore(services)
+	return RestoreContext(context.Background(), services)
+}
+
+func RestoreContext(ctx context.Context, services []Service) error {
+	return DefaultIpvs.RestoreContext(ctx, services)
 }
 
 func Save() error {
-	return DefaultIpvs.Save()
+	return SaveContext(context.Background())
+}
+
+func SaveContext(ctx context.Context) error {
+	return DefaultIpvs.SaveContext(ctx)
+}
+
+func SaveFunc(fn func(Service) error) error {
+	return SaveFuncContext(context.Background(), fn)
+}
+
+func SaveFuncContext(ctx context.Context, fn func(Service) error) error {
+	return DefaultIpvs.SaveFuncContext(ctx, fn)
 }
 
 func Zero() error {
-	return DefaultIpvs.Zero()
+	return ZeroContext(context.Background())
+}
+
+func ZeroContext(ctx context.Context) error {
+	return DefaultIpvs.ZeroContext(ctx)
+}
+
+// commandContext applies CommandTimeout to ctx.
+func commandContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if CommandTimeout > 0 {
+		return context.WithTimeout(ctx, CommandTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func command(ctx context.Context, exe string, args ...string) error {
+	_, err := dispatch(ctx, append([]string{exe}, args...), "", func(ctx context.Context) ([]byte, error) {
+		return nil, backend(ctx, exe, args...)
+	})
+	return err
+}
+
+func commandOutput(ctx context.Context, args []string) ([]byte, error) {
+	return dispatch(ctx, args, "", func(ctx context.Context) ([]byte, error) {
+		return backendRun(ctx, args)
+	})
+}
+
+func commandStdin(ctx context.Context, in, exe string, args ...string) error {
+	_, err := dispatch(ctx, append([]string{exe}, args...), in, func(ctx context.Context) ([]byte, error) {
+		return nil, backendStdin(ctx, in, exe, args...)
+	})
+	return err
+}
+
+// commandStdinOutput is commandStdin, also returning what the command
+// printed when the backend can tell.
+func commandStdinOutput(ctx context.Context, in, exe string, args ...string) ([]byte, error) {
+	return dispatch(ctx, append([]string{exe}, args...), in, func(ctx context.Context) ([]byte, error) {
+		if backendStdinOutput != nil {
+			return backendStdinOutput(ctx, in, exe, args...)
+		}
+		return nil, backendStdin(ctx, in, exe, args...)
+	})
 }
 
-func run(args []string) ([]byte, error) {
-	cmd := exec.Command(args[0], args[1:]...)
+// commandStream passes the output of the command line args to out as the
+// command produces it. It is never retried as out may have seen part of the
+// output.
+func commandStream(ctx context.Context, args []string, out func(io.Reader) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	trace := dispatchOnce(ctx, args, "", func(ctx context.Context) ([]byte, error) {
+		if backendStream != nil {
+			return nil, backendStream(ctx, args, out)
+		}
+		output, err := backendRun(ctx, args)
+		if err != nil {
+			return nil, err
+		}
+		return nil, out(bytes.NewReader(output))
+	})
+	return trace.Err
+}
+
+// dispatch runs the backend call for the command line args, retrying it as
+// Retries allows.
+func dispatch(ctx context.Context, args []string, in string, call func(context.Context) ([]byte, error)) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for attempt := 1; ; attempt++ {
+		trace := dispatchOnce(ctx, args, in, call)
+		if trace.Err == nil || !Retries.retry(ctx, trace, attempt) {
+			return trace.Output, trace.Err
+		}
+	}
+}
+
+// dispatchOnce runs a single backend call, applying CommandTimeout and reporting
+// it to the logger and trace hooks.
+func dispatchOnce(ctx context.Context, args []string, in string, call func(context.Context) ([]byte, error)) Trace {
+	ctx, cancel := commandContext(ctx)
+	defer cancel()
+
+	trace := Trace{Command: args, Stdin: in}
+	beforeCommand(ctx, trace)
+	started := time.Now()
+	trace.Output, trace.Err = call(ctx)
+	trace.Duration = time.Since(started)
+	afterCommand(ctx, trace)
+	return trace
+}
+
+// commandError reports why a command failed, preferring the context's error
+// when it was the context that stopped it.
+func commandError(ctx context.Context, command []string, err error, output []byte) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s: %w", strings.Join(command, " "), ctx.Err())
+	}
+	return newIpvsError(command, err, output)
+}
+
+func run(ctx context.Context, args []string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.WaitDelay = commandWaitDelay
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return nil, errors.New(err.Error() + " output: " + string(output))
+		return nil, commandError(ctx, args, err, output)
 	}
 	return output, err
 }
 
-func execute(exe string, args ...string) error {
-	// fmt.Printf("%s\n", strings.Join(append([]string{exe}, args...), " "))
-	cmd := exec.Command(exe, args...)
-	output, err := cmd.CombinedOutput()
+// stream runs args, passing its stdout to out. The command is stopped if out
+// fails.
+func stream(ctx context.Context, args []string, out func(io.Reader) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.WaitDelay = commandWaitDelay
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return errors.New(err.Error() + ": " + string(output))
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return commandError(ctx, args, err, nil)
+	}
+	outErr := out(stdout)
+	if outErr != nil {
+		cancel()
+	} else {
+		// let the command finish writing whatever out did not read
+		io.Copy(io.Discard, stdout)
+	}
+	err = cmd.Wait()
+	if outErr != nil {
+		return outErr
+	}
+	if err != nil {
+		return commandError(ctx, args, err, stderr.Bytes())
 	}
 	return nil
 }
 
-func executeStdin(in, exe string, args ...string) error {
-	// fmt.Printf("%s\n%s\n", strings.Join(append([]string{exe}, args...), " "), in)
+func execute(ctx context.Context, exe string, args ...string) error {
+	_, err := executeOutput(ctx, exe, args...)
+	return err
+}
+
+func executeOutput(ctx context.Context, exe string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.WaitDelay = commandWaitDelay
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, commandError(ctx, append([]string{exe}, args...), err, output)
+	}
+	return output, nil
+}
+
+func executeStdin(ctx context.Context, in, exe string, args ...string) error {
+	_, err := executeStdinOutput(ctx, in, exe, args...)
+	return err
+}
+
+func executeStdinOutput(ctx context.Context, in, exe string, args ...string) ([]byte, error) {
 	var err error
 	var total, part, segment int
 	var stdin io.WriteCloser
+	var output bytes.Buffer
 
-	cmd := exec.Command(exe, args...)
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.WaitDelay = commandWaitDelay
+	cmd.Stdout = &output
+	cmd.Stderr = &output
 	stdin, err = cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
 	defer stdin.Close()
 	if err = cmd.Start(); err != nil {
-		return err
+		return nil, commandError(ctx, append([]string{exe}, args...), err, nil)
 	}
 
 	total = len(in)
 	for part = 0; part != total; part += segment {
 		segment, err = stdin.Write([]byte(in[part:total]))
 		if err != nil {
-			return err
+			cmd.Wait()
+			return nil, commandError(ctx, append([]string{exe}, args...), err, output.Bytes())
 		}
 	}
 	stdin.Close()
-	return cmd.Wait()
+	if err = cmd.Wait(); err != nil {
+		return nil, commandError(ctx, append([]string{exe}, args...), err, output.Bytes())
+	}
+	return output.Bytes(), nil
 }
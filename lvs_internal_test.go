@@ -6,29 +6,66 @@
 //
 package lvs
 
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
 var (
 	fakeRunOutput       []byte
 	fakeRunErr          error
 	fakeExecuteErr      error
 	fakeExecuteStdinErr error
+	fakeCommands        [][]string
+	// per command results, keyed by the space joined command line
+	fakeRunOutputs  = map[string][]byte{}
+	fakeExecuteErrs = map[string]error{}
 )
 
-func fakeRun(args []string) ([]byte, error) {
+// the tests never run commands on the host unless they ask to
+func init() {
+	useFakes()
+}
+
+func useFakes() {
+	backend, backendRun, backendStdin = fakeExecute, fakeRun, fakeExecuteStdin
+	backendStream, backendStdinOutput = nil, nil
+}
+
+// useSimulator runs the following commands against a fresh simulator
+func useSimulator() *Simulator {
+	simulator := NewSimulator()
+	SetBackend(simulator)
+	return simulator
+}
+
+func fakeRun(ctx context.Context, args []string) ([]byte, error) {
 	// cmd := exec.Command(args[0], args[1:]...)
 	// output, err := cmd.CombinedOutput()
 	// if err != nil {
 	// 	return nil, errors.New(err.Error() + " output: " + string(output))
 	// }
+	fakeCommands = append(fakeCommands, args)
+	if output, ok := fakeRunOutputs[strings.Join(args, " ")]; ok {
+		return output, nil
+	}
 	return fakeRunOutput, fakeRunErr
 }
 
-func fakeExecute(exe string, args ...string) error {
+func fakeExecute(ctx context.Context, exe string, args ...string) error {
 	// // fmt.Printf("%s\n", strings.Join(append([]string{exe}, args...), " "))
 	// cmd := exec.Command(exe, args...)
+	fakeCommands = append(fakeCommands, append([]string{exe}, args...))
+	if err, ok := fakeExecuteErrs[strings.Join(append([]string{exe}, args...), " ")]; ok {
+		return err
+	}
 	return fakeExecuteErr
 }
 
-func fakeExecuteStdin(in, exe string, args ...string) error {
+func fakeExecuteStdin(ctx context.Context, in, exe string, args ...string) error {
 	// var err error
 	// var total, part, segment int
 	// var stdin io.WriteCloser
@@ -49,3 +86,59 @@ func fakeExecuteStdin(in, exe string, args ...string) error {
 	// }
 	return fakeExecuteStdinErr
 }
+
+func TestCommandTimeout(test *testing.T) {
+	backend, backendStdin = execute, executeStdin
+	defer useFakes()
+	CommandTimeout = 50 * time.Millisecond
+	defer func() { CommandTimeout = 0 }()
+
+	started := time.Now()
+	err := command(context.Background(), "sleep", "5")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		test.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+	var ipvsErr *IpvsError
+	if errors.As(err, &ipvsErr) {
+		test.Errorf("a timeout should not be reported as an *IpvsError: %v", err)
+	}
+
+	err = commandStdin(context.Background(), "-C\n", "sh", "-c", "sleep 5")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		test.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+	if time.Since(started) > 2*time.Second {
+		test.Errorf("commands were not stopped at their deadline")
+	}
+}
+
+func TestCanceledContext(test *testing.T) {
+	backend = fakeExecute
+	fakeCommands = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ipvs := &Ipvs{}
+	err := ipvs.AddServiceContext(ctx, Service{Host: "10.0.0.1", Port: 80})
+	if !errors.Is(err, context.Canceled) {
+		test.Errorf("expected Canceled, got %v", err)
+	}
+	if len(fakeCommands) != 0 || len(ipvs.Services) != 0 {
+		test.Errorf("nothing should have run, ran %v", fakeCommands)
+	}
+
+	// the lookup of ipvsadm reports the context rather than a missing ipvsadm
+	if err := LoadContext(ctx); !errors.Is(err, context.Canceled) || errors.Is(err, IpvsadmMissing) {
+		test.Errorf("expected Canceled, got %v", err)
+	}
+	if finding := DoctorContext(ctx)[0]; finding.Message != context.Canceled.Error() {
+		test.Errorf("expected Canceled, got %v", finding)
+	}
+	backend, backendStdin = execute, executeStdin
+	defer useFakes()
+	CommandTimeout = time.Nanosecond
+	defer func() { CommandTimeout = 0 }()
+	if err := check(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		test.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+}
@@ -20,4 +20,20 @@ type (
 	FromJson interface {
 		FromJson([]byte) error
 	}
+
+	ToYaml interface {
+		ToYaml() ([]byte, error)
+	}
+
+	FromYaml interface {
+		FromYaml([]byte) error
+	}
+
+	ToToml interface {
+		ToToml() ([]byte, error)
+	}
+
+	FromToml interface {
+		FromToml([]byte) error
+	}
 )
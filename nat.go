@@ -0,0 +1,242 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type (
+	// NatOptions controls what ConfigureNat is allowed to change on the
+	// director.
+	NatOptions struct {
+		// Snat adds a source nat rule for every masquerading server so
+		// return traffic comes back through the director even when the
+		// server does not route through it (full-NAT).
+		Snat bool `json:"snat"`
+		// SnatSource is the address to source nat to, empty masquerades
+		// behind the outgoing interface's address.
+		SnatSource string `json:"snat_source"`
+	}
+
+	// NatProblem is something that keeps a masquerading server from
+	// receiving or answering traffic.
+	NatProblem struct {
+		Service Service `json:"service"`
+		Server  Server  `json:"server"`
+		Problem string  `json:"problem"`
+	}
+
+	natServer struct {
+		service Service
+		server  Server
+	}
+)
+
+var (
+	natForwardSysctl = map[int]string{
+		4: "net.ipv4.ip_forward",
+		6: "net.ipv6.conf.all.forwarding",
+	}
+	natConntrackSysctl = "net.ipv4.vs.conntrack"
+)
+
+func (p NatProblem) String() string {
+	return fmt.Sprintf("%s %s -> %s: %s", p.Service.Type, p.Service.getHostPort(), p.Server.getHostPort(), p.Problem)
+}
+
+// CheckNat reports the problems that would keep the masquerading servers in
+// i from working, without changing anything.
+func (i Ipvs) CheckNat(options NatOptions) ([]NatProblem, error) {
+	return i.CheckNatContext(context.Background(), options)
+}
+
+func (i Ipvs) CheckNatContext(ctx context.Context, options NatOptions) ([]NatProblem, error) {
+	return i.nat(ctx, options, false)
+}
+
+// ConfigureNat turns on forwarding, and source nat when asked to, for the
+// masquerading servers in i and reports whatever it could not fix.
+func (i Ipvs) ConfigureNat(options NatOptions) ([]NatProblem, error) {
+	return i.ConfigureNatContext(context.Background(), options)
+}
+
+func (i Ipvs) ConfigureNatContext(ctx context.Context, options NatOptions) ([]NatProblem, error) {
+	return i.nat(ctx, options, true)
+}
+
+func (i Ipvs) nat(ctx context.Context, options NatOptions, configure bool) ([]NatProblem, error) {
+	problems := make([]NatProblem, 0, 0)
+	servers := i.masqueradingServers()
+	if len(servers) == 0 {
+		return problems, nil
+	}
+
+	families := make(map[int]bool)
+	for _, s := range servers {
+		families[ipFamily(s.server.Host)] = true
+	}
+
+	// forwarding is needed for every family that has a masquerading server
+	for _, family := range []int{4, 6} {
+		if !families[family] {
+			continue
+		}
+		ok, err := natSysctl(ctx, natForwardSysctl[family], configure)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			continue
+		}
+		for _, s := range servers {
+			if ipFamily(s.server.Host) == family {
+				problems = append(problems, s.problem(fmt.Sprintf("%s is disabled, set it to 1", natForwardSysctl[family])))
+			}
+		}
+	}
+
+	if options.Snat {
+		ok, err := natSysctl(ctx, natConntrackSysctl, configure)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range servers {
+			if !ok {
+				problems = append(problems, s.problem(fmt.Sprintf("%s is disabled, source nat needs it set to 1", natConntrackSysctl)))
+			}
+			present, err := s.snat(ctx, options.SnatSource, configure)
+			if err != nil {
+				return nil, err
+			}
+			if !present {
+				problems = append(problems, s.problem("missing source nat rule: "+strings.Join(s.snatRule(options.SnatSource), " ")))
+			}
+		}
+		return problems, nil
+	}
+
+	// without source nat, replies only make it back if the director is the
+	// server's next hop, which we can only vouch for on directly connected
+	// networks
+	for _, s := range servers {
+		out, err := commandOutput(ctx, []string{"ip", "route", "get", s.server.Host})
+		if err != nil {
+			problems = append(problems, s.problem("no route to server"))
+			continue
+		}
+		fields := strings.Fields(string(out))
+		for j := range fields {
+			if fields[j] == "via" && j+1 < len(fields) {
+				problems = append(problems, s.problem(fmt.Sprintf("server is reached via %s, route its replies through the director or enable Snat", fields[j+1])))
+				break
+			}
+		}
+	}
+	return problems, nil
+}
+
+func (i Ipvs) masqueradingServers() []natServer {
+	servers := make([]natServer, 0, 0)
+	for j := range i.Services {
+		service := i.Services[j]
+		service.Servers = nil
+		for k := range i.Services[j].Servers {
+			if i.Services[j].Servers[k].Forwarder == "m" {
+				servers = append(servers, natServer{service, i.Services[j].Servers[k]})
+			}
+		}
+	}
+	return servers
+}
+
+func (s natServer) problem(problem string) NatProblem {
+	return NatProblem{Service: s.service, Server: s.server, Problem: problem}
+}
+
+// snatRule returns the postrouting rule that source nats traffic ipvs sends
+// to the server.
+func (s natServer) snatRule(source string) []string {
+	suffix := "/32"
+	if ipFamily(s.server.Host) == 6 {
+		suffix = "/128"
+	}
+	rule := []string{"POSTROUTING", "-d", s.server.Host + suffix}
+	if s.service.Type != "fwmark" {
+		rule = append(rule, "-p", serviceTypeName(s.service.Type), "--dport", strconv.Itoa(s.server.Port))
+	}
+	rule = append(rule, "-m", "ipvs", "--ipvs")
+	if s.service.Type != "fwmark" {
+		rule = append(rule, "--vaddr", s.service.Host+suffix, "--vport", strconv.Itoa(s.service.Port))
+	}
+	if source == "" {
+		return append(rule, "-j", "MASQUERADE")
+	}
+	return append(rule, "-j", "SNAT", "--to-source", source)
+}
+
+// snat reports whether the server's source nat rule is installed, adding it
+// first when configure is set.
+func (s natServer) snat(ctx context.Context, source string, configure bool) (bool, error) {
+	tool := "iptables"
+	if ipFamily(s.server.Host) == 6 {
+		tool = "ip6tables"
+	}
+	rule := s.snatRule(source)
+	if command(ctx, tool, append([]string{"-t", "nat", "-C"}, rule...)...) == nil {
+		return true, nil
+	}
+	if !configure {
+		return false, nil
+	}
+	err := command(ctx, tool, append([]string{"-t", "nat", "-A"}, rule...)...)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// natSysctl reports whether the boolean sysctl is enabled, enabling it first
+// when configure is set.
+func natSysctl(ctx context.Context, name string, configure bool) (bool, error) {
+	out, err := commandOutput(ctx, []string{"sysctl", "-n", name})
+	if err != nil {
+		return false, err
+	}
+	if strings.TrimSpace(string(out)) != "0" {
+		return true, nil
+	}
+	if !configure {
+		return false, nil
+	}
+	err = command(ctx, "sysctl", "-w", name+"=1")
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// serviceTypeName returns the protocol name for a service type, applying the
+// same default as ServiceTypeFlag.
+func serviceTypeName(netType string) string {
+	if netType == "" {
+		return "tcp"
+	}
+	return netType
+}
+
+func ipFamily(host string) int {
+	ip := net.ParseIP(host)
+	if ip != nil && ip.To4() == nil {
+		return 6
+	}
+	return 4
+}
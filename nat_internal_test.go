@@ -0,0 +1,91 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var natIpvs = Ipvs{Services: []Service{
+	{Host: "192.168.0.1", Port: 80, Type: "tcp", Servers: []Server{
+		{Host: "10.0.0.2", Port: 8080, Forwarder: "m"},
+		{Host: "10.1.0.2", Port: 8080, Forwarder: "m"},
+		{Host: "10.0.0.3", Port: 80, Forwarder: "g"},
+	}},
+}}
+
+func TestCheckNat(test *testing.T) {
+	backend, backendRun = fakeExecute, fakeRun
+	fakeCommands = nil
+	fakeRunOutputs = map[string][]byte{
+		"sysctl -n net.ipv4.ip_forward": []byte("0\n"),
+		"ip route get 10.0.0.2":         []byte("10.0.0.2 dev eth1 src 10.0.0.1 uid 0\n    cache\n"),
+		"ip route get 10.1.0.2":         []byte("10.1.0.2 via 10.0.0.254 dev eth1 src 10.0.0.1 uid 0\n    cache\n"),
+	}
+	defer func() { fakeRunOutputs = map[string][]byte{} }()
+
+	problems, err := natIpvs.CheckNat(NatOptions{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if len(problems) != 3 {
+		test.Fatalf("expected 3 problems, got %v", problems)
+	}
+	if problems[0].Server.Host != "10.0.0.2" || !strings.Contains(problems[0].Problem, "net.ipv4.ip_forward") {
+		test.Errorf("unexpected problem %v", problems[0])
+	}
+	if problems[2].Server.Host != "10.1.0.2" || !strings.Contains(problems[2].Problem, "via 10.0.0.254") {
+		test.Errorf("unexpected problem %v", problems[2])
+	}
+	for i := range fakeCommands {
+		if fakeCommands[i][0] == "sysctl" && fakeCommands[i][1] == "-w" {
+			test.Error("CheckNat should not change sysctls")
+		}
+	}
+}
+
+func TestConfigureNatSnat(test *testing.T) {
+	backend, backendRun = fakeExecute, fakeRun
+	fakeCommands = nil
+	fakeRunOutputs = map[string][]byte{
+		"sysctl -n net.ipv4.ip_forward":   []byte("0\n"),
+		"sysctl -n net.ipv4.vs.conntrack": []byte("1\n"),
+	}
+	missing := errors.New("exit status 1")
+	fakeExecuteErrs = map[string]error{
+		"iptables -t nat -C POSTROUTING -d 10.0.0.2/32 -p tcp --dport 8080 -m ipvs --ipvs --vaddr 192.168.0.1/32 --vport 80 -j MASQUERADE": missing,
+	}
+	defer func() {
+		fakeRunOutputs = map[string][]byte{}
+		fakeExecuteErrs = map[string]error{}
+	}()
+
+	problems, err := natIpvs.ConfigureNat(NatOptions{Snat: true})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if len(problems) != 0 {
+		test.Errorf("expected no problems, got %v", problems)
+	}
+
+	commands := make([]string, 0, 0)
+	for i := range fakeCommands {
+		commands = append(commands, strings.Join(fakeCommands[i], " "))
+	}
+	joined := strings.Join(commands, "\n")
+	if !strings.Contains(joined, "sysctl -w net.ipv4.ip_forward=1") {
+		test.Errorf("forwarding was not enabled:\n%s", joined)
+	}
+	if !strings.Contains(joined, "iptables -t nat -A POSTROUTING -d 10.0.0.2/32") {
+		test.Errorf("missing snat rule was not added:\n%s", joined)
+	}
+	if strings.Contains(joined, "iptables -t nat -A POSTROUTING -d 10.1.0.2/32") {
+		test.Errorf("existing snat rule was added again:\n%s", joined)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Normalize puts i in canonical form: every service is normalized and the
+// services are sorted by type, address and port.
+func (i *Ipvs) Normalize() {
+	for j := range i.Services {
+		i.Services[j].Normalize()
+	}
+	sort.SliceStable(i.Services, func(a, b int) bool {
+		return serviceLess(i.Services[a], i.Services[b])
+	})
+	i.services.build(i.Services, serviceKeys)
+}
+
+// Normalize puts s in canonical form: addresses are written the way net.IP
+// prints them, an empty Type and Scheduler are set to their defaults,
+// SchedulerFlags are sorted and the servers are normalized and sorted by
+// address and port.
+func (s *Service) Normalize() {
+	if s.Host != "" {
+		s.Host = canonicalHost(s.Host)
+	}
+	if s.Netmask != "" {
+		s.Netmask = canonicalHost(s.Netmask)
+	}
+	s.Type = canonicalType(s.Type)
+	if s.Scheduler == "" {
+		s.Scheduler = defaultName(ServiceSchedulerFlag)
+	}
+	if len(s.SchedulerFlags) != 0 {
+		flags := make([]string, 0, len(s.SchedulerFlags))
+		seen := make(map[string]bool, len(s.SchedulerFlags))
+		for _, flag := range s.SchedulerFlags {
+			if !seen[flag] {
+				seen[flag] = true
+				flags = append(flags, flag)
+			}
+		}
+		sort.Strings(flags)
+		s.SchedulerFlags = flags
+	}
+	for j := range s.Servers {
+		s.Servers[j].Normalize()
+	}
+	sort.SliceStable(s.Servers, func(a, b int) bool {
+		return addressLess(s.Servers[a].Host, s.Servers[a].Port, s.Servers[b].Host, s.Servers[b].Port)
+	})
+	s.reindex()
+}
+
+// Normalize puts s in canonical form: the address is written the way net.IP
+// prints it and an empty Forwarder is set to its default.
+func (s *Server) Normalize() {
+	s.Host = canonicalHost(s.Host)
+	if s.Forwarder == "" {
+		s.Forwarder = defaultName(ServerForwarderFlag)
+	}
+}
+
+// canonicalHost returns host as net.IP prints it, or lower cased if it is
+// not an ip address.
+func canonicalHost(host string) string {
+	if ip := parseIP(host); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(host)
+}
+
+// parseIP is net.ParseIP, but also accepts ipv6 addresses in brackets and
+// ipv4 octets with leading zeros, which are read as decimal.
+func parseIP(host string) net.IP {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	parts := strings.Split(host, ".")
+	if len(parts) != 4 {
+		return nil
+	}
+	octets := make([]byte, 4)
+	for j, part := range parts {
+		if part == "" || len(part) > 3 || strings.Trim(part, "0123456789") != "" {
+			return nil
+		}
+		n, _ := strconv.Atoi(part)
+		if n > 255 {
+			return nil
+		}
+		octets[j] = byte(n)
+	}
+	return net.IPv4(octets[0], octets[1], octets[2], octets[3])
+}
+
+func canonicalType(netType string) string {
+	if netType == "" {
+		return defaultName(ServiceTypeFlag)
+	}
+	return netType
+}
+
+// defaultName returns the name flags gives the flag "" stands for.
+func defaultName(flags map[string]string) string {
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		if name != "" && flags[name] == flags[""] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+func serviceLess(a, b Service) bool {
+	if canonicalType(a.Type) != canonicalType(b.Type) {
+		return canonicalType(a.Type) < canonicalType(b.Type)
+	}
+	if a.Type == "fwmark" && a.FwMark != b.FwMark {
+		return a.FwMark < b.FwMark
+	}
+	return addressLess(a.Host, a.Port, b.Host, b.Port)
+}
+
+// addressLess orders ip addresses numerically, before host names, then by
+// port.
+func addressLess(aHost string, aPort int, bHost string, bPort int) bool {
+	aIP, bIP := parseIP(aHost), parseIP(bHost)
+	switch {
+	case aIP != nil && bIP != nil:
+		if c := bytes.Compare(aIP.To16(), bIP.To16()); c != 0 {
+			return c < 0
+		}
+	case aIP != nil || bIP != nil:
+		return aIP != nil
+	case aHost != bHost:
+		return aHost < bHost
+	}
+	return aPort < bPort
+}
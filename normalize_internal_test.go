@@ -0,0 +1,84 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCanonicalHost(test *testing.T) {
+	cases := map[string]string{
+		"10.000.0.1":              "10.0.0.1",
+		"010.0.0.001":             "10.0.0.1",
+		"2001:DB8:0:0:0:0:0:1":    "2001:db8::1",
+		"[2001:db8::1]":           "2001:db8::1",
+		"::ffff:10.0.0.1":         "10.0.0.1",
+		"Director.Example.com":    "director.example.com",
+		"10.0.0.256":              "10.0.0.256",
+		"7":                       "7",
+		"2001:0db8:0000::0000:01": "2001:db8::1",
+	}
+	for host, expected := range cases {
+		if canonical := canonicalHost(host); canonical != expected {
+			test.Errorf("%s: expected %s got %s", host, expected, canonical)
+		}
+	}
+}
+
+func TestNormalize(test *testing.T) {
+	ipvs := Ipvs{Services: []Service{
+		{Type: "udp", Host: "10.0.0.1", Port: 53},
+		{Host: "2001:DB8::1", Port: 80, SchedulerFlags: []string{"sh-port", "sh-fallback", "sh-port"}, Servers: []Server{
+			{Host: "2001:db8::0:20", Port: 80},
+			{Host: "2001:db8::3", Port: 80, Forwarder: "m"},
+		}},
+		{Type: "fwmark", FwMark: 2},
+		{Type: "tcp", Host: "10.000.0.2", Port: 80, Scheduler: "rr", Servers: []Server{
+			{Host: "10.0.1.10", Port: 80},
+			{Host: "10.0.1.9", Port: 80},
+		}},
+	}}
+	ipvs.Normalize()
+
+	order := make([]string, 0, 0)
+	for _, service := range ipvs.Services {
+		order = append(order, diffName(service.Type, service.getHost(), service.Port))
+	}
+	if strings.Join(order, ", ") != "fwmark 2, tcp 10.0.0.2:80, tcp [2001:db8::1]:80, udp 10.0.0.1:53" {
+		test.Errorf("unexpected order %v", order)
+	}
+	tcp := ipvs.Services[1]
+	if tcp.Servers[0].Host != "10.0.1.9" || tcp.Servers[0].Forwarder != "g" {
+		test.Errorf("unexpected servers %+v", tcp.Servers)
+	}
+	v6 := ipvs.Services[2]
+	if v6.Type != "tcp" || v6.Scheduler != "wlc" || strings.Join(v6.SchedulerFlags, ",") != "sh-fallback,sh-port" {
+		test.Errorf("defaults not filled in %+v", v6)
+	}
+	if v6.Servers[0].Host != "2001:db8::3" || v6.Servers[1].Host != "2001:db8::20" {
+		test.Errorf("unexpected servers %+v", v6.Servers)
+	}
+}
+
+func TestNormalizedLookups(test *testing.T) {
+	ipvs := &Ipvs{}
+	ipvs.Restore([]Service{{Host: "10.0.0.1", Port: 80, Servers: []Server{{Host: "2001:db8::1", Port: 80}}}})
+	service := ipvs.FindService("tcp", "10.000.0.1", 80)
+	if service == nil || service.FindServer("2001:DB8:0::1", 80) == nil {
+		test.Fatal("lookups should ignore how addresses and defaults are spelled")
+	}
+	a := Service{Type: "", Host: "10.0.0.1", Port: 80, Scheduler: ""}
+	b := Service{Type: "tcp", Host: "10.00.0.1", Port: 80, Scheduler: "wlc"}
+	if !a.Equal(b) || !(Server{Host: "10.0.0.1"}).Equal(Server{Host: "10.0.0.01", Forwarder: "g"}) {
+		test.Error("differently spelled services should be equal")
+	}
+	out, _ := a.ToJson()
+	if !strings.Contains(string(out), `"type":"tcp"`) || !strings.Contains(string(out), `"scheduler":"wlc"`) {
+		test.Errorf("json should be normalized: %s", out)
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+type (
+	// OperationKind is the ipvsadm command an Operation runs.
+	OperationKind string
+
+	// Operation is one ipvsadm command that changes the table, as read by
+	// ParseCommand or ParseScript. Service is the service it targets, and
+	// for server operations Server is the server. Line is the line of the
+	// script it was read from.
+	Operation struct {
+		Kind    OperationKind `json:"kind"`
+		Service Service       `json:"service"`
+		Server  Server        `json:"server"`
+		Args    []string      `json:"args"`
+		Line    int           `json:"line,omitempty"`
+	}
+
+	// ScriptError is a command of an ipvsadm script that could not be read
+	// or applied, at Line.
+	ScriptError struct {
+		Line int
+		Text string
+		Err  error
+	}
+)
+
+const (
+	AddServiceOperation    OperationKind = "add-service"
+	EditServiceOperation   OperationKind = "edit-service"
+	DeleteServiceOperation OperationKind = "delete-service"
+	ClearOperation         OperationKind = "clear"
+	AddServerOperation     OperationKind = "add-server"
+	EditServerOperation    OperationKind = "edit-server"
+	DeleteServerOperation  OperationKind = "delete-server"
+)
+
+var (
+	UnsupportedOperation = errors.New("Unsupported Operation")
+
+	// the ipvsadm commands that become operations
+	operationKinds = map[string]OperationKind{
+		"-A": AddServiceOperation,
+		"-E": EditServiceOperation,
+		"-D": DeleteServiceOperation,
+		"-C": ClearOperation,
+		"-a": AddServerOperation,
+		"-e": EditServerOperation,
+		"-d": DeleteServerOperation,
+	}
+
+	// ipvsadm commands that leave the table alone, which scripts may run
+	// between the ones that change it
+	readOnlyCommands = map[string]bool{
+		"-L": true, "-S": true, "-Z": true, "-h": true, "-v": true,
+	}
+)
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("line %d: %v: %q", e.Line, e.Err, e.Text)
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// ParseCommand reads an ipvsadm command line, with or without the ipvsadm,
+// taking short and long options and filling in ipvsadm's defaults. Commands
+// other than -A, -E, -D, -C, -a, -e and -d return UnsupportedOperation.
+func ParseCommand(args []string) (Operation, error) {
+	if len(args) != 0 && path.Base(args[0]) == "ipvsadm" {
+		args = args[1:]
+	}
+	c, err := parseIpvsadmArgs(args)
+	if err != nil {
+		return Operation{}, err
+	}
+	kind, ok := operationKinds[c.op]
+	if !ok {
+		return Operation{}, fmt.Errorf("%w: %s", UnsupportedOperation, c.op)
+	}
+	if kind != ClearOperation && !c.hasTarget {
+		return Operation{}, fmt.Errorf("%w: %s needs a service address", UnexpecedToken, c.op)
+	}
+	op := Operation{Kind: kind, Service: c.service, Args: append([]string{}, args...)}
+	if kind == AddServerOperation || kind == EditServerOperation || kind == DeleteServerOperation {
+		if !c.hasServer {
+			return Operation{}, fmt.Errorf("%w: %s needs a real server", UnexpecedToken, c.op)
+		}
+		op.Server = c.server
+	}
+	return op, nil
+}
+
+// ParseScript reads the ipvsadm commands of a shell script, one per line or
+// separated by ;, && or ||, with \ continuing a line and # starting a
+// comment. Other commands, and ipvsadm commands that only read the table,
+// are skipped. Commands using shell variables or substitutions, or that
+// change anything else, such as ipvsadm -R, return a *ScriptError with their
+// line.
+func ParseScript(r io.Reader) ([]Operation, error) {
+	ops := []Operation{}
+	commands, err := splitScript(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, command := range commands {
+		words := command.words
+		// skip sudo and variable assignments
+		for len(words) != 0 && (words[0] == "sudo" || (strings.Contains(words[0], "=") && !strings.HasPrefix(words[0], "-"))) {
+			words = words[1:]
+		}
+		if len(words) == 0 {
+			continue
+		}
+		name := path.Base(words[0])
+		if name == "ipvsadm-restore" {
+			return nil, &ScriptError{Line: command.line, Text: strings.Join(command.words, " "), Err: fmt.Errorf("%w: %s", UnsupportedOperation, name)}
+		}
+		if name != "ipvsadm" {
+			continue
+		}
+		if command.expansion {
+			return nil, &ScriptError{Line: command.line, Text: strings.Join(command.words, " "), Err: fmt.Errorf("%w: shell expansion", UnsupportedOperation)}
+		}
+		if c, err := parseIpvsadmArgs(words[1:]); err == nil && readOnlyCommands[c.op] {
+			continue
+		}
+		op, err := ParseCommand(words)
+		if err != nil {
+			return nil, &ScriptError{Line: command.line, Text: strings.Join(command.words, " "), Err: err}
+		}
+		op.Line = command.line
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+type scriptCommand struct {
+	line      int
+	words     []string
+	expansion bool
+}
+
+// splitScript splits a shell script into commands and their words, removing
+// quotes.
+func splitScript(r io.Reader) ([]scriptCommand, error) {
+	commands := []scriptCommand{}
+	current := scriptCommand{}
+	var word strings.Builder
+	inWord := false
+	var quote byte
+	// the next word is the target of a redirection
+	redirect := false
+
+	endWord := func() {
+		if inWord && redirect {
+			redirect = false
+		} else if inWord {
+			current.words = append(current.words, word.String())
+		}
+		word.Reset()
+		inWord = false
+	}
+	endCommand := func() {
+		endWord()
+		redirect = false
+		if len(current.words) != 0 {
+			commands = append(commands, current)
+		}
+		current = scriptCommand{}
+	}
+
+	reader := bufio.NewReader(r)
+	line := 1
+	for {
+		c, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if current.line == 0 && c != ' ' && c != '\t' && c != '\n' {
+			current.line = line
+		}
+
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\\':
+			next, err := reader.ReadByte()
+			if err != nil {
+				word.WriteByte(c)
+				break
+			}
+			if next == '\n' {
+				// a line continuation
+				line++
+				break
+			}
+			if quote == '"' && !strings.ContainsRune("$`\"\\", rune(next)) {
+				word.WriteByte(c)
+			}
+			word.WriteByte(next)
+			inWord = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+				break
+			}
+			current.expansion = current.expansion || c == '$' || c == '`'
+			word.WriteByte(c)
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == '#' && !inWord:
+			// a comment, up to the end of the line
+			for c != '\n' && err == nil {
+				c, err = reader.ReadByte()
+			}
+			endCommand()
+		case c == '>' || c == '<':
+			// drop redirections, along with the file descriptor before them
+			if strings.Trim(word.String(), "0123456789") != "" {
+				endWord()
+			}
+			word.Reset()
+			inWord = false
+			if next, err := reader.ReadByte(); err == nil && next != '>' && next != '&' {
+				reader.UnreadByte()
+			}
+			redirect = true
+		case c == '\n' || c == ';' || c == '|' || c == '&':
+			endCommand()
+		case c == ' ' || c == '\t' || c == '\r':
+			endWord()
+		default:
+			current.expansion = current.expansion || c == '$' || c == '`'
+			word.WriteByte(c)
+			inWord = true
+		}
+		if c == '\n' {
+			line++
+		}
+	}
+	if quote != 0 {
+		return nil, &ScriptError{Line: current.line, Text: strings.Join(current.words, " "), Err: fmt.Errorf("%w: unterminated quote", UnexpecedToken)}
+	}
+	endCommand()
+	return commands, nil
+}
+
+// String is the operation as ipvsadm arguments.
+func (o Operation) String() string {
+	switch o.Kind {
+	case AddServiceOperation:
+		return serviceLine("-A", o.Service)
+	case EditServiceOperation:
+		return serviceLine("-E", o.Service)
+	case DeleteServiceOperation:
+		return fmt.Sprintf("-D %s %s", ServiceTypeFlag[o.Service.Type], o.Service.getHostPort())
+	case ClearOperation:
+		return "-C"
+	case AddServerOperation:
+		return serverLine("-a", o.Service, o.Server.String())
+	case EditServerOperation:
+		return serverLine("-e", o.Service, o.Server.String())
+	case DeleteServerOperation:
+		return serverLine("-d", o.Service, o.Server.getHostPort())
+	}
+	return strings.Join(o.Args, " ")
+}
+
+// Apply changes i the way running the operations would change the table,
+// without running anything. It stops at the first operation ipvsadm would
+// reject, returning a *ScriptError if the operation has a Line, and leaves
+// i as it was.
+func (i *Ipvs) Apply(ops []Operation) error {
+	table := i.Clone()
+	for _, op := range ops {
+		if err := table.apply(op); err != nil {
+			if op.Line != 0 {
+				return &ScriptError{Line: op.Line, Text: strings.Join(op.Args, " "), Err: err}
+			}
+			return err
+		}
+	}
+	*i = table
+	return nil
+}
+
+func (i *Ipvs) apply(op Operation) error {
+	j := -1
+	if op.Kind != ClearOperation {
+		j = i.findService(op.Service.Type, op.Service.getHost(), op.Service.Port)
+	}
+	switch op.Kind {
+	case AddServiceOperation, EditServiceOperation:
+		if _, ok := ServiceSchedulerFlag[op.Service.Scheduler]; !ok {
+			return fmt.Errorf("%w: %q", InvalidServiceScheduler, op.Service.Scheduler)
+		}
+		service := op.Service.Clone()
+		if op.Kind == AddServiceOperation {
+			if j != -1 {
+				return fmt.Errorf("%w: service %s", Conflict, op.Service.getHostPort())
+			}
+			service.Servers = nil
+			i.appendService(service)
+			return nil
+		}
+		if j == -1 {
+			return fmt.Errorf("%w: service %s", NotFound, op.Service.getHostPort())
+		}
+		service.Servers = i.Services[j].Servers
+		service.servers = i.Services[j].servers
+		i.Services[j] = service
+		return nil
+	case DeleteServiceOperation:
+		if j == -1 {
+			return fmt.Errorf("%w: service %s", NotFound, op.Service.getHostPort())
+		}
+		i.removeService(j)
+		return nil
+	case ClearOperation:
+		i.Services = nil
+		i.Reindex()
+		return nil
+	}
+
+	if j == -1 {
+		return fmt.Errorf("%w: service %s", NotFound, op.Service.getHostPort())
+	}
+	service := &i.Services[j]
+	k := service.findServer(op.Server.Host, op.Server.Port)
+	switch op.Kind {
+	case AddServerOperation:
+		if k != -1 {
+			return fmt.Errorf("%w: server %s", Conflict, op.Server.getHostPort())
+		}
+		service.appendServer(op.Server)
+	case EditServerOperation:
+		if k == -1 {
+			return fmt.Errorf("%w: server %s", NotFound, op.Server.getHostPort())
+		}
+		service.Servers[k] = op.Server
+	case DeleteServerOperation:
+		if k == -1 {
+			return fmt.Errorf("%w: server %s", NotFound, op.Server.getHostPort())
+		}
+		service.removeServer(k)
+	default:
+		return fmt.Errorf("%w: %s", UnsupportedOperation, op.Kind)
+	}
+	return nil
+}
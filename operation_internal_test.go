@@ -0,0 +1,148 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(test *testing.T) {
+	op, err := ParseCommand([]string{"/sbin/ipvsadm", "--add-server", "--tcp-service", "10.0.0.1:80", "--real-server=10.0.1.1:8080", "--masquerading", "-w", "3"})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if op.Kind != AddServerOperation || op.Service.Type != "tcp" || op.Service.Host != "10.0.0.1" || op.Service.Port != 80 {
+		test.Errorf("unexpected operation %+v", op)
+	}
+	if op.Server.Host != "10.0.1.1" || op.Server.Port != 8080 || op.Server.Forwarder != "m" || op.Server.Weight != 3 {
+		test.Errorf("unexpected server %+v", op.Server)
+	}
+	if op.String() != "-a -t 10.0.0.1:80 -r 10.0.1.1:8080 -m -y 0 -x 0 -w 3" {
+		test.Errorf("unexpected string %q", op.String())
+	}
+
+	op, err = ParseCommand([]string{"-A", "-f", "7", "-s", "sh", "-p"})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if op.Kind != AddServiceOperation || op.Service.Type != "fwmark" || op.Service.FwMark != 7 || op.Service.Persistence != 300 {
+		test.Errorf("unexpected operation %+v", op)
+	}
+
+	for _, args := range [][]string{{"-L", "-n"}, {"-R"}, {"--set", "900", "120", "300"}} {
+		if _, err := ParseCommand(args); !errors.Is(err, UnsupportedOperation) {
+			test.Errorf("%v: expected UnsupportedOperation, got %v", args, err)
+		}
+	}
+	for _, args := range [][]string{{"-A", "-s", "rr"}, {"-a", "-t", "10.0.0.1:80"}, {"-A", "-t"}, {"-A", "-t", "10.0.0.1:80", "stray"}} {
+		if _, err := ParseCommand(args); !errors.Is(err, UnexpecedToken) && !errors.Is(err, EOFError) {
+			test.Errorf("%v: expected a parse error, got %v", args, err)
+		}
+	}
+}
+
+const testScript = `#!/bin/sh
+set -e
+VIP=10.0.0.1
+
+# web
+ipvsadm -C
+ipvsadm -A -t 10.0.0.1:80 -s wlc -p 300 ; ipvsadm -a -t 10.0.0.1:80 -r 10.0.1.1 -g -w 2
+sudo /sbin/ipvsadm --add-server --tcp-service 10.0.0.1:80 \
+    --real-server 10.0.1.2 --gatewaying --weight 1 > /dev/null 2>&1
+ipvsadm -L -n | grep -q 10.0.0.1 || echo "missing"
+
+# dns
+ipvsadm -A -u '10.0.0.1:53' -s "rr" && ipvsadm -a -u 10.0.0.1:53 -r 10.0.1.1:53 -g
+ipvsadm -E -t 10.0.0.1:80 -s rr
+ipvsadm -e -t 10.0.0.1:80 -r 10.0.1.1 -g -w 5 # heavier
+ipvsadm -d -t 10.0.0.1:80 -r 10.0.1.2
+`
+
+func TestParseScript(test *testing.T) {
+	ops, err := ParseScript(strings.NewReader(testScript))
+	if err != nil {
+		test.Fatal(err)
+	}
+	kinds := []string{}
+	for _, op := range ops {
+		kinds = append(kinds, string(op.Kind))
+	}
+	expected := "clear add-service add-server add-server add-service add-server edit-service edit-server delete-server"
+	if strings.Join(kinds, " ") != expected {
+		test.Fatalf("unexpected operations %v", kinds)
+	}
+	if ops[3].Line != 8 || ops[3].Server.Host != "10.0.1.2" || ops[3].Server.Port != 80 || ops[4].Line != 13 || ops[5].Line != 13 || ops[8].Line != 16 {
+		test.Errorf("unexpected lines or servers %v", ops)
+	}
+
+	ipvs := Ipvs{}
+	if err := ipvs.Apply(ops); err != nil {
+		test.Fatal(err)
+	}
+	web := ipvs.FindService("tcp", "10.0.0.1", 80)
+	if web == nil || web.Scheduler != "rr" || web.Persistence != 0 || len(web.Servers) != 1 || web.Servers[0].Weight != 5 {
+		test.Errorf("web service applied as %+v", web)
+	}
+	dns := ipvs.FindService("udp", "10.0.0.1", 53)
+	if dns == nil || dns.Scheduler != "rr" || len(dns.Servers) != 1 {
+		test.Errorf("dns service applied as %+v", dns)
+	}
+}
+
+func TestParseScriptErrors(test *testing.T) {
+	tests := []struct {
+		script string
+		line   int
+		err    error
+	}{
+		{"ipvsadm -C\nipvsadm -A -t $VIP:80\n", 2, UnsupportedOperation},
+		{"ipvsadm -C\n\nipvsadm -R < rules\n", 3, UnsupportedOperation},
+		{"ipvsadm-restore < /etc/ipvsadm.rules\n", 1, UnsupportedOperation},
+		{"ipvsadm -A -t 10.0.0.1:80 -x\n", 1, EOFError},
+		{"echo ok\nipvsadm -A -t '10.0.0.1:80\n", 2, UnexpecedToken},
+	}
+	for _, tt := range tests {
+		_, err := ParseScript(strings.NewReader(tt.script))
+		scriptErr := &ScriptError{}
+		if !errors.As(err, &scriptErr) || scriptErr.Line != tt.line || !errors.Is(err, tt.err) {
+			test.Errorf("%q: expected %v on line %d, got %v", tt.script, tt.err, tt.line, err)
+		}
+	}
+}
+
+func TestApplyErrors(test *testing.T) {
+	ops, err := ParseScript(strings.NewReader("ipvsadm -A -t 10.0.0.1:80\nipvsadm -a -t 10.0.0.1:80 -r 10.0.1.1\nipvsadm -a -t 10.0.0.1:80 -r 10.0.1.1\n"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	ipvs := Ipvs{}
+	err = ipvs.Apply(ops)
+	scriptErr := &ScriptError{}
+	if !errors.As(err, &scriptErr) || scriptErr.Line != 3 || !errors.Is(err, Conflict) {
+		test.Errorf("expected a Conflict on line 3, got %v", err)
+	}
+	if len(ipvs.Services) != 0 {
+		test.Errorf("a failed apply should leave the table alone, got %+v", ipvs.Services)
+	}
+
+	for _, args := range [][]string{{"-D", "-t", "10.0.0.2:80"}, {"-e", "-t", "10.0.0.1:80", "-r", "10.0.1.9"}, {"-a", "-u", "10.0.0.1:80", "-r", "10.0.1.9"}} {
+		op, err := ParseCommand(args)
+		if err != nil {
+			test.Fatal(err)
+		}
+		if err := ipvs.Apply([]Operation{ops[0], op}); !errors.Is(err, NotFound) {
+			test.Errorf("%v: expected NotFound, got %v", args, err)
+		}
+	}
+	op, _ := ParseCommand([]string{"-A", "-t", "10.0.0.3:80", "-s", "fastest"})
+	if err := ipvs.Apply([]Operation{op}); !errors.Is(err, InvalidServiceScheduler) {
+		test.Errorf("expected InvalidServiceScheduler, got %v", err)
+	}
+}
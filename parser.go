@@ -8,8 +8,10 @@ package lvs
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"strconv"
+	"strings"
 )
 
 var (
@@ -17,14 +19,208 @@ var (
 	UnexpecedToken = errors.New("Unexpected Token")
 )
 
-func parseHostPort(hostPort string) (string, int) {
+type (
+	// ipvsadmCommand is a single parsed ipvsadm command line.
+	ipvsadmCommand struct {
+		op        string
+		service   Service
+		server    Server
+		hasTarget bool
+		hasServer bool
+		args      []string
+		options   map[string]string
+	}
+)
+
+var (
+	// long ipvsadm options and the short form they are handled as
+	ipvsadmLongOptions = map[string]string{
+		"--add-service":    "-A",
+		"--edit-service":   "-E",
+		"--delete-service": "-D",
+		"--clear":          "-C",
+		"--restore":        "-R",
+		"--save":           "-S",
+		"--add-server":     "-a",
+		"--edit-server":    "-e",
+		"--delete-server":  "-d",
+		"--list":           "-L",
+		"--zero":           "-Z",
+		"--help":           "-h",
+		"--version":        "-v",
+		"--tcp-service":    "-t",
+		"--udp-service":    "-u",
+		"--fwmark-service": "-f",
+		"--scheduler":      "-s",
+		"--persistent":     "-p",
+		"--netmask":        "-M",
+		"--sched-flags":    "-b",
+		"--real-server":    "-r",
+		"--gatewaying":     "-g",
+		"--ipip":           "-i",
+		"--masquerading":   "-m",
+		"--weight":         "-w",
+		"--u-threshold":    "-x",
+		"--l-threshold":    "-y",
+		"--numeric":        "-n",
+		"--connection":     "-c",
+	}
+
+	// ipvsadm commands, as opposed to options
+	ipvsadmOps = map[string]bool{
+		"-A": true, "-E": true, "-D": true, "-C": true, "-R": true, "-S": true,
+		"-a": true, "-e": true, "-d": true, "-L": true, "-l": true, "-Z": true,
+		"-h": true, "-v": true,
+		"--set": true, "--start-daemon": true, "--stop-daemon": true,
+	}
+
+	// options that take a value
+	ipvsadmValueOptions = map[string]bool{
+		"-t": true, "-u": true, "-f": true, "-s": true, "-M": true, "-b": true,
+		"-r": true, "-w": true, "-x": true, "-y": true, "--pe": true,
+		"--tun-type": true, "--tun-port": true, "--mcast-interface": true,
+		"--syncid": true, "--mcast-group": true, "--mcast-port": true,
+		"--mcast-ttl": true, "--sync-maxlen": true,
+	}
+)
+
+// parseIpvsadmArgs parses the arguments of one ipvsadm command line (without
+// the ipvsadm itself), filling in the same defaults ipvsadm does.
+func parseIpvsadmArgs(args []string) (ipvsadmCommand, error) {
+	c := ipvsadmCommand{options: map[string]string{}}
+	c.server = Server{Forwarder: "g", Weight: 1}
+
+	for i := 0; i < len(args); i++ {
+		arg, value, hasValue := args[i], "", false
+		if strings.HasPrefix(arg, "--") && strings.Contains(arg, "=") {
+			parts := strings.SplitN(arg, "=", 2)
+			arg, value, hasValue = parts[0], parts[1], true
+		}
+		if short, ok := ipvsadmLongOptions[arg]; ok {
+			arg = short
+		}
+		if arg == "-l" {
+			arg = "-L"
+		}
+
+		if ipvsadmOps[arg] {
+			if c.op != "" {
+				return c, fmt.Errorf("%w: more than one command (%s and %s)", UnexpecedToken, c.op, arg)
+			}
+			c.op = arg
+			// the remaining arguments of these belong to the command
+			if arg == "--set" || arg == "--start-daemon" || arg == "--stop-daemon" {
+				for i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+					i++
+					c.args = append(c.args, args[i])
+				}
+			}
+			continue
+		}
+
+		if ipvsadmValueOptions[arg] && !hasValue {
+			if i+1 >= len(args) {
+				return c, fmt.Errorf("%w: %s needs a value", EOFError, arg)
+			}
+			i++
+			value = args[i]
+		}
+
+		var err error
+		switch arg {
+		case "-t", "-u", "-f":
+			c.hasTarget = true
+			c.service.Type = map[string]string{"-t": "tcp", "-u": "udp", "-f": "fwmark"}[arg]
+			if arg == "-f" {
+				c.service.FwMark, err = strconv.Atoi(value)
+				if err != nil || c.service.FwMark <= 0 {
+					return c, fmt.Errorf("%w: invalid fwmark %q", UnexpecedToken, value)
+				}
+				break
+			}
+			c.service.Host, c.service.Port, err = splitHostPort(value)
+		case "-s":
+			c.service.Scheduler = value
+		case "-p":
+			c.service.Persistence = 300
+			// the timeout is optional
+			if hasValue {
+				c.service.Persistence, err = strconv.Atoi(value)
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				c.service.Persistence, err = strconv.Atoi(args[i])
+			}
+		case "-M":
+			c.service.Netmask = value
+		case "-b":
+			c.service.SchedulerFlags = strings.Split(value, ",")
+		case "--pe":
+			c.service.PersistenceEngine = value
+		case "-r":
+			c.hasServer = true
+			c.server.Host, c.server.Port, err = splitHostPort(value)
+		case "-g":
+			c.server.Forwarder = "g"
+		case "-i":
+			c.server.Forwarder = "i"
+		case "-m":
+			c.server.Forwarder = "m"
+		case "-w":
+			c.server.Weight, err = strconv.Atoi(value)
+		case "-x":
+			c.server.UpperThreshold, err = strconv.Atoi(value)
+		case "-y":
+			c.server.LowerThreshold, err = strconv.Atoi(value)
+		case "--tun-type":
+			c.server.TunnelType = value
+		case "--tun-port":
+			c.server.TunnelPort, err = strconv.Atoi(value)
+		default:
+			if !strings.HasPrefix(arg, "-") {
+				return c, fmt.Errorf("%w: %q", UnexpecedToken, arg)
+			}
+			c.options[arg] = value
+		}
+		if err != nil {
+			return c, fmt.Errorf("%w: invalid value %q for %s", UnexpecedToken, value, arg)
+		}
+	}
+
+	if c.op == "" {
+		return c, fmt.Errorf("%w: no command given", UnexpecedToken)
+	}
+	if c.service.Scheduler == "" && (c.op == "-A" || c.op == "-E") {
+		c.service.Scheduler = "wlc"
+	}
+	// only masquerading can change the port, ipvsadm uses the service's
+	// port for everything else
+	if c.hasServer && c.server.Forwarder != "m" && c.service.Type != "fwmark" {
+		c.server.Port = c.service.Port
+	}
+	return c, nil
+}
+
+// splitHostPort splits an ipvsadm address, which may be a bare host and may
+// put an ipv6 host in brackets.
+func splitHostPort(hostPort string) (string, int, error) {
 	host, port, err := net.SplitHostPort(hostPort)
 	if err != nil {
-		return hostPort, 0
+		return strings.Trim(hostPort, "[]"), 0, nil
 	}
 	intPort, err := strconv.Atoi(port)
 	if err != nil {
-		return hostPort, 0
+		return "", 0, err
+	}
+	return host, intPort, nil
+}
+
+// joinHostPort is the inverse of splitHostPort.
+func joinHostPort(host string, port int) string {
+	if port == 0 {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
 	}
-	return host, intPort
+	return net.JoinHostPort(host, strconv.Itoa(port))
 }
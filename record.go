@@ -0,0 +1,191 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+type (
+	// Recording is a single command and how it went, one json object per
+	// line in a fixture file.
+	Recording struct {
+		Command  []string `json:"command"`
+		Stdin    string   `json:"stdin,omitempty"`
+		Output   string   `json:"output"`
+		Error    string   `json:"error,omitempty"`
+		ExitCode int      `json:"exit_code,omitempty"`
+	}
+
+	// RecordBackend passes commands to another backend and writes each one,
+	// with its output, to a fixture.
+	RecordBackend struct {
+		Backend Backend
+
+		mutex  sync.Mutex
+		writer io.Writer
+	}
+
+	// ReplayBackend answers commands from recordings instead of running
+	// them. Each recording is used once, matching on the command line and
+	// stdin, in the order they were recorded.
+	ReplayBackend struct {
+		mutex      sync.Mutex
+		recordings []Recording
+		used       []bool
+	}
+)
+
+var (
+	ReplayMismatch = errors.New("no recording for command")
+)
+
+func NewRecordBackend(b Backend, w io.Writer) *RecordBackend {
+	return &RecordBackend{Backend: b, writer: w}
+}
+
+func (r *RecordBackend) Execute(ctx context.Context, exe string, args ...string) error {
+	_, err := r.ExecuteOutput(ctx, exe, args...)
+	return err
+}
+
+func (r *RecordBackend) ExecuteOutput(ctx context.Context, exe string, args ...string) ([]byte, error) {
+	out, err := executeOutputOf(r.Backend, ctx, exe, args...)
+	return out, r.record(append([]string{exe}, args...), "", out, err)
+}
+
+func (r *RecordBackend) Run(ctx context.Context, args []string) ([]byte, error) {
+	out, err := r.Backend.Run(ctx, args)
+	return out, r.record(args, "", out, err)
+}
+
+func (r *RecordBackend) ExecuteStdin(ctx context.Context, in, exe string, args ...string) error {
+	_, err := r.ExecuteStdinOutput(ctx, in, exe, args...)
+	return err
+}
+
+func (r *RecordBackend) ExecuteStdinOutput(ctx context.Context, in, exe string, args ...string) ([]byte, error) {
+	out, err := executeStdinOutputOf(r.Backend, ctx, in, exe, args...)
+	return out, r.record(append([]string{exe}, args...), in, out, err)
+}
+
+// record writes the recording and returns the command's error, or the
+// error writing the fixture if the command succeeded.
+func (r *RecordBackend) record(command []string, in string, out []byte, err error) error {
+	recording := Recording{Command: command, Stdin: in, Output: string(out)}
+	if err != nil {
+		recording.Error = err.Error()
+		var ipvsErr *IpvsError
+		if errors.As(err, &ipvsErr) {
+			recording.Output = ipvsErr.Output
+			recording.ExitCode = ipvsErr.ExitCode
+			if ipvsErr.Err != nil {
+				recording.Error = ipvsErr.Err.Error()
+			}
+		}
+	}
+	line, jsonErr := json.Marshal(recording)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, writeErr := r.writer.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return writeErr
+}
+
+// ReadRecordings reads a fixture written by a RecordBackend.
+func ReadRecordings(reader io.Reader) ([]Recording, error) {
+	recordings := make([]Recording, 0, 0)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		recording := Recording{}
+		if err := json.Unmarshal(scanner.Bytes(), &recording); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		recordings = append(recordings, recording)
+	}
+	return recordings, scanner.Err()
+}
+
+func NewReplayBackend(recordings []Recording) *ReplayBackend {
+	return &ReplayBackend{recordings: recordings, used: make([]bool, len(recordings))}
+}
+
+// Remaining returns the recordings that have not been replayed yet.
+func (r *ReplayBackend) Remaining() []Recording {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	remaining := make([]Recording, 0, 0)
+	for i := range r.recordings {
+		if !r.used[i] {
+			remaining = append(remaining, r.recordings[i])
+		}
+	}
+	return remaining
+}
+
+func (r *ReplayBackend) Execute(ctx context.Context, exe string, args ...string) error {
+	_, err := r.replay(append([]string{exe}, args...), "")
+	return err
+}
+
+func (r *ReplayBackend) Run(ctx context.Context, args []string) ([]byte, error) {
+	return r.replay(args, "")
+}
+
+func (r *ReplayBackend) ExecuteOutput(ctx context.Context, exe string, args ...string) ([]byte, error) {
+	return r.replay(append([]string{exe}, args...), "")
+}
+
+func (r *ReplayBackend) ExecuteStdin(ctx context.Context, in, exe string, args ...string) error {
+	_, err := r.replay(append([]string{exe}, args...), in)
+	return err
+}
+
+func (r *ReplayBackend) ExecuteStdinOutput(ctx context.Context, in, exe string, args ...string) ([]byte, error) {
+	return r.replay(append([]string{exe}, args...), in)
+}
+
+func (r *ReplayBackend) replay(command []string, in string) ([]byte, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	line := strings.Join(command, " ")
+	for i := range r.recordings {
+		if r.used[i] || strings.Join(r.recordings[i].Command, " ") != line || r.recordings[i].Stdin != in {
+			continue
+		}
+		r.used[i] = true
+		recording := r.recordings[i]
+		if recording.Error == "" {
+			return []byte(recording.Output), nil
+		}
+		return nil, &IpvsError{
+			Command:  command,
+			ExitCode: recording.ExitCode,
+			Output:   recording.Output,
+			Kind:     classify(command, recording.Output),
+			Err:      errors.New(recording.Error),
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ReplayMismatch, line)
+}
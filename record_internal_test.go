@@ -0,0 +1,131 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestRecordReplay(test *testing.T) {
+	var fixture bytes.Buffer
+	SetBackend(NewRecordBackend(NewSimulator(), &fixture))
+	defer useFakes()
+
+	ipvs := &Ipvs{}
+	if err := ipvs.Restore(testServices); err != nil {
+		test.Fatalf("restore failed: %v", err)
+	}
+	if err := ipvs.RemoveService("tcp", "10.9.9.9", 80); !errors.Is(err, NotFound) {
+		test.Fatalf("expected NotFound, got %v", err)
+	}
+	if err := ipvs.Save(); err != nil {
+		test.Fatalf("save failed: %v", err)
+	}
+	saved := ipvs.Services
+
+	recordings, err := ReadRecordings(&fixture)
+	if err != nil {
+		test.Fatalf("failed to read recordings: %v", err)
+	}
+	if len(recordings) != 3 || recordings[1].ExitCode != 2 || recordings[0].Stdin == "" {
+		test.Fatalf("unexpected recordings %+v", recordings)
+	}
+
+	replay := NewReplayBackend(recordings)
+	SetBackend(replay)
+	ipvs = &Ipvs{}
+	if err := ipvs.Restore(testServices); err != nil {
+		test.Errorf("replayed restore failed: %v", err)
+	}
+	if err := ipvs.RemoveService("tcp", "10.9.9.9", 80); !errors.Is(err, NotFound) {
+		test.Errorf("expected replayed NotFound, got %v", err)
+	}
+	ipvs.Services = nil
+	if err := ipvs.Save(); err != nil || len(ipvs.Services) != len(saved) || ipvs.Services[0].String() != saved[0].String() {
+		test.Errorf("replayed save differs: %v %+v", err, ipvs.Services)
+	}
+	if len(replay.Remaining()) != 0 {
+		test.Errorf("expected every recording to be used, %d left", len(replay.Remaining()))
+	}
+	if err := ipvs.Zero(); !errors.Is(err, ReplayMismatch) {
+		test.Errorf("expected ReplayMismatch, got %v", err)
+	}
+}
+
+func TestRecordExecuteOutput(test *testing.T) {
+	var fixture bytes.Buffer
+	simulator := NewSimulator()
+	record := NewRecordBackend(simulator, &fixture)
+	ctx := context.Background()
+
+	// what a successful command prints is kept, like the lines a restore
+	// rejects before its last
+	if err := record.Execute(ctx, "ipvsadm", "-v"); err != nil {
+		test.Fatal(err)
+	}
+	in := "-A -t 10.0.0.1:80\n-A -t 10.0.0.1:80\n-A -t 10.0.0.2:80\n"
+	out, err := record.ExecuteStdinOutput(ctx, in, "ipvsadm", "-R")
+	if err != nil || string(out) != "Service already exists\n" {
+		test.Fatalf("unexpected restore %q %v", out, err)
+	}
+
+	recordings, err := ReadRecordings(&fixture)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if len(recordings) != 2 || recordings[0].Output != simulator.Version+"\n" || recordings[1].Output != string(out) {
+		test.Fatalf("unexpected recordings %+v", recordings)
+	}
+
+	replay := NewReplayBackend(recordings)
+	if out, err := replay.ExecuteOutput(ctx, "ipvsadm", "-v"); err != nil || string(out) != recordings[0].Output {
+		test.Errorf("unexpected replayed version %q %v", out, err)
+	}
+	if out, err := replay.ExecuteStdinOutput(ctx, in, "ipvsadm", "-R"); err != nil || string(out) != recordings[1].Output {
+		test.Errorf("unexpected replayed restore %q %v", out, err)
+	}
+}
+
+func TestReplayFixture(test *testing.T) {
+	file, err := os.Open("testdata/director.jsonl")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer file.Close()
+	recordings, err := ReadRecordings(file)
+	if err != nil {
+		test.Fatalf("failed to read fixture: %v", err)
+	}
+	SetBackend(NewReplayBackend(recordings))
+	defer useFakes()
+
+	ipvs := &Ipvs{}
+	if err := ipvs.Save(); err != nil {
+		test.Fatalf("save failed: %v", err)
+	}
+	services := ipvs.Services
+	if len(services) != 2 || len(services[0].Servers) != 2 || services[0].Servers[1].UpperThreshold != 500 {
+		test.Errorf("unexpected services %+v", services)
+	}
+	if services[1].Type != "udp" || services[1].Servers[0].Forwarder != "g" {
+		test.Errorf("unexpected udp service %+v", services[1])
+	}
+	if err := ipvs.RemoveService("tcp", "192.168.0.10", 443); !errors.Is(err, NotFound) {
+		test.Errorf("expected NotFound, got %v", err)
+	}
+}
+
+func TestReadRecordingsError(test *testing.T) {
+	_, err := ReadRecordings(bytes.NewBufferString("{\"command\":[\"ipvsadm\"]}\n\n{bad\n"))
+	if err == nil || err.Error()[:7] != "line 3:" {
+		test.Errorf("expected an error on line 3, got %v", err)
+	}
+}
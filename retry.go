@@ -0,0 +1,115 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+type (
+	// RetryPolicy decides how often and how long apart a failed command is
+	// tried again. The delay before retry n is Backoff * Multiplier^(n-1),
+	// at most MaxBackoff, less a random fraction of up to Jitter of it.
+	RetryPolicy struct {
+		// MaxAttempts counts the first try, 0 or 1 disables retries.
+		MaxAttempts int
+		Backoff     time.Duration
+		MaxBackoff  time.Duration
+		// Multiplier defaults to 2.
+		Multiplier float64
+		// Jitter is between 0 and 1.
+		Jitter float64
+		// Retryable defaults to IsRetryable.
+		Retryable func(err error) bool
+	}
+
+	// Retry describes a failed command about to be tried again.
+	Retry struct {
+		Trace   Trace
+		Attempt int
+		Delay   time.Duration
+	}
+
+	// RetryHook is called before every retry.
+	RetryHook func(ctx context.Context, retry Retry)
+)
+
+var (
+	// returned, wrapped in an *IpvsError, when ipvsadm reports a failure
+	// that may not happen again
+	Transient = errors.New("transient failure")
+
+	// Retries is applied to every command, the zero value never retries.
+	// Restores are never retried, as a failed restore may have applied
+	// part of its input.
+	Retries RetryPolicy
+
+	// OnRetry, when set, is called before every retry.
+	OnRetry RetryHook
+)
+
+// IsRetryable reports whether err is a Transient failure.
+func IsRetryable(err error) bool {
+	return errors.Is(err, Transient)
+}
+
+// Delay returns how long to wait before retry n, counting from 1.
+func (p RetryPolicy) Delay(n int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	delay := float64(p.Backoff)
+	for i := 1; i < n; i++ {
+		delay *= multiplier
+		if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		delay -= delay * p.Jitter * rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// retry waits before retrying the command in trace, returning false if it
+// should not be retried.
+func (p RetryPolicy) retry(ctx context.Context, trace Trace, attempt int) bool {
+	if attempt >= p.MaxAttempts || trace.Stdin != "" || ctx.Err() != nil || !p.retryable(trace.Err) {
+		return false
+	}
+	retry := Retry{Trace: trace, Attempt: attempt, Delay: p.Delay(attempt)}
+	if Logger != nil {
+		Logger.WarnContext(ctx, "retrying command", append(traceAttrs(trace), slog.Int("attempt", attempt), slog.Duration("delay", retry.Delay), slog.Any("error", trace.Err))...)
+	}
+	if OnRetry != nil {
+		OnRetry(ctx, retry)
+	}
+
+	timer := time.NewTimer(retry.Delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
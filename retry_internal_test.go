@@ -0,0 +1,105 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func busy(command ...string) error {
+	return &IpvsError{Command: command, ExitCode: 2, Output: "Device or resource busy\n", Kind: classify(command, "Device or resource busy")}
+}
+
+func TestRetryEditServer(test *testing.T) {
+	simulator := NewSimulator()
+	faults := NewFaultBackend(simulator, Fault{Match: regexp.MustCompile(`^ipvsadm -e`), Err: busy("ipvsadm", "-e"), Times: 2})
+	SetBackend(faults)
+	defer useFakes()
+	Retries = RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+	var retries []Retry
+	OnRetry = func(ctx context.Context, retry Retry) { retries = append(retries, retry) }
+	defer func() { Retries, OnRetry = RetryPolicy{}, nil }()
+
+	ipvs := &Ipvs{}
+	if err := ipvs.Restore(testServices); err != nil {
+		test.Fatalf("restore failed: %v", err)
+	}
+	server := testServices[0].Servers[0]
+	server.Weight = 7
+	if err := ipvs.Services[0].EditServer(server); err != nil {
+		test.Fatalf("edit should have been retried, got %v", err)
+	}
+	if len(retries) != 2 || retries[0].Attempt != 1 || retries[1].Attempt != 2 || retries[1].Delay != 2*time.Millisecond {
+		test.Errorf("unexpected retries %+v", retries)
+	}
+	if simulator.Ipvs().Services[0].Servers[0].Weight != 7 || ipvs.Services[0].Servers[0].Weight != 7 {
+		test.Error("the kernel and model should both have the new weight")
+	}
+}
+
+func TestRetryGivesUp(test *testing.T) {
+	faults := NewFaultBackend(NewSimulator(), Fault{Err: busy("ipvsadm", "-D")})
+	SetBackend(faults)
+	defer useFakes()
+	Retries = RetryPolicy{MaxAttempts: 3}
+	defer func() { Retries = RetryPolicy{} }()
+
+	err := (&Ipvs{}).RemoveService("tcp", "10.0.0.1", 80)
+	if !errors.Is(err, DeleteFailed) || !errors.Is(err, Transient) {
+		test.Errorf("expected a transient DeleteFailed, got %v", err)
+	}
+	if faults.Commands() != 3 {
+		test.Errorf("expected 3 attempts, got %d", faults.Commands())
+	}
+
+	// not retryable
+	faults.Reset()
+	err = (&Ipvs{}).RemoveService("tcp", "10.0.0.1", 80)
+	if !errors.Is(err, NotFound) || faults.Commands() != 1 {
+		test.Errorf("NotFound should not be retried, got %v after %d commands", err, faults.Commands())
+	}
+
+	// restores are never retried
+	faults.Add(Fault{Err: busy("ipvsadm", "-R")})
+	if err := (&Ipvs{}).Restore(testServices); !errors.Is(err, Transient) || faults.Commands() != 2 {
+		test.Errorf("restore should not be retried, got %v after %d commands", err, faults.Commands())
+	}
+}
+
+func TestRetryCanceled(test *testing.T) {
+	faults := NewFaultBackend(NewSimulator(), Fault{Err: busy("ipvsadm", "-Z")})
+	SetBackend(faults)
+	defer useFakes()
+	Retries = RetryPolicy{MaxAttempts: 5, Backoff: time.Hour}
+	defer func() { Retries = RetryPolicy{} }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := (&Ipvs{}).ZeroContext(ctx); !errors.Is(err, Transient) || faults.Commands() != 1 {
+		test.Errorf("expected the first failure after cancel, got %v after %d commands", err, faults.Commands())
+	}
+}
+
+func TestRetryDelay(test *testing.T) {
+	policy := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Multiplier: 3}
+	expected := []time.Duration{10 * time.Millisecond, 30 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond}
+	for i := range expected {
+		if delay := policy.Delay(i + 1); delay != expected[i] {
+			test.Errorf("retry %d: expected %v got %v", i+1, expected[i], delay)
+		}
+	}
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if delay := policy.Delay(2); delay > 30*time.Millisecond || delay < 15*time.Millisecond {
+			test.Fatalf("jittered delay %v out of range", delay)
+		}
+	}
+}
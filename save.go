@@ -0,0 +1,149 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type (
+	// SaveError is a line of `ipvsadm -S` output that could not be parsed.
+	SaveError struct {
+		Line int
+		Text string
+		Err  error
+	}
+)
+
+func (e *SaveError) Error() string {
+	return fmt.Sprintf("line %d: %v: %q", e.Line, e.Err, e.Text)
+}
+
+func (e *SaveError) Unwrap() error {
+	return e.Err
+}
+
+// ParseSave reads the rules printed by `ipvsadm -S` from r one line at a
+// time, calling fn with each service once all of its servers have been
+// read, so only one service is held in memory. It stops at the first error
+// returned by fn, or the first line it can't parse as a *SaveError.
+func ParseSave(r io.Reader, fn func(Service) error) error {
+	var service *Service
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		c, err := parseIpvsadmArgs(fields)
+		if err != nil {
+			return &SaveError{Line: n, Text: scanner.Text(), Err: err}
+		}
+
+		switch c.op {
+		case "-A":
+			if service != nil {
+				if err := fn(*service); err != nil {
+					return err
+				}
+			}
+			service = &c.service
+		case "-a":
+			if service == nil || !service.matches(c.service.Type, c.service.getHost(), c.service.Port) {
+				return &SaveError{Line: n, Text: scanner.Text(), Err: fmt.Errorf("%w: server of a service that was not saved before it", UnexpecedToken)}
+			}
+			service.Servers = append(service.Servers, c.server)
+		default:
+			return &SaveError{Line: n, Text: scanner.Text(), Err: fmt.Errorf("%w: %s", UnexpecedToken, c.op)}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if service != nil {
+		return fn(*service)
+	}
+	return nil
+}
+
+// ReadSave replaces the services of i with the rules printed by
+// `ipvsadm -S` read from r, see ParseSave.
+func (i *Ipvs) ReadSave(r io.Reader) error {
+	services := make([]Service, 0, 0)
+	err := ParseSave(r, func(service Service) error {
+		services = append(services, service)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	i.Services = services
+	i.Reindex()
+	return nil
+}
+
+// WriteSave writes the services of i, in order, byte for byte the way
+// `ipvsadm -S -n` prints them. ReadSave reads the output back to an equal
+// table, as long as i only holds what the kernel keeps: a netmask or
+// persistence engine only for persistent services, the service's port for
+// servers that aren't masqueraded and a tunnel port only with a tunnel
+// type.
+func (i Ipvs) WriteSave(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	for _, service := range i.Services {
+		for _, line := range saveLines(service) {
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.Flush()
+}
+
+// saveLines returns the lines `ipvsadm -S -n` prints for s and its servers.
+func saveLines(s Service) []string {
+	target := ServiceTypeFlag[s.Type] + " " + net.JoinHostPort(canonicalHost(s.Host), strconv.Itoa(s.Port))
+	if s.Type == "fwmark" {
+		target = "-f " + s.getHost()
+	}
+	line := "-A " + target + " -s " + ServiceSchedulerFlag[s.Scheduler]
+	if len(s.SchedulerFlags) != 0 {
+		line += " -b " + strings.Join(s.SchedulerFlags, ",")
+	}
+	if s.Persistence != 0 {
+		line += " -p " + strconv.Itoa(s.Persistence)
+		// the netmask is only printed when it isn't a single address
+		if s.Netmask != "" && s.Netmask != "255.255.255.255" && s.Netmask != "128" {
+			line += " -M " + canonicalHost(s.Netmask)
+		}
+		if s.PersistenceEngine != "" {
+			line += " --pe " + s.PersistenceEngine
+		}
+	}
+
+	lines := []string{line}
+	for _, server := range s.Servers {
+		line := fmt.Sprintf("-a %s -r %s %s -w %d", target, net.JoinHostPort(canonicalHost(server.Host), strconv.Itoa(server.Port)), ServerForwarderFlag[server.Forwarder], server.Weight)
+		if server.UpperThreshold != 0 {
+			line += " -x " + strconv.Itoa(server.UpperThreshold)
+		}
+		if server.LowerThreshold != 0 {
+			line += " -y " + strconv.Itoa(server.LowerThreshold)
+		}
+		if server.TunnelType != "" {
+			line += " --tun-type " + server.TunnelType
+			if server.TunnelPort != 0 {
+				line += " --tun-port " + strconv.Itoa(server.TunnelPort)
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
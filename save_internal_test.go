@@ -0,0 +1,271 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// saveOutput writes `ipvsadm -S -n` output for services with servers each
+func saveOutput(w io.Writer, services, servers int) {
+	for j := 0; j < services; j++ {
+		fmt.Fprintf(w, "-A -t 10.0.%d.%d:80 -s wlc\n", j/250, j%250)
+		for k := 0; k < servers; k++ {
+			fmt.Fprintf(w, "-a -t 10.0.%d.%d:80 -r 10.1.%d.%d:80 -g -w 1\n", j/250, j%250, k/250, k%250)
+		}
+	}
+}
+
+func TestParseSave(test *testing.T) {
+	reader, writer := io.Pipe()
+	go func() {
+		saveOutput(writer, 20, 2500)
+		writer.Close()
+	}()
+	var services, servers int
+	err := ParseSave(reader, func(service Service) error {
+		services++
+		servers += len(service.Servers)
+		return nil
+	})
+	if err != nil || services != 20 || servers != 50000 {
+		test.Errorf("expected 20 services and 50000 servers, got %d and %d: %v", services, servers, err)
+	}
+
+	stop := errors.New("stop")
+	services = 0
+	err = ParseSave(strings.NewReader("-A -t 10.0.0.1:80 -s rr\n-A -t 10.0.0.2:80 -s rr\n"), func(service Service) error {
+		services++
+		return stop
+	})
+	if err != stop || services != 1 {
+		test.Errorf("expected fn's error after 1 service, got %v after %d", err, services)
+	}
+}
+
+func TestParseSaveErrors(test *testing.T) {
+	cases := []struct {
+		input string
+		line  int
+	}{
+		{"-A -t 10.0.0.1:80 -s rr\n\n-a -t 10.0.0.1:80 -r 10.0.0.2:80 -w many\n", 3},
+		{"-A -t 10.0.0.1:80 -s rr\n-a -t 10.0.0.9:80 -r 10.0.0.2:80\n", 2},
+		{"-D -t 10.0.0.1:80\n", 1},
+		{"-A -t 10.0.0.1:80 -s\n", 1},
+	}
+	for i := range cases {
+		err := ParseSave(strings.NewReader(cases[i].input), func(Service) error { return nil })
+		var saveErr *SaveError
+		if !errors.As(err, &saveErr) || saveErr.Line != cases[i].line {
+			test.Errorf("case %d: expected an error on line %d, got %v", i, cases[i].line, err)
+		}
+	}
+}
+
+func TestStream(test *testing.T) {
+	var lines int
+	err := stream(context.Background(), []string{"sh", "-c", "echo '-A -t 10.0.0.1:80 -s rr'; echo '-A -t 10.0.0.2:80 -s rr'"}, func(out io.Reader) error {
+		return ParseSave(out, func(Service) error {
+			lines++
+			return nil
+		})
+	})
+	if err != nil || lines != 2 {
+		test.Errorf("expected 2 services, got %d: %v", lines, err)
+	}
+
+	// a failing reader stops the command
+	stop := errors.New("stop")
+	err = stream(context.Background(), []string{"sh", "-c", "while :; do echo '-A -t 10.0.0.1:80 -s rr'; done"}, func(out io.Reader) error {
+		return ParseSave(out, func(Service) error { return stop })
+	})
+	if err != stop {
+		test.Errorf("expected the reader's error, got %v", err)
+	}
+
+	err = stream(context.Background(), []string{"sh", "-c", "echo 'Memory allocation problem' >&2; exit 2"}, func(out io.Reader) error {
+		return ParseSave(out, func(Service) error { return nil })
+	})
+	if !errors.Is(err, Transient) {
+		test.Errorf("expected the command's error, got %v", err)
+	}
+}
+
+func BenchmarkParseSave(b *testing.B) {
+	var output strings.Builder
+	saveOutput(&output, 100, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ParseSave(strings.NewReader(output.String()), func(Service) error { return nil })
+	}
+}
+
+func TestWriteSave(test *testing.T) {
+	saved, err := os.ReadFile("testdata/ipvsadm.save")
+	if err != nil {
+		test.Fatal(err)
+	}
+	ipvs := Ipvs{}
+	if err := ipvs.ReadSave(bytes.NewReader(saved)); err != nil {
+		test.Fatal(err)
+	}
+	if len(ipvs.Services) != 5 || ipvs.Services[2].Host != "2001:db8::10" || ipvs.Services[2].Netmask != "64" || ipvs.Services[3].Servers[0].TunnelPort != 6080 {
+		test.Fatalf("unexpected table %+v", ipvs.Services)
+	}
+
+	out := &bytes.Buffer{}
+	if err := ipvs.WriteSave(out); err != nil {
+		test.Fatal(err)
+	}
+	if out.String() != string(saved) {
+		test.Errorf("save did not round trip, got\n%s", out)
+	}
+
+	// restoring the rules ipvs.String writes gives the same table
+	defer useFakes()
+	simulator := NewSimulator()
+	SetBackend(simulator)
+	if err := (&Ipvs{}).Restore(ipvs.Services); err != nil {
+		test.Fatal(err)
+	}
+	live, err := simulator.Run(context.Background(), []string{"ipvsadm", "-S", "-n"})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if string(live) != string(saved) {
+		test.Errorf("restored table saved as\n%s", live)
+	}
+
+	// addresses are written the way ipvsadm prints them
+	out.Reset()
+	(Ipvs{Services: []Service{{Type: "tcp", Host: "2001:DB8:0::1", Port: 80, Servers: []Server{{Host: "10.000.0.1", Port: 80}}}}}).WriteSave(out)
+	if out.String() != "-A -t [2001:db8::1]:80 -s wlc\n-a -t [2001:db8::1]:80 -r 10.0.0.1:80 -g -w 0\n" {
+		test.Errorf("unexpected save %q", out)
+	}
+}
+
+// saveTable is a random table holding only what the kernel keeps, so it
+// survives `ipvsadm -S`.
+type saveTable struct {
+	Ipvs
+}
+
+func (saveTable) Generate(r *rand.Rand, size int) reflect.Value {
+	pick := func(a ...string) string {
+		return a[r.Intn(len(a))]
+	}
+	address := func(v6 bool) string {
+		if v6 {
+			return fmt.Sprintf("2001:db8::%x:%x", r.Intn(0x10000), r.Intn(0x10000))
+		}
+		return fmt.Sprintf("10.%d.%d.%d", r.Intn(256), r.Intn(256), r.Intn(256))
+	}
+	schedulers := []string{}
+	for name := range ServiceSchedulerFlag {
+		if name != "" {
+			schedulers = append(schedulers, name)
+		}
+	}
+	sort.Strings(schedulers)
+
+	table := Ipvs{}
+	seen := map[string]bool{}
+	for j := r.Intn(size%8 + 1); j > 0; j-- {
+		v6 := r.Intn(2) == 0
+		service := Service{Type: pick("tcp", "udp", "fwmark"), Scheduler: pick(schedulers...)}
+		if service.Type == "fwmark" {
+			v6 = false
+			service.FwMark = r.Intn(1000) + 1
+		} else {
+			service.Host, service.Port = address(v6), r.Intn(65536)
+		}
+		if r.Intn(2) == 0 || (service.Port == 0 && service.Type != "fwmark") {
+			service.Persistence = r.Intn(86400) + 1
+			if v6 {
+				service.Netmask = pick("", "64", "96")
+			} else {
+				service.Netmask = pick("", "255.255.255.0", "255.255.0.0")
+			}
+			service.PersistenceEngine = pick("", "sip")
+		}
+		for _, flag := range []string{"flag-1", "flag-2", "flag-3"} {
+			if r.Intn(3) == 0 {
+				service.SchedulerFlags = append(service.SchedulerFlags, flag)
+			}
+		}
+		key := serviceKey(service.Type, service.getHost(), service.Port)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		servers := map[string]bool{}
+		for k := r.Intn(5); k > 0; k-- {
+			server := Server{Host: address(v6), Port: service.Port, Forwarder: pick("g", "i", "m"), Weight: r.Intn(65536)}
+			if server.Forwarder == "m" || service.Type == "fwmark" {
+				server.Port = r.Intn(65536)
+			}
+			if r.Intn(2) == 0 {
+				server.UpperThreshold = r.Intn(10000) + 1
+				server.LowerThreshold = r.Intn(server.UpperThreshold)
+			}
+			if server.Forwarder == "i" {
+				server.TunnelType = pick("", "ipip", "gue", "gre")
+				if server.TunnelType == "gue" {
+					server.TunnelPort = r.Intn(65535) + 1
+				}
+			}
+			if !servers[serverKey(server.Host, server.Port)] {
+				servers[serverKey(server.Host, server.Port)] = true
+				service.Servers = append(service.Servers, server)
+			}
+		}
+		table.Services = append(table.Services, service)
+	}
+	return reflect.ValueOf(saveTable{table})
+}
+
+func TestSaveRoundTrip(test *testing.T) {
+	property := func(table saveTable) bool {
+		first := &bytes.Buffer{}
+		if err := table.WriteSave(first); err != nil {
+			test.Log(err)
+			return false
+		}
+		read := Ipvs{}
+		if err := read.ReadSave(bytes.NewReader(first.Bytes())); err != nil {
+			test.Logf("%v\n%s", err, first)
+			return false
+		}
+		if !read.Equal(table.Ipvs) {
+			test.Logf("read back a different table: %s\n%s", read.Diff(table.Ipvs), first)
+			return false
+		}
+		second := &bytes.Buffer{}
+		read.WriteSave(second)
+		if second.String() != first.String() {
+			test.Logf("save is not stable:\n%s\n%s", first, second)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		test.Error(err)
+	}
+}
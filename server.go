@@ -10,8 +10,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"strconv"
-	"strings"
 )
 
 type (
@@ -20,8 +20,10 @@ type (
 		Port           int    `json:"port"`
 		Forwarder      string `json:"forwarder"`
 		Weight         int    `json:"weight"`
-		UpperThreshold int    `json:upper_threshold`
-		LowerThreshold int    `json:lower_threshold`
+		UpperThreshold int    `json:"upper_threshold"`
+		LowerThreshold int    `json:"lower_threshold"`
+		TunnelType     string `json:"tunnel_type,omitempty"`
+		TunnelPort     int    `json:"tunnel_port,omitempty"`
 	}
 )
 
@@ -35,6 +37,13 @@ var (
 
 	InvalidServerForwarder = errors.New("Invalid Server Forwarder")
 	InvalidServerPort      = errors.New("Invalid Server Port for Forwarder")
+	InvalidServerTunnel    = errors.New("Invalid Server Tunnel Type")
+
+	ServerTunnelTypes = map[string]bool{
+		"ipip": true,
+		"gue":  true,
+		"gre":  true,
+	}
 )
 
 func (s Server) Validate() error {
@@ -42,6 +51,14 @@ func (s Server) Validate() error {
 	if !ok {
 		return InvalidServerForwarder
 	}
+	if s.TunnelType != "" {
+		if s.Forwarder != "i" || !ServerTunnelTypes[s.TunnelType] {
+			return InvalidServerTunnel
+		}
+		if err := HostCapabilities.checkFeature(FeatureTunnelType); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -49,53 +66,28 @@ func (s *Server) FromJson(bytes []byte) error {
 	return json.Unmarshal(bytes, s)
 }
 
+// ToJson encodes s normalized.
 func (s Server) ToJson() ([]byte, error) {
+	s.Normalize()
 	return json.Marshal(s)
 }
 
 func (s Server) getHostPort() string {
-	return fmt.Sprintf("%s:%d", s.Host, s.Port)
-}
-
-func (s Server) String() string {
-	return fmt.Sprintf("%s %s -y %d -x %d -w %d",
-		s.getHostPort(), ServerForwarderFlag[s.Forwarder],
-		s.LowerThreshold, s.UpperThreshold, s.Weight)
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
 }
 
-func parseServer(serverString string) Server {
-	server := Server{
-		Forwarder: "g",
-		Weight:    1,
+func (s Server) getTunnel() string {
+	if s.TunnelType == "" {
+		return ""
 	}
-	var err error
-	exploded := strings.Split(serverString, " ")
-	for i := range exploded {
-		switch exploded[i] {
-		case "-r", "--real-server":
-			server.Host, server.Port = parseHostPort(exploded[i+1])
-		case "-g", "--gatewaying":
-			server.Forwarder = "g"
-		case "-i", "--ipip":
-			server.Forwarder = "i"
-		case "-m", "--masquerading":
-			server.Forwarder = "m"
-		case "-w", "--weight":
-			server.Weight, err = strconv.Atoi(exploded[i+1])
-			if err != nil {
-				server.Weight = 1
-			}
-		case "-x", "--u-threshold":
-			server.UpperThreshold, err = strconv.Atoi(exploded[i+1])
-			if err != nil {
-				server.UpperThreshold = 0
-			}
-		case "-y", "--l-threshold":
-			server.LowerThreshold, err = strconv.Atoi(exploded[i+1])
-			if err != nil {
-				server.LowerThreshold = 0
-			}
-		}
+	if s.TunnelPort != 0 {
+		return fmt.Sprintf(" --tun-type %s --tun-port %d", s.TunnelType, s.TunnelPort)
 	}
-	return server
+	return " --tun-type " + s.TunnelType
+}
+
+func (s Server) String() string {
+	return fmt.Sprintf("%s %s -y %d -x %d -w %d%s",
+		s.getHostPort(), ServerForwarderFlag[s.Forwarder],
+		s.LowerThreshold, s.UpperThreshold, s.Weight, s.getTunnel())
 }
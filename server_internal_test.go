@@ -5,3 +5,33 @@
 // at http://mozilla.org/MPL/2.0/.
 //
 package lvs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestServerParse(test *testing.T) {
+	server := Server{Host: "10.0.1.1", Port: 8080, Forwarder: "m", Weight: 5, UpperThreshold: 100, LowerThreshold: 10}
+	c, err := parseIpvsadmArgs(strings.Fields("-a -t 10.0.0.1:80 -r " + server.String()))
+	if err != nil || c.server != server {
+		test.Errorf("expected %+v got %+v %v", server, c.server, err)
+	}
+
+	c, err = parseIpvsadmArgs(strings.Fields("-a -t 10.0.0.1:80 -r 10.0.1.1:80"))
+	if err != nil || c.server.Forwarder != "g" || c.server.Weight != 1 {
+		test.Errorf("defaults were not applied: %+v %v", c.server, err)
+	}
+}
+
+func TestServerValidate(test *testing.T) {
+	if (Server{Forwarder: "x"}).Validate() != InvalidServerForwarder {
+		test.Error("unknown forwarders should not validate")
+	}
+	if (Server{Forwarder: "g", TunnelType: "gue"}).Validate() != InvalidServerTunnel {
+		test.Error("tunnels need the ipip forwarder")
+	}
+	if err := (Server{Forwarder: "i", TunnelType: "gre"}).Validate(); err != nil {
+		test.Error(err)
+	}
+}
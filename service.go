@@ -7,6 +7,7 @@
 package lvs
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,13 +17,18 @@ import (
 
 type (
 	Service struct {
-		Host        string   `json:"host"`
-		Port        int      `json:"port"`
-		Type        string   `json:"type"`
-		Scheduler   string   `json:"scheduler"`
-		Persistence int      `json:"persistence"`
-		Netmask     string   `json:"netmask"`
-		Servers     []Server `json:"servers"`
+		Host              string   `json:"host"`
+		Port              int      `json:"port"`
+		Type              string   `json:"type"`
+		FwMark            int      `json:"fwmark,omitempty"`
+		Scheduler         string   `json:"scheduler"`
+		Persistence       int      `json:"persistence"`
+		Netmask           string   `json:"netmask"`
+		SchedulerFlags    []string `json:"scheduler_flags,omitempty"`
+		PersistenceEngine string   `json:"persistence_engine,omitempty"`
+		Servers           []Server `json:"servers"`
+
+		servers keyIndex[Server]
 	}
 )
 
@@ -45,6 +51,10 @@ var (
 		"sh":    "sh",
 		"sed":   "sed",
 		"nq":    "nq",
+		"fo":    "fo",
+		"ovf":   "ovf",
+		"mh":    "mh",
+		"twos":  "twos",
 		"":      "wlc", // default
 	}
 
@@ -61,82 +71,146 @@ func (s Service) Validate() error {
 	if !ok {
 		return InvalidServiceScheduler
 	}
+	err := HostCapabilities.checkScheduler(ServiceSchedulerFlag[s.Scheduler])
+	if err != nil {
+		return err
+	}
+	if len(s.SchedulerFlags) != 0 {
+		if err := HostCapabilities.checkFeature(FeatureSchedulerFlags); err != nil {
+			return err
+		}
+	}
+	if s.PersistenceEngine != "" {
+		if err := HostCapabilities.checkFeature(FeaturePersistenceEngine); err != nil {
+			return err
+		}
+	}
+	if s.Type == "fwmark" {
+		mark, err := strconv.Atoi(s.getHost())
+		if err != nil || mark <= 0 {
+			return InvalidFwMark
+		}
+	}
 	for _, server := range s.Servers {
 		err := server.Validate()
 		if err != nil {
 			return err
 		}
 		// follow ipvsadm rules
-		if server.Forwarder != "m" && (s.Port != server.Port) {
+		if server.Forwarder != "m" && s.Type != "fwmark" && s.Port != server.Port {
 			return InvalidServerPort
 		}
 	}
 	return nil
 }
 
+// matches reports whether the service is identified by netType, host and
+// port. fwmark services are identified by their mark, which callers may pass
+// as the host.
+func (s Service) matches(netType, host string, port int) bool {
+	return s.matchesCanonical(canonicalType(netType), canonicalHost(host), port)
+}
+
+// matchesCanonical is matches for a type and host already in canonical
+// form.
+func (s Service) matchesCanonical(netType, host string, port int) bool {
+	if canonicalType(s.Type) != netType || s.Port != port {
+		return false
+	}
+	return sameHost(s.getHost(), host) || sameHost(s.Host, host)
+}
+
+// FindServer looks the server up in an index kept up to date by s's
+// methods, like Ipvs.FindService.
 func (s Service) FindServer(host string, port int) *Server {
-	for i := range s.Servers {
-		if s.Servers[i].Host == host && s.Servers[i].Port == port {
-			return &s.Servers[i]
-		}
+	if i := s.findServer(host, port); i != -1 {
+		return &s.Servers[i]
 	}
 	return nil
 }
 
+func (s Service) findServer(host string, port int) int {
+	host = canonicalHost(host)
+	return s.servers.find(s.Servers, canonicalServerKey(host, port), func(server Server) bool {
+		return server.Port == port && sameHost(server.Host, host)
+	})
+}
+
+func (s *Service) reindex() {
+	s.servers.build(s.Servers, serverKeys)
+}
+
+func (s *Service) appendServer(server Server) {
+	before := s.Servers
+	s.Servers = append(s.Servers, server)
+	s.servers.appended(before, s.Servers, serverKeys)
+}
+
+func (s *Service) removeServer(i int) {
+	s.Servers = append(s.Servers[:i], s.Servers[i+1:]...)
+	s.reindex()
+}
+
 func (s *Service) AddServer(server Server) error {
+	return s.AddServerContext(context.Background(), server)
+}
+
+func (s *Service) AddServerContext(ctx context.Context, server Server) error {
 	err := server.Validate()
 	if err != nil {
 		return err
 	}
-	if server.Forwarder != "m" && (s.Port != server.Port) {
+	if server.Forwarder != "m" && s.Type != "fwmark" && s.Port != server.Port {
 		return InvalidServerPort
 	}
 	if s.FindServer(server.Host, server.Port) != nil {
 		return nil
 	}
-	err = backend("ipvsadm", append([]string{"-a", ServiceTypeFlag[s.Type], s.getHostPort(), "-r"}, strings.Split(server.String(), " ")...)...)
+	err = command(ctx, "ipvsadm", append([]string{"-a", ServiceTypeFlag[s.Type], s.getHostPort(), "-r"}, strings.Split(server.String(), " ")...)...)
 	if err != nil {
 		return err
 	}
 
-	s.Servers = append(s.Servers, server)
+	s.appendServer(server)
 	return nil
 }
 
 func (s *Service) EditServer(server Server) error {
+	return s.EditServerContext(context.Background(), server)
+}
+
+func (s *Service) EditServerContext(ctx context.Context, server Server) error {
 	err := server.Validate()
 	if err != nil {
 		return err
 	}
-	if server.Forwarder != "m" && (s.Port != server.Port) {
+	if server.Forwarder != "m" && s.Type != "fwmark" && s.Port != server.Port {
 		return InvalidServerPort
 	}
 
-	err = backend("ipvsadm", append([]string{"-e", ServiceTypeFlag[s.Type], s.getHostPort(), "-r"}, strings.Split(server.String(), " ")...)...)
+	err = command(ctx, "ipvsadm", append([]string{"-e", ServiceTypeFlag[s.Type], s.getHostPort(), "-r"}, strings.Split(server.String(), " ")...)...)
 	if err != nil {
 		return err
 	}
 
-	for i := range s.Servers {
-		if s.Servers[i].Host == server.Host && s.Servers[i].Port == server.Port {
-			s.Servers = append(s.Servers[:i], append([]Server{server}, s.Servers[i+1:]...)...)
-			break
-		}
+	if i := s.findServer(server.Host, server.Port); i != -1 {
+		s.Servers[i] = server
 	}
 	return nil
 }
 
 func (s *Service) RemoveServer(host string, port int) error {
-	err := backend("ipvsadm", "-d", ServiceTypeFlag[s.Type], s.getHostPort(), "-r", fmt.Sprintf("%s:%d", host, port))
+	return s.RemoveServerContext(context.Background(), host, port)
+}
+
+func (s *Service) RemoveServerContext(ctx context.Context, host string, port int) error {
+	err := command(ctx, "ipvsadm", "-d", ServiceTypeFlag[s.Type], s.getHostPort(), "-r", Server{Host: host, Port: port}.getHostPort())
 	if err != nil {
 		return err
 	}
 
-	for i := range s.Servers {
-		if s.Servers[i].Host == host && s.Servers[i].Port == port {
-			s.Servers = append(s.Servers[:i], s.Servers[i+1:]...)
-			break
-		}
+	if i := s.findServer(host, port); i != -1 {
+		s.removeServer(i)
 	}
 	return nil
 }
@@ -145,7 +219,10 @@ func (s *Service) FromJson(bytes []byte) error {
 	return json.Unmarshal(bytes, s)
 }
 
+// ToJson encodes s normalized.
 func (s Service) ToJson() ([]byte, error) {
+	s = s.Clone()
+	s.Normalize()
 	return json.Marshal(s)
 }
 
@@ -165,67 +242,74 @@ func (s Service) getPersistence() []string {
 	}
 }
 
+// getHost returns the address the service is keyed on, which is the mark
+// for fwmark services and the virtual ip for everything else.
+func (s Service) getHost() string {
+	if s.Type == "fwmark" && s.FwMark != 0 {
+		return strconv.Itoa(s.FwMark)
+	}
+	return s.Host
+}
+
+func (s Service) getSchedulerFlags() []string {
+	if len(s.SchedulerFlags) != 0 {
+		return []string{"-b", strings.Join(s.SchedulerFlags, ",")}
+	}
+	return []string{}
+}
+
+func (s Service) getPersistenceEngine() []string {
+	if s.PersistenceEngine != "" {
+		return []string{"--pe", s.PersistenceEngine}
+	}
+	return []string{}
+}
+
+// getOptions returns the scheduling and persistence options for -A and -E.
+func (s Service) getOptions() []string {
+	options := []string{"-s", ServiceSchedulerFlag[s.Scheduler]}
+	options = append(options, s.getSchedulerFlags()...)
+	options = append(options, s.getPersistence()...)
+	options = append(options, s.getNetmask()...)
+	return append(options, s.getPersistenceEngine()...)
+}
+
 func (s Service) getHostPort() string {
-	if s.Port == 0 {
-		return s.Host
+	if s.Port == 0 || s.Type == "fwmark" {
+		return s.getHost()
 	}
-	return fmt.Sprintf("%s:%d", s.Host, s.Port)
+	return joinHostPort(s.Host, s.Port)
 }
 
+// String returns the service and its servers as `ipvsadm -R` lines.
 func (s Service) String() string {
-	a := make([]string, 0, 0)
-	a = append(a, fmt.Sprintf("-A %s %s -s %s %s %s\n",
-		ServiceTypeFlag[s.Type], s.getHostPort(),
-		ServiceSchedulerFlag[s.Scheduler], strings.Join(s.getPersistence(), " "), strings.Join(s.getNetmask(), " ")))
+	a := []string{serviceLine("-A", s) + "\n"}
 	for i := range s.Servers {
-		a = append(a, fmt.Sprintf("-a %s %s:%d -r %s\n",
-			ServiceTypeFlag[s.Type], s.Host, s.Port,
-			s.Servers[i].String()))
+		a = append(a, serverLine("-a", s, s.Servers[i].String())+"\n")
 	}
 	return strings.Join(a, "")
 }
 
 func (s Service) Add() error {
-	return backend("ipvsadm", append([]string{"-A", ServiceTypeFlag[s.Type], s.getHostPort(), "-s", ServiceSchedulerFlag[s.Scheduler]}, append(s.getPersistence(), s.getNetmask()...)...)...)
+	return s.AddContext(context.Background())
+}
+
+func (s Service) AddContext(ctx context.Context) error {
+	return command(ctx, "ipvsadm", append([]string{"-A", ServiceTypeFlag[s.Type], s.getHostPort()}, s.getOptions()...)...)
 }
 
 func (s Service) Remove() error {
-	return backend("ipvsadm", "-D", ServiceTypeFlag[s.Type], s.getHostPort())
+	return s.RemoveContext(context.Background())
+}
+
+func (s Service) RemoveContext(ctx context.Context) error {
+	return command(ctx, "ipvsadm", "-D", ServiceTypeFlag[s.Type], s.getHostPort())
 }
 
 func (s Service) Zero() error {
-	return backend("ipvsadm", "-Z", ServiceTypeFlag[s.Type], s.getHostPort())
-}
-
-func parseService(serviceString string) Service {
-	service := Service{
-		Scheduler:   "wlc",
-		Type:        "tcp",
-		Persistence: 300,
-	}
-	var err error
-	exploded := strings.Split(serviceString, " ")
-	for i := range exploded {
-		switch exploded[i] {
-		case "-t", "--tcp-service":
-			service.Type = "tcp"
-			service.Host, service.Port = parseHostPort(exploded[i+1])
-		case "-u", "--udp-service":
-			service.Type = "udp"
-			service.Host, service.Port = parseHostPort(exploded[i+1])
-		case "-f", "--fwmark-service":
-			service.Type = "fwmark"
-			service.Host, service.Port = parseHostPort(exploded[i+1])
-		case "-s", "--scheduler":
-			service.Scheduler = exploded[i+1]
-		case "-p", "--persistent":
-			service.Persistence, err = strconv.Atoi(exploded[i+1])
-			if err != nil {
-				service.Persistence = 300
-			}
-		case "-M", "--netmask":
-			service.Netmask = exploded[i+1]
-		}
-	}
-	return service
+	return s.ZeroContext(context.Background())
+}
+
+func (s Service) ZeroContext(ctx context.Context) error {
+	return command(ctx, "ipvsadm", "-Z", ServiceTypeFlag[s.Type], s.getHostPort())
 }
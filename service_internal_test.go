@@ -5,3 +5,88 @@
 // at http://mozilla.org/MPL/2.0/.
 //
 package lvs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestServiceServers(test *testing.T) {
+	simulator := useSimulator()
+	defer useFakes()
+
+	ipvs := &Ipvs{}
+	if err := ipvs.AddService(Service{Host: "10.0.0.1", Port: 80, Scheduler: "wrr"}); err != nil {
+		test.Fatal(err)
+	}
+	service := ipvs.FindService("", "10.0.0.1", 80)
+
+	if err := service.AddServer(Server{Host: "10.0.1.1", Port: 80, Weight: 3}); err != nil {
+		test.Fatal(err)
+	}
+	if err := service.AddServer(Server{Host: "10.0.1.1", Port: 8080}); err != InvalidServerPort {
+		test.Errorf("expected InvalidServerPort, got %v", err)
+	}
+	if err := service.EditServer(Server{Host: "10.0.1.1", Port: 80, Weight: 0}); err != nil {
+		test.Fatal(err)
+	}
+	servers := simulator.Ipvs().Services[0].Servers
+	if len(servers) != 1 || servers[0].Weight != 0 || service.Servers[0].Weight != 0 {
+		test.Errorf("server was not quiesced: %+v", servers)
+	}
+
+	if err := service.EditServer(Server{Host: "10.0.1.9", Port: 80}); !errors.Is(err, NotFound) {
+		test.Errorf("expected NotFound, got %v", err)
+	}
+	if err := service.RemoveServer("10.0.1.1", 80); err != nil {
+		test.Fatal(err)
+	}
+	if len(service.Servers) != 0 || len(simulator.Ipvs().Services[0].Servers) != 0 {
+		test.Error("server was not removed")
+	}
+	if err := service.RemoveServer("10.0.1.1", 80); !errors.Is(err, NotFound) {
+		test.Errorf("expected NotFound, got %v", err)
+	}
+}
+
+func TestServiceFwmarkServerPort(test *testing.T) {
+	simulator := useSimulator()
+	defer useFakes()
+
+	// a firewall mark matches any port, so direct routed servers keep theirs
+	server := Server{Host: "10.0.1.1", Port: 443, Forwarder: "g", Weight: 1}
+	service := Service{Type: "fwmark", Host: "7", Scheduler: "wrr", Servers: []Server{server}}
+	if err := service.Validate(); err != nil {
+		test.Fatal(err)
+	}
+	ipvs := &Ipvs{}
+	if err := ipvs.AddService(Service{Type: "fwmark", Host: "7", Scheduler: "wrr"}); err != nil {
+		test.Fatal(err)
+	}
+	found := ipvs.FindService("fwmark", "7", 0)
+	if err := found.AddServer(server); err != nil {
+		test.Fatal(err)
+	}
+	server.Weight = 5
+	if err := found.EditServer(server); err != nil {
+		test.Fatal(err)
+	}
+	servers := simulator.Ipvs().Services[0].Servers
+	if len(servers) != 1 || servers[0].Port != 443 || servers[0].Weight != 5 {
+		test.Errorf("unexpected servers %+v", servers)
+	}
+}
+
+func TestServiceString(test *testing.T) {
+	service := Service{Host: "10.0.0.1", Port: 80, Type: "udp", Scheduler: "rr", Persistence: 60, Servers: []Server{{Host: "10.0.1.1", Port: 80, Weight: 1}}}
+	expected := "-A -u 10.0.0.1:80 -s rr -p 60\n-a -u 10.0.0.1:80 -r 10.0.1.1:80 -g -y 0 -x 0 -w 1\n"
+	if service.String() != expected {
+		test.Errorf("expected %q got %q", expected, service.String())
+	}
+	if (Service{Type: "sctp"}).Validate() != InvalidServiceType {
+		test.Error("unknown service types should not validate")
+	}
+	if (Service{Scheduler: "random"}).Validate() != InvalidServiceScheduler {
+		test.Error("unknown schedulers should not validate")
+	}
+}
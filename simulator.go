@@ -0,0 +1,325 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// Simulator is a Backend that keeps an ipvs table in memory and answers
+	// ipvsadm commands the way ipvsadm and the kernel would, so tests can run
+	// without root or ipvsadm.
+	Simulator struct {
+		// Version is what `ipvsadm -v` prints.
+		Version string
+
+		mutex    sync.Mutex
+		table    Ipvs
+		counters map[string]*SimulatorCounters
+		daemons  map[string]bool
+	}
+
+	// SimulatorCounters are the statistics ipvs keeps for a service, which
+	// the simulator only changes through Count and `ipvsadm -Z`.
+	SimulatorCounters struct {
+		Connections uint64
+		Packets     uint64
+		Bytes       uint64
+	}
+)
+
+var (
+	SimulatorUnsupported = errors.New("command not supported by the simulator")
+)
+
+func NewSimulator() *Simulator {
+	return &Simulator{
+		Version:  "ipvsadm v1.31 2019/12/24 (compiled with popt and IPVS v1.2.1)",
+		counters: make(map[string]*SimulatorCounters),
+		daemons:  make(map[string]bool),
+	}
+}
+
+// Ipvs returns a copy of the simulated table.
+func (s *Simulator) Ipvs() Ipvs {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	table := s.table
+	table.Services = make([]Service, 0, len(s.table.Services))
+	for i := range s.table.Services {
+		service := s.table.Services[i]
+		service.Servers = append([]Server{}, service.Servers...)
+		table.Services = append(table.Services, service)
+	}
+	return table
+}
+
+// Count adds traffic to a service's counters.
+func (s *Simulator) Count(netType, host string, port int, counters SimulatorCounters) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	service := s.table.FindService(netType, host, port)
+	if service == nil {
+		return NotFound
+	}
+	c := s.counter(*service)
+	c.Connections += counters.Connections
+	c.Packets += counters.Packets
+	c.Bytes += counters.Bytes
+	return nil
+}
+
+// Counters returns a service's counters.
+func (s *Simulator) Counters(netType, host string, port int) (SimulatorCounters, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	service := s.table.FindService(netType, host, port)
+	if service == nil {
+		return SimulatorCounters{}, NotFound
+	}
+	return *s.counter(*service), nil
+}
+
+// Daemon reports whether the master or backup sync daemon is running.
+func (s *Simulator) Daemon(state string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.daemons[state]
+}
+
+func (s *Simulator) Execute(ctx context.Context, exe string, args ...string) error {
+	_, err := s.Run(ctx, append([]string{exe}, args...))
+	return err
+}
+
+func (s *Simulator) ExecuteOutput(ctx context.Context, exe string, args ...string) ([]byte, error) {
+	return s.Run(ctx, append([]string{exe}, args...))
+}
+
+func (s *Simulator) ExecuteStdin(ctx context.Context, in, exe string, args ...string) error {
+	_, err := s.ExecuteStdinOutput(ctx, in, exe, args...)
+	return err
+}
+
+func (s *Simulator) ExecuteStdinOutput(ctx context.Context, in, exe string, args ...string) ([]byte, error) {
+	command := append([]string{exe}, args...)
+	if exe != "ipvsadm" || len(args) != 1 || (args[0] != "-R" && args[0] != "--restore") {
+		return s.ExecuteOutput(ctx, exe, args...)
+	}
+
+	// like ipvsadm, lines the kernel rejects are reported and the restore
+	// carries on, exiting with the status of the last line, while a line
+	// that can't be read stops it
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var output strings.Builder
+	var last error
+	for _, line := range strings.Split(in, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] == "ipvsadm" {
+			fields = fields[1:]
+		}
+		if _, err := parseIpvsadmArgs(fields); err != nil {
+			output.WriteString(err.Error() + "\n")
+			return nil, simulatorError(command, 2, strings.TrimSuffix(output.String(), "\n"))
+		}
+		_, last = s.apply(command, fields)
+		var ipvsErr *IpvsError
+		if errors.As(last, &ipvsErr) {
+			output.WriteString(ipvsErr.Output)
+		}
+	}
+	var ipvsErr *IpvsError
+	if errors.As(last, &ipvsErr) {
+		return nil, simulatorError(command, ipvsErr.ExitCode, strings.TrimSuffix(output.String(), "\n"))
+	}
+	if last != nil {
+		return nil, last
+	}
+	return []byte(output.String()), nil
+}
+
+func (s *Simulator) Run(ctx context.Context, args []string) ([]byte, error) {
+	if len(args) == 0 {
+		return nil, SimulatorUnsupported
+	}
+	switch {
+	case len(args) == 2 && args[0] == "which" && args[1] == "ipvsadm":
+		return []byte("/sbin/ipvsadm\n"), nil
+	case args[0] != "ipvsadm":
+		return nil, simulatorError(args, 127, fmt.Sprintf("%s: %s", args[0], SimulatorUnsupported))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.apply(args, args[1:])
+}
+
+// apply runs one ipvsadm command line against the table, command is what is
+// reported in errors.
+func (s *Simulator) apply(command, args []string) ([]byte, error) {
+	c, err := parseIpvsadmArgs(args)
+	if err != nil {
+		return nil, simulatorError(command, 2, err.Error())
+	}
+	if c.op == "-v" {
+		return []byte(s.Version + "\n"), nil
+	}
+	if (c.op == "-A" || c.op == "-E" || c.op == "-D" || c.op == "-a" || c.op == "-e" || c.op == "-d") && !c.hasTarget {
+		return nil, simulatorError(command, 2, "You need to supply the 'service-address' option for this command")
+	}
+	if (c.op == "-a" || c.op == "-e" || c.op == "-d") && !c.hasServer {
+		return nil, simulatorError(command, 2, "You need to supply the 'real-server' option for this command")
+	}
+
+	key := c.service.Type + " " + c.service.getHostPort()
+	var service *Service
+	index := -1
+	for i := range s.table.Services {
+		if s.table.Services[i].Type+" "+s.table.Services[i].getHostPort() == key {
+			service, index = &s.table.Services[i], i
+			break
+		}
+	}
+
+	switch c.op {
+	case "-A":
+		if service != nil {
+			return nil, simulatorError(command, 2, "Service already exists")
+		}
+		if _, ok := ServiceSchedulerFlag[c.service.Scheduler]; !ok {
+			return nil, simulatorError(command, 2, "Scheduler not found: ip_vs_"+c.service.Scheduler+".ko")
+		}
+		s.table.Services = append(s.table.Services, c.service)
+	case "-E":
+		if service == nil {
+			return nil, simulatorError(command, 2, "No such service")
+		}
+		if _, ok := ServiceSchedulerFlag[c.service.Scheduler]; !ok {
+			return nil, simulatorError(command, 2, "Scheduler not found: ip_vs_"+c.service.Scheduler+".ko")
+		}
+		c.service.Servers = service.Servers
+		*service = c.service
+	case "-D":
+		if service == nil {
+			return nil, simulatorError(command, 2, "No such service")
+		}
+		delete(s.counters, key)
+		s.table.Services = append(s.table.Services[:index], s.table.Services[index+1:]...)
+	case "-a", "-e", "-d":
+		if service == nil {
+			return nil, simulatorError(command, 2, "Service not defined")
+		}
+		return nil, s.applyServer(command, c, service)
+	case "-C":
+		s.table.Services = nil
+		s.counters = make(map[string]*SimulatorCounters)
+	case "-Z":
+		if !c.hasTarget {
+			s.counters = make(map[string]*SimulatorCounters)
+			break
+		}
+		if service == nil {
+			return nil, simulatorError(command, 2, "No such service")
+		}
+		delete(s.counters, key)
+	case "-S":
+		return []byte(s.save()), nil
+	case "--set":
+		if len(c.args) != 3 {
+			return nil, simulatorError(command, 2, "--set requires tcp, tcpfin and udp timeouts")
+		}
+		timeouts := make([]int, 3)
+		for i := range c.args {
+			timeouts[i], err = strconv.Atoi(c.args[i])
+			if err != nil {
+				return nil, simulatorError(command, 2, "invalid timeout "+c.args[i])
+			}
+		}
+		s.table.Tcp, s.table.Tcpfin, s.table.Udp = timeouts[0], timeouts[1], timeouts[2]
+	case "--start-daemon":
+		if len(c.args) != 1 || (c.args[0] != "master" && c.args[0] != "backup") {
+			return nil, simulatorError(command, 2, "illegal start-daemon parameter specified")
+		}
+		if s.daemons[c.args[0]] {
+			return nil, simulatorError(command, 2, "Daemon has already run")
+		}
+		s.daemons[c.args[0]] = true
+		s.table.MulticastInterface = c.options["--mcast-interface"]
+		s.table.Syncid, _ = strconv.Atoi(c.options["--syncid"])
+	case "--stop-daemon":
+		if len(c.args) != 1 || !s.daemons[c.args[0]] {
+			return nil, simulatorError(command, 2, "No daemon is running")
+		}
+		delete(s.daemons, c.args[0])
+	default:
+		return nil, simulatorError(command, 2, fmt.Sprintf("%s: %s", c.op, SimulatorUnsupported))
+	}
+	return []byte{}, nil
+}
+
+func (s *Simulator) applyServer(command []string, c ipvsadmCommand, service *Service) error {
+	index := -1
+	for i := range service.Servers {
+		if service.Servers[i].Host == c.server.Host && service.Servers[i].Port == c.server.Port {
+			index = i
+			break
+		}
+	}
+	switch c.op {
+	case "-a":
+		if index != -1 {
+			return simulatorError(command, 2, "Destination already exists")
+		}
+		service.Servers = append(service.Servers, c.server)
+	case "-e":
+		if index == -1 {
+			return simulatorError(command, 2, "No such destination")
+		}
+		service.Servers[index] = c.server
+	case "-d":
+		if index == -1 {
+			return simulatorError(command, 2, "No such destination")
+		}
+		service.Servers = append(service.Servers[:index], service.Servers[index+1:]...)
+	}
+	return nil
+}
+
+func (s *Simulator) counter(service Service) *SimulatorCounters {
+	key := service.Type + " " + service.getHostPort()
+	if s.counters[key] == nil {
+		s.counters[key] = &SimulatorCounters{}
+	}
+	return s.counters[key]
+}
+
+// save renders the table the way `ipvsadm -S -n` does.
+func (s *Simulator) save() string {
+	b := &strings.Builder{}
+	s.table.WriteSave(b)
+	return b.String()
+}
+
+func simulatorError(command []string, code int, message string) error {
+	return &IpvsError{
+		Command:  command,
+		ExitCode: code,
+		Output:   message + "\n",
+		Kind:     classify(command, message),
+		Err:      fmt.Errorf("exit status %d", code),
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func simulate(test *testing.T, simulator *Simulator, line string) error {
+	test.Helper()
+	return simulator.Execute(context.Background(), "ipvsadm", strings.Fields(line)...)
+}
+
+func TestSimulatorSemantics(test *testing.T) {
+	simulator := NewSimulator()
+	cases := []struct {
+		line string
+		kind error
+	}{
+		{"-A -t 10.0.0.1:80 -s rr", nil},
+		{"-A -t 10.0.0.1:80 -s wrr", Conflict},
+		{"-a -t 10.0.0.1:80 -r 10.0.0.2 -g -w 2", nil},
+		{"-a -t 10.0.0.1:80 -r 10.0.0.2:80", Conflict},
+		{"-a -t 10.0.0.1:81 -r 10.0.0.2:80", NotFound},
+		{"-e -t 10.0.0.1:80 -r 10.0.0.3:80", NotFound},
+		{"-d -t 10.0.0.1:80 -r 10.0.0.3:80", NotFound},
+		{"-E -t 10.0.0.9:80 -s rr", NotFound},
+		{"-D -t 10.0.0.9:80", NotFound},
+		{"--add-service --udp-service=[fd00::1]:53 --scheduler=sh --sched-flags=sh-port -p", nil},
+	}
+	for _, c := range cases {
+		err := simulate(test, simulator, c.line)
+		if c.kind == nil && err != nil {
+			test.Errorf("%s: unexpected error %v", c.line, err)
+		}
+		if c.kind != nil && !errors.Is(err, c.kind) {
+			test.Errorf("%s: expected %v, got %v", c.line, c.kind, err)
+		}
+	}
+
+	if simulate(test, simulator, "-A -t 10.0.0.1:443 -s bogus") == nil {
+		test.Error("unknown schedulers should be rejected")
+	}
+
+	// direct routing keeps the service's port
+	table := simulator.Ipvs()
+	if len(table.Services) != 2 || table.Services[0].Servers[0].Port != 80 || table.Services[0].Servers[0].Weight != 2 {
+		test.Fatalf("unexpected table %+v", table)
+	}
+	if table.Services[1].Host != "fd00::1" || table.Services[1].Persistence != 300 {
+		test.Errorf("unexpected ipv6 service %+v", table.Services[1])
+	}
+
+	// editing resets whatever is not given to ipvsadm's defaults
+	if err := simulate(test, simulator, "-e -t 10.0.0.1:80 -r 10.0.0.2:80 -m"); err != nil {
+		test.Fatal(err)
+	}
+	if err := simulate(test, simulator, "-E -t 10.0.0.1:80"); err != nil {
+		test.Fatal(err)
+	}
+	table = simulator.Ipvs()
+	if table.Services[0].Scheduler != "wlc" || table.Services[0].Servers[0].Weight != 1 || table.Services[0].Servers[0].Forwarder != "m" {
+		test.Errorf("unexpected edited service %+v", table.Services[0])
+	}
+
+	out, err := simulator.Run(context.Background(), []string{"ipvsadm", "-S", "-n"})
+	if err != nil {
+		test.Fatal(err)
+	}
+	expected := `-A -t 10.0.0.1:80 -s wlc
+-a -t 10.0.0.1:80 -r 10.0.0.2:80 -m -w 1
+-A -u [fd00::1]:53 -s sh -b sh-port -p 300
+`
+	if string(out) != expected {
+		test.Errorf("unexpected save output:\n%s", out)
+	}
+}
+
+func TestSimulatorRestore(test *testing.T) {
+	simulator := NewSimulator()
+	err := simulator.ExecuteStdin(context.Background(), `-A -t 10.0.0.1:80 -s rr
+-a -t 10.0.0.1:80 -r 10.0.0.2:80 -g -w 1 -x 100 -y 10
+
+-A -f 7 -s wlc -p 60
+-a -f 7 -r 10.0.0.3:0 -i -w 1 --tun-type gue --tun-port 6080
+`, "ipvsadm", "-R")
+	if err != nil {
+		test.Fatal(err)
+	}
+	table := simulator.Ipvs()
+	if len(table.Services) != 2 || table.Services[1].FwMark != 7 || table.Services[1].Servers[0].TunnelPort != 6080 {
+		test.Fatalf("unexpected table %+v", table)
+	}
+
+	// rejected lines are skipped and the last line sets the status
+	err = simulator.ExecuteStdin(context.Background(), "-A -t 10.0.0.1:80\n-A -t 10.0.0.4:80\n", "ipvsadm", "-R")
+	if err != nil || len(simulator.Ipvs().Services) != 3 {
+		test.Errorf("expected the restore to carry on, got %v", err)
+	}
+	err = simulator.ExecuteStdin(context.Background(), "-A -t 10.0.0.1:80\n-A -t 10.0.0.5:80\n-A -t 10.0.0.4:80\n", "ipvsadm", "-R")
+	var ipvsErr *IpvsError
+	if !errors.As(err, &ipvsErr) || !errors.Is(err, Conflict) || ipvsErr.Output != "Service already exists\nService already exists\n" || len(simulator.Ipvs().Services) != 4 {
+		test.Errorf("expected a conflict, got %v", err)
+	}
+
+	// a line that can't be read stops the restore
+	err = simulator.ExecuteStdin(context.Background(), "-A -t 10.0.0.6:80 -s\n-A -t 10.0.0.7:80\n", "ipvsadm", "-R")
+	if err == nil || len(simulator.Ipvs().Services) != 4 {
+		test.Errorf("expected the restore to stop, got %v", err)
+	}
+}
+
+func TestSimulatorCounters(test *testing.T) {
+	simulator := NewSimulator()
+	simulate(test, simulator, "-A -t 10.0.0.1:80")
+	simulate(test, simulator, "-A -t 10.0.0.1:443")
+	simulator.Count("tcp", "10.0.0.1", 80, SimulatorCounters{Connections: 1, Packets: 10, Bytes: 1000})
+	simulator.Count("tcp", "10.0.0.1", 443, SimulatorCounters{Connections: 2})
+
+	simulate(test, simulator, "-Z -t 10.0.0.1:80")
+	counters, _ := simulator.Counters("tcp", "10.0.0.1", 80)
+	if counters != (SimulatorCounters{}) {
+		test.Errorf("counters were not zeroed: %+v", counters)
+	}
+	counters, _ = simulator.Counters("tcp", "10.0.0.1", 443)
+	if counters.Connections != 2 {
+		test.Errorf("other counters should be untouched: %+v", counters)
+	}
+	simulate(test, simulator, "-Z")
+	counters, _ = simulator.Counters("tcp", "10.0.0.1", 443)
+	if counters != (SimulatorCounters{}) {
+		test.Errorf("counters were not zeroed: %+v", counters)
+	}
+	if _, err := simulator.Counters("tcp", "10.0.0.9", 80); err != NotFound {
+		test.Errorf("expected NotFound, got %v", err)
+	}
+}
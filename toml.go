@@ -0,0 +1,391 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The toml read here is what a config file needs: tables, arrays of tables,
+// key = value pairs with strings, integers, booleans and arrays, and
+// comments. Dotted keys, inline tables, multi line strings and dates are
+// rejected.
+
+type tomlParser struct {
+	root    *node
+	current *node
+	// tables defined by a [table] header, which can't be defined twice
+	defined map[*node]bool
+}
+
+var (
+	tomlBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+func (i Ipvs) ToToml() ([]byte, error) {
+	return renderToml(encodeIpvs(i)), nil
+}
+
+func (i *Ipvs) FromToml(bytes []byte) error {
+	n, err := parseToml(bytes)
+	if err != nil {
+		return err
+	}
+	return decodeIpvs(n, i)
+}
+
+func (s Service) ToToml() ([]byte, error) {
+	return renderToml(encodeService(s)), nil
+}
+
+func (s *Service) FromToml(bytes []byte) error {
+	n, err := parseToml(bytes)
+	if err != nil {
+		return err
+	}
+	return decodeValue(n, s)
+}
+
+func (s Server) ToToml() ([]byte, error) {
+	return renderToml(encodeServer(s)), nil
+}
+
+func (s *Server) FromToml(bytes []byte) error {
+	n, err := parseToml(bytes)
+	if err != nil {
+		return err
+	}
+	return decodeValue(n, s)
+}
+
+func renderToml(n *node) []byte {
+	var b strings.Builder
+	writeTomlTable(&b, n, "")
+	return []byte(b.String())
+}
+
+// writeTomlTable writes the values of n, then its tables under path.
+func writeTomlTable(b *strings.Builder, n *node, path string) {
+	for _, f := range n.fields {
+		if !isTomlTable(f.value) {
+			b.WriteString(tomlKey(f.key) + " = " + tomlValue(f.value) + "\n")
+		}
+	}
+	for _, f := range n.fields {
+		if !isTomlTable(f.value) {
+			continue
+		}
+		name := tomlKey(f.key)
+		if path != "" {
+			name = path + "." + name
+		}
+		if f.value.kind == mappingNode {
+			b.WriteString("\n[" + name + "]\n")
+			writeTomlTable(b, f.value, name)
+			continue
+		}
+		for _, item := range f.value.items {
+			b.WriteString("\n[[" + name + "]]\n")
+			writeTomlTable(b, item, name)
+		}
+	}
+}
+
+// isTomlTable reports whether n is written as a table or an array of tables
+// rather than a value.
+func isTomlTable(n *node) bool {
+	return n.kind == mappingNode || (n.kind == sequenceNode && len(n.items) != 0 && n.items[0].kind == mappingNode)
+}
+
+func tomlValue(n *node) string {
+	if n.kind == sequenceNode {
+		a := make([]string, 0, len(n.items))
+		for _, item := range n.items {
+			a = append(a, tomlValue(item))
+		}
+		return "[" + strings.Join(a, ", ") + "]"
+	}
+	if n.string {
+		return tomlQuote(n.text)
+	}
+	return n.text
+}
+
+func tomlKey(key string) string {
+	if tomlBareKey.MatchString(key) {
+		return key
+	}
+	return tomlQuote(key)
+}
+
+// tomlQuote writes s as a basic string, which only has the escapes below.
+func tomlQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func parseToml(bytes []byte) (*node, error) {
+	root := &node{kind: mappingNode, line: 1}
+	p := &tomlParser{root: root, current: root, defined: map[*node]bool{}}
+	lines := strings.Split(string(bytes), "\n")
+	for j := 0; j < len(lines); j++ {
+		number := j + 1
+		text := strings.TrimSpace(stripComment(strings.TrimRight(lines[j], "\r")))
+		switch {
+		case text == "":
+			continue
+		case strings.HasPrefix(text, "[[") && strings.HasSuffix(text, "]]"):
+			if err := p.arrayTable(text[2:len(text)-2], number); err != nil {
+				return nil, err
+			}
+			continue
+		case strings.HasPrefix(text, "["):
+			if !strings.HasSuffix(text, "]") {
+				return nil, configError(number, "unterminated table %q", text)
+			}
+			if err := p.table(text[1:len(text)-1], number); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		name, value, ok := splitTomlKey(text)
+		if !ok {
+			return nil, configError(number, "expected key = value, got %q", text)
+		}
+		key, err := tomlKeyName(name, number)
+		if err != nil {
+			return nil, err
+		}
+		// arrays can continue over several lines
+		for strings.HasPrefix(value, "[") && tomlDepth(value) > 0 && j+1 < len(lines) {
+			j++
+			value += " " + strings.TrimSpace(stripComment(strings.TrimRight(lines[j], "\r")))
+		}
+		if p.current.get(key) != nil {
+			return nil, configError(number, "duplicate key %q", key)
+		}
+		n, err := tomlScalar(value, number)
+		if err != nil {
+			return nil, err
+		}
+		p.current.fields = append(p.current.fields, field{key: key, value: n})
+	}
+	return root, nil
+}
+
+// table starts the [name] table.
+func (p *tomlParser) table(name string, line int) error {
+	keys, err := splitTomlPath(name, line)
+	if err != nil {
+		return err
+	}
+	n, err := p.walk(keys, line)
+	if err != nil {
+		return err
+	}
+	if p.defined[n] {
+		return configError(line, "duplicate table %q", name)
+	}
+	p.defined[n] = true
+	p.current = n
+	return nil
+}
+
+// arrayTable appends a table to the [[name]] array and starts it.
+func (p *tomlParser) arrayTable(name string, line int) error {
+	keys, err := splitTomlPath(name, line)
+	if err != nil {
+		return err
+	}
+	parent, err := p.walk(keys[:len(keys)-1], line)
+	if err != nil {
+		return err
+	}
+	key := keys[len(keys)-1]
+	array := parent.get(key)
+	if array == nil {
+		array = &node{kind: sequenceNode, line: line}
+		parent.fields = append(parent.fields, field{key: key, value: array})
+	} else if array.kind != sequenceNode || (len(array.items) != 0 && array.items[0].kind != mappingNode) || (len(array.items) == 0 && !p.defined[array]) {
+		return configError(line, "%q is not an array of tables", name)
+	}
+	p.defined[array] = true
+	p.current = &node{kind: mappingNode, line: line}
+	array.items = append(array.items, p.current)
+	return nil
+}
+
+// walk finds the table at keys from the root, creating missing tables and
+// stepping into the last table of an array of tables.
+func (p *tomlParser) walk(keys []string, line int) (*node, error) {
+	n := p.root
+	for _, key := range keys {
+		next := n.get(key)
+		switch {
+		case next == nil:
+			next = &node{kind: mappingNode, line: line}
+			n.fields = append(n.fields, field{key: key, value: next})
+		case next.kind == sequenceNode && len(next.items) != 0 && next.items[0].kind == mappingNode:
+			next = next.items[len(next.items)-1]
+		case next.kind != mappingNode:
+			return nil, configError(line, "%q is not a table", key)
+		}
+		n = next
+	}
+	return n, nil
+}
+
+func splitTomlPath(name string, line int) ([]string, error) {
+	keys := []string{}
+	for _, part := range strings.Split(name, ".") {
+		key, err := tomlKeyName(strings.TrimSpace(part), line)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// splitTomlKey splits "key = value" outside of quotes.
+func splitTomlKey(text string) (string, string, bool) {
+	var quote byte
+	for j := 0; j < len(text); j++ {
+		switch {
+		case quote != 0:
+			if text[j] == quote {
+				quote = 0
+			} else if text[j] == '\\' && quote == '"' {
+				j++
+			}
+		case text[j] == '"' || text[j] == '\'':
+			quote = text[j]
+		case text[j] == '=':
+			return strings.TrimSpace(text[:j]), strings.TrimSpace(text[j+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+func tomlKeyName(key string, line int) (string, error) {
+	switch {
+	case tomlBareKey.MatchString(key):
+		return key, nil
+	case strings.HasPrefix(key, `"`) || strings.HasPrefix(key, "'"):
+		n, err := tomlScalar(key, line)
+		if err != nil {
+			return "", err
+		}
+		return n.text, nil
+	case strings.Contains(key, "."):
+		return "", configError(line, "dotted keys are not supported: %q", key)
+	}
+	return "", configError(line, "invalid key %q", key)
+}
+
+func tomlScalar(text string, line int) (*node, error) {
+	switch {
+	case text == "":
+		return nil, configError(line, "missing value")
+	case strings.HasPrefix(text, `"""`) || strings.HasPrefix(text, "'''"):
+		return nil, configError(line, "multi line strings are not supported")
+	case strings.HasPrefix(text, `"`):
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, configError(line, "invalid string %s", text)
+		}
+		return &node{kind: scalarNode, line: line, text: s, string: true}, nil
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") || strings.Contains(text[1:len(text)-1], "'") {
+			return nil, configError(line, "invalid string %s", text)
+		}
+		return &node{kind: scalarNode, line: line, text: text[1 : len(text)-1], string: true}, nil
+	case strings.HasPrefix(text, "["):
+		if tomlDepth(text) != 0 || !strings.HasSuffix(text, "]") {
+			return nil, configError(line, "unterminated array %q", text)
+		}
+		n := &node{kind: sequenceNode, line: line}
+		items := splitFlow(text[1 : len(text)-1])
+		for j, item := range items {
+			item = strings.TrimSpace(item)
+			// a trailing comma is allowed
+			if item == "" && j == len(items)-1 {
+				continue
+			}
+			if strings.HasPrefix(item, "[") {
+				return nil, configError(line, "nested arrays are not supported")
+			}
+			scalar, err := tomlScalar(item, line)
+			if err != nil {
+				return nil, err
+			}
+			n.items = append(n.items, scalar)
+		}
+		return n, nil
+	case strings.HasPrefix(text, "{"):
+		return nil, configError(line, "inline tables are not supported")
+	case text == "true" || text == "false":
+		return &node{kind: scalarNode, line: line, text: text}, nil
+	}
+	if _, err := strconv.ParseInt(strings.ReplaceAll(text, "_", ""), 10, 64); err != nil {
+		return nil, configError(line, "invalid value %q", text)
+	}
+	return &node{kind: scalarNode, line: line, text: text}, nil
+}
+
+// tomlDepth counts the brackets text leaves open, outside of quotes.
+func tomlDepth(text string) int {
+	depth := 0
+	var quote byte
+	for j := 0; j < len(text); j++ {
+		switch {
+		case quote != 0:
+			if text[j] == quote {
+				quote = 0
+			} else if text[j] == '\\' && quote == '"' {
+				j++
+			}
+		case text[j] == '"' || text[j] == '\'':
+			quote = text[j]
+		case text[j] == '[':
+			depth++
+		case text[j] == ']':
+			depth--
+		}
+	}
+	return depth
+}
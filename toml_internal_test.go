@@ -0,0 +1,93 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestIpvsToml(test *testing.T) {
+	ipvs := Ipvs{MulticastInterface: "eth1", Syncid: 4, Tcp: 900, Tcpfin: 120, Udp: 300, Services: testServices}
+	out, err := ipvs.ToToml()
+	if err != nil {
+		test.Fatal(err)
+	}
+	for _, line := range []string{"version = 1\n", "mcast_interface = \"eth1\"\n", "\n[[services]]\n", "\n[[services.servers]]\n"} {
+		if !strings.Contains(string(out), line) {
+			test.Errorf("expected %q in\n%s", line, out)
+		}
+	}
+
+	decoded := Ipvs{}
+	if err := decoded.FromToml(out); err != nil {
+		test.Fatal(err)
+	}
+	if !decoded.Equal(ipvs) || decoded.MulticastInterface != "eth1" || decoded.Udp != 300 {
+		test.Errorf("toml did not round trip: %s\n%s", decoded.Diff(ipvs), out)
+	}
+
+	empty, _ := Ipvs{}.ToToml()
+	if !strings.Contains(string(empty), "services = []\n") {
+		test.Errorf("unexpected empty document\n%s", empty)
+	}
+}
+
+func TestServiceToml(test *testing.T) {
+	service := testServices[0].Clone()
+	service.SchedulerFlags = []string{"flag-1", "flag-2"}
+	service.PersistenceEngine = "sip\t\"x\""
+	out, err := service.ToToml()
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !strings.Contains(string(out), `persistence_engine = "sip\t\"x\""`) {
+		test.Errorf("expected an escaped persistence engine\n%s", out)
+	}
+	decoded := Service{}
+	if err := decoded.FromToml(out); err != nil {
+		test.Fatal(err)
+	}
+	if !decoded.Equal(service) || decoded.PersistenceEngine != service.PersistenceEngine {
+		test.Errorf("service did not round trip\n%s", out)
+	}
+
+	server := Server{}
+	if err := server.FromToml([]byte("host = '10.0.0.1' # literal string\n\"port\" = 8_080\nforwarder = \"i\"\n")); err != nil {
+		test.Fatal(err)
+	}
+	if server.Host != "10.0.0.1" || server.Port != 8080 || server.Forwarder != "i" {
+		test.Errorf("server decoded as %+v", server)
+	}
+}
+
+func TestTomlErrors(test *testing.T) {
+	tests := []struct {
+		toml string
+		line int
+		want string
+	}{
+		{"version = 1\n\n[[services]]\nhost = \"10.0.0.1\"\nprot = 80\n", 5, `unknown field "prot"`},
+		{"syncid = 4\ntcp_timeout = \"soon\"\n", 2, `invalid number "soon"`},
+		{"syncid = 4\nsyncid = 5\n", 2, `duplicate key "syncid"`},
+		{"services.host = \"10.0.0.1\"\n", 1, "dotted keys"},
+		{"syncid = 4\ntcp_timeout = 1.5\n", 2, "invalid value"},
+		{"services = []\n[[services]]\n", 2, "not an array of tables"},
+		{"syncid\n", 1, "expected key = value"},
+		{"[services]\nhost = \"10.0.0.1\"\n", 1, "expected a list"},
+		{"# comment\nversion = 2\n", 2, "Unsupported Json Version"},
+	}
+	for _, tt := range tests {
+		ipvs := Ipvs{}
+		err := ipvs.FromToml([]byte(tt.toml))
+		configErr := &ConfigError{}
+		if !errors.As(err, &configErr) || configErr.Line != tt.line || !strings.Contains(err.Error(), tt.want) {
+			test.Errorf("%q: expected %q on line %d, got %v", tt.toml, tt.want, tt.line, err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+type (
+	// Trace describes a command run on the host. Output, Duration and Err
+	// are only set once the command has finished.
+	Trace struct {
+		Command  []string
+		Stdin    string
+		Output   []byte
+		Duration time.Duration
+		Err      error
+	}
+
+	// TraceHook is called with the trace of every command.
+	TraceHook func(ctx context.Context, trace Trace)
+)
+
+var (
+	// Logger receives a debug record before and after every command, and a
+	// warning for every command that fails. nil disables logging.
+	Logger *slog.Logger
+
+	// BeforeCommand and AfterCommand, when set, are called before and after
+	// every command, including commands sent to a replaced backend.
+	BeforeCommand TraceHook
+	AfterCommand  TraceHook
+)
+
+func (t Trace) String() string {
+	return strings.Join(t.Command, " ")
+}
+
+func beforeCommand(ctx context.Context, trace Trace) {
+	if Logger != nil {
+		Logger.DebugContext(ctx, "running command", traceAttrs(trace)...)
+	}
+	if BeforeCommand != nil {
+		BeforeCommand(ctx, trace)
+	}
+}
+
+func afterCommand(ctx context.Context, trace Trace) {
+	if Logger != nil {
+		attrs := append(traceAttrs(trace), slog.Duration("duration", trace.Duration))
+		if trace.Err != nil {
+			Logger.WarnContext(ctx, "command failed", append(attrs, slog.Any("error", trace.Err))...)
+		} else {
+			Logger.DebugContext(ctx, "command finished", attrs...)
+		}
+	}
+	if AfterCommand != nil {
+		AfterCommand(ctx, trace)
+	}
+}
+
+func traceAttrs(trace Trace) []any {
+	attrs := []any{slog.Any("argv", trace.Command)}
+	if trace.Stdin != "" {
+		attrs = append(attrs, slog.String("stdin", trace.Stdin))
+	}
+	return attrs
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestTraceHooks(test *testing.T) {
+	backend, backendStdin = fakeExecute, fakeExecuteStdin
+	var before, after []Trace
+	BeforeCommand = func(ctx context.Context, trace Trace) { before = append(before, trace) }
+	AfterCommand = func(ctx context.Context, trace Trace) { after = append(after, trace) }
+	defer func() { BeforeCommand, AfterCommand = nil, nil }()
+
+	fakeExecuteErr = errors.New("No such service")
+	defer func() { fakeExecuteErr = nil }()
+	ipvs := &Ipvs{}
+	ipvs.RemoveService("tcp", "10.0.0.1", 80)
+	ipvs.Restore([]Service{{Host: "10.0.0.1", Port: 80}})
+
+	if len(before) != 2 || len(after) != 2 {
+		test.Fatalf("expected 2 traces before and after, got %d and %d", len(before), len(after))
+	}
+	if before[0].String() != "ipvsadm -D -t 10.0.0.1:80" || before[0].Err != nil {
+		test.Errorf("unexpected trace before %+v", before[0])
+	}
+	if after[0].Err != fakeExecuteErr {
+		test.Errorf("trace after should carry the error, got %+v", after[0])
+	}
+	if after[1].String() != "ipvsadm -R" || !strings.HasPrefix(after[1].Stdin, "-A -t 10.0.0.1:80") {
+		test.Errorf("unexpected restore trace %+v", after[1])
+	}
+}
+
+func TestTraceLogger(test *testing.T) {
+	backend = fakeExecute
+	var buf bytes.Buffer
+	Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	defer func() { Logger = nil }()
+
+	Zero()
+	logged := buf.String()
+	if !strings.Contains(logged, `msg="running command" argv="[ipvsadm -Z]"`) || !strings.Contains(logged, `msg="command finished"`) {
+		test.Errorf("unexpected log output:\n%s", logged)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type (
+	// ValidationError is a problem with the value at Path, a JSON path such
+	// as $.services[0].servers[1].weight.
+	ValidationError struct {
+		Path string
+		Err  error
+	}
+
+	// ValidationErrors is every problem ValidateAll found, errors.Is matches
+	// any of them.
+	ValidationErrors []ValidationError
+)
+
+var (
+	InvalidAddress         = errors.New("Invalid Address")
+	InvalidAddressFamily   = errors.New("Invalid Address Family")
+	InvalidPort            = errors.New("Invalid Port")
+	InvalidPersistence     = errors.New("Invalid Persistence")
+	InvalidNetmask         = errors.New("Invalid Netmask")
+	InvalidTimeout         = errors.New("Invalid Timeout")
+	InvalidSyncid          = errors.New("Invalid Syncid")
+	InvalidServerWeight    = errors.New("Invalid Server Weight")
+	InvalidServerThreshold = errors.New("Invalid Server Threshold")
+	DuplicateService       = errors.New("Duplicate Service")
+	DuplicateServer        = errors.New("Duplicate Server")
+)
+
+func (e ValidationError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func (e ValidationErrors) Error() string {
+	a := make([]string, 0, len(e))
+	for i := range e {
+		a = append(a, e[i].Error())
+	}
+	return strings.Join(a, "; ")
+}
+
+func (e ValidationErrors) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for i := range e {
+		errs = append(errs, e[i])
+	}
+	return errs
+}
+
+func (e *ValidationErrors) add(path string, err error) {
+	*e = append(*e, ValidationError{Path: path, Err: err})
+}
+
+// ValidateAll checks everything about i that ipvsadm or the kernel would
+// reject, and services that are defined twice. It returns ValidationErrors
+// or nil.
+func (i Ipvs) ValidateAll() error {
+	errs := ValidationErrors{}
+	if i.Tcp < 0 {
+		errs.add("$.tcp_timeout", InvalidTimeout)
+	}
+	if i.Tcpfin < 0 {
+		errs.add("$.tcp_fin_timeout", InvalidTimeout)
+	}
+	if i.Udp < 0 {
+		errs.add("$.udp_fin_timeout", InvalidTimeout)
+	}
+	if i.Syncid < 0 || i.Syncid > 255 {
+		errs.add("$.syncid", InvalidSyncid)
+	}
+
+	seen := make(map[string]int, len(i.Services))
+	for j := range i.Services {
+		path := fmt.Sprintf("$.services[%d]", j)
+		i.Services[j].validate(&errs, path)
+		key := serviceKey(i.Services[j].Type, i.Services[j].getHost(), i.Services[j].Port)
+		if first, ok := seen[key]; ok {
+			errs.add(path, fmt.Errorf("%w: same as $.services[%d]", DuplicateService, first))
+			continue
+		}
+		seen[key] = j
+	}
+	return errs.orNil()
+}
+
+// ValidateAll checks everything about s that ipvsadm or the kernel would
+// reject, including each of its servers. Unlike Validate, which stops at the
+// first problem, it returns every problem as ValidationErrors, or nil.
+func (s Service) ValidateAll() error {
+	errs := ValidationErrors{}
+	s.validate(&errs, "$")
+	return errs.orNil()
+}
+
+// ValidateAll checks the server on its own, Service.ValidateAll also checks
+// it against its service.
+func (s Server) ValidateAll() error {
+	errs := ValidationErrors{}
+	s.validate(&errs, "$")
+	return errs.orNil()
+}
+
+func (s Service) validate(errs *ValidationErrors, path string) {
+	if _, ok := ServiceTypeFlag[s.Type]; !ok {
+		errs.add(path+".type", InvalidServiceType)
+	}
+	if _, ok := ServiceSchedulerFlag[s.Scheduler]; !ok {
+		errs.add(path+".scheduler", InvalidServiceScheduler)
+	} else if err := HostCapabilities.checkScheduler(ServiceSchedulerFlag[s.Scheduler]); err != nil {
+		errs.add(path+".scheduler", err)
+	}
+	if len(s.SchedulerFlags) != 0 {
+		if err := HostCapabilities.checkFeature(FeatureSchedulerFlags); err != nil {
+			errs.add(path+".scheduler_flags", err)
+		}
+	}
+	if s.PersistenceEngine != "" {
+		if err := HostCapabilities.checkFeature(FeaturePersistenceEngine); err != nil {
+			errs.add(path+".persistence_engine", err)
+		}
+	}
+
+	var family net.IP
+	if s.Type == "fwmark" {
+		if mark, err := strconv.Atoi(s.getHost()); err != nil || mark <= 0 {
+			errs.add(path+".fwmark", InvalidFwMark)
+		}
+		if s.Port != 0 {
+			errs.add(path+".port", fmt.Errorf("%w: fwmark services have no port", InvalidPort))
+		}
+	} else {
+		family = parseIP(s.Host)
+		if family == nil {
+			errs.add(path+".host", InvalidAddress)
+		}
+		// port 0 forwards every port, which ipvsadm only allows for
+		// persistent services
+		if s.Port < 0 || s.Port > 65535 || (s.Port == 0 && s.Persistence <= 0) {
+			errs.add(path+".port", InvalidPort)
+		}
+	}
+
+	if s.Persistence < 0 || s.Persistence > math.MaxInt32 {
+		errs.add(path+".persistence", InvalidPersistence)
+	}
+	if s.Netmask != "" && !validNetmask(s.Netmask, family) {
+		errs.add(path+".netmask", InvalidNetmask)
+	}
+
+	seen := make(map[string]int, len(s.Servers))
+	for j, server := range s.Servers {
+		serverPath := fmt.Sprintf("%s.servers[%d]", path, j)
+		server.validate(errs, serverPath)
+		// follow ipvsadm rules
+		if server.Forwarder != "m" && s.Type != "fwmark" && s.Port != server.Port {
+			errs.add(serverPath+".port", InvalidServerPort)
+		}
+		// only tunnels can cross address families
+		if ip := parseIP(server.Host); ip != nil && family != nil && (ip.To4() == nil) != (family.To4() == nil) && server.Forwarder != "i" {
+			errs.add(serverPath+".host", InvalidAddressFamily)
+		}
+		key := serverKey(server.Host, server.Port)
+		if first, ok := seen[key]; ok {
+			errs.add(serverPath, fmt.Errorf("%w: same as %s.servers[%d]", DuplicateServer, path, first))
+			continue
+		}
+		seen[key] = j
+	}
+}
+
+func (s Server) validate(errs *ValidationErrors, path string) {
+	if parseIP(s.Host) == nil {
+		errs.add(path+".host", InvalidAddress)
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		errs.add(path+".port", InvalidPort)
+	}
+	if _, ok := ServerForwarderFlag[s.Forwarder]; !ok {
+		errs.add(path+".forwarder", InvalidServerForwarder)
+	}
+	if s.Weight < 0 || s.Weight > 65535 {
+		errs.add(path+".weight", InvalidServerWeight)
+	}
+	if s.UpperThreshold < 0 {
+		errs.add(path+".upper_threshold", InvalidServerThreshold)
+	}
+	if s.LowerThreshold < 0 || (s.UpperThreshold > 0 && s.LowerThreshold > s.UpperThreshold) {
+		errs.add(path+".lower_threshold", InvalidServerThreshold)
+	}
+	if s.TunnelType != "" {
+		if s.Forwarder != "i" || !ServerTunnelTypes[s.TunnelType] {
+			errs.add(path+".tunnel_type", InvalidServerTunnel)
+		} else if err := HostCapabilities.checkFeature(FeatureTunnelType); err != nil {
+			errs.add(path+".tunnel_type", err)
+		}
+	}
+	if s.TunnelPort < 0 || s.TunnelPort > 65535 {
+		errs.add(path+".tunnel_port", InvalidPort)
+	}
+}
+
+func (e ValidationErrors) orNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// validNetmask reports whether netmask suits a service of family, a dotted
+// mask for ipv4 and a prefix length for ipv6. A nil family accepts either.
+func validNetmask(netmask string, family net.IP) bool {
+	if family == nil || family.To4() == nil {
+		if bits, err := strconv.Atoi(netmask); err == nil {
+			return bits > 0 && bits <= 128
+		}
+		if family != nil {
+			return false
+		}
+	}
+	ip := parseIP(netmask).To4()
+	if ip == nil {
+		return false
+	}
+	ones, bits := net.IPMask(ip).Size()
+	return bits != 0 && ones > 0
+}
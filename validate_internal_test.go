@@ -0,0 +1,83 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateAll(test *testing.T) {
+	for i := range testServices {
+		if err := testServices[i].ValidateAll(); err != nil {
+			test.Errorf("service %d should be valid: %v", i, err)
+		}
+	}
+
+	ipvs := Ipvs{Tcp: -1, Syncid: 300, Services: []Service{
+		{Type: "tcp", Host: "10.0.0.1", Port: 80, Netmask: "255.0.255.0", Servers: []Server{
+			{Host: "10.0.1.1", Port: 80, Weight: 70000},
+			{Host: "10.0.1.01", Port: 80, UpperThreshold: 10, LowerThreshold: 20},
+			{Host: "2001:db8::1", Port: 8080, Forwarder: "m"},
+			{Host: "2001:db8::2", Port: 80, Forwarder: "i"},
+		}},
+		{Type: "fwmark", FwMark: 3, Port: 80},
+		{Type: "udp", Host: "10.0.0.300", Port: 0, Persistence: -1},
+		{Type: "tcp", Host: "2001:db8::9", Port: 80, Netmask: "255.255.255.0"},
+		{Type: "tcp", Host: "2001:db8::9", Port: 80, Netmask: "64"},
+		{Type: "tcp", Host: "010.0.0.1", Port: 80},
+	}}
+	expected := []struct {
+		path string
+		err  error
+	}{
+		{"$.tcp_timeout", InvalidTimeout},
+		{"$.syncid", InvalidSyncid},
+		{"$.services[0].netmask", InvalidNetmask},
+		{"$.services[0].servers[0].weight", InvalidServerWeight},
+		{"$.services[0].servers[1].lower_threshold", InvalidServerThreshold},
+		{"$.services[0].servers[1]", DuplicateServer},
+		{"$.services[0].servers[2].host", InvalidAddressFamily},
+		{"$.services[1].port", InvalidPort},
+		{"$.services[2].host", InvalidAddress},
+		{"$.services[2].port", InvalidPort},
+		{"$.services[2].persistence", InvalidPersistence},
+		{"$.services[3].netmask", InvalidNetmask},
+		{"$.services[4]", DuplicateService},
+		{"$.services[5]", DuplicateService},
+	}
+
+	err := ipvs.ValidateAll()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		test.Fatalf("expected ValidationErrors, got %v", err)
+	}
+	if len(errs) != len(expected) {
+		test.Errorf("expected %d problems, got %d: %v", len(expected), len(errs), err)
+	}
+	for i := range expected {
+		if i >= len(errs) {
+			break
+		}
+		if errs[i].Path != expected[i].path || !errors.Is(errs[i], expected[i].err) {
+			test.Errorf("problem %d: expected %s %v, got %v", i, expected[i].path, expected[i].err, errs[i])
+		}
+	}
+	if !errors.Is(err, DuplicateService) || errors.Is(err, InvalidServiceType) {
+		test.Error("errors.Is should match exactly the problems found")
+	}
+}
+
+func TestValidateAllServer(test *testing.T) {
+	err := (Server{Host: "bogus", Port: 70000, Forwarder: "g", TunnelType: "gue"}).ValidateAll()
+	if err == nil || err.Error() != "$.host: Invalid Address; $.port: Invalid Port; $.tunnel_type: Invalid Server Tunnel Type" {
+		test.Errorf("unexpected error %v", err)
+	}
+	if err := (Server{Host: "10.0.0.1", Port: 80}).ValidateAll(); err != nil {
+		test.Errorf("expected a valid server, got %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type (
+	Version struct {
+		Major int `json:"major"`
+		Minor int `json:"minor"`
+		Patch int `json:"patch"`
+	}
+
+	Feature string
+
+	// Capabilities describes what the host's ipvsadm and kernel support. A
+	// zero version means it could not be detected, in which case nothing is
+	// ruled out.
+	Capabilities struct {
+		Ipvsadm Version `json:"ipvsadm"`
+		Ipvs    Version `json:"ipvs"`
+		Kernel  Version `json:"kernel"`
+	}
+)
+
+const (
+	FeaturePersistenceEngine Feature = "--pe"
+	FeatureSchedulerFlags    Feature = "--sched-flags"
+	FeatureTunnelType        Feature = "--tun-type"
+)
+
+var (
+	// HostCapabilities is filled in by Load and consulted by Validate.
+	HostCapabilities Capabilities
+
+	// FeatureIpvsadmVersion is the first ipvsadm release with each feature.
+	FeatureIpvsadmVersion = map[Feature]Version{
+		FeaturePersistenceEngine: {1, 26, 0},
+		FeatureSchedulerFlags:    {1, 27, 0},
+		FeatureTunnelType:        {1, 30, 0},
+	}
+
+	// SchedulerKernelVersion is the first kernel release with each scheduler
+	// that is not available everywhere.
+	SchedulerKernelVersion = map[string]Version{
+		"fo":   {3, 18, 0},
+		"ovf":  {4, 3, 0},
+		"mh":   {4, 18, 0},
+		"twos": {6, 2, 0},
+	}
+
+	Unsupported = errors.New("not supported by this host")
+
+	versionPattern = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+)
+
+// ParseVersion finds the first dotted version number in s.
+func ParseVersion(s string) (Version, error) {
+	match := versionPattern.FindStringSubmatch(s)
+	if match == nil {
+		return Version{}, fmt.Errorf("no version found in %q", s)
+	}
+	v := Version{}
+	v.Major, _ = strconv.Atoi(match[1])
+	v.Minor, _ = strconv.Atoi(match[2])
+	if match[3] != "" {
+		v.Patch, _ = strconv.Atoi(match[3])
+	}
+	return v, nil
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+func (v Version) IsZero() bool {
+	return v == Version{}
+}
+
+// Less reports whether v is older than o.
+func (v Version) Less(o Version) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor < o.Minor
+	}
+	return v.Patch < o.Patch
+}
+
+// DetectCapabilities asks the host which ipvsadm, ipvs and kernel versions it
+// runs. Versions that cannot be read are left zero.
+func DetectCapabilities() (Capabilities, error) {
+	return DetectCapabilitiesContext(context.Background())
+}
+
+func DetectCapabilitiesContext(ctx context.Context) (Capabilities, error) {
+	c := Capabilities{}
+	out, err := commandOutput(ctx, []string{"ipvsadm", "-v"})
+	if err != nil {
+		return c, err
+	}
+	// ipvsadm v1.31 2019/12/24 (compiled with popt and IPVS v1.2.1)
+	c.Ipvsadm, err = ParseVersion(string(out))
+	if err != nil {
+		return c, err
+	}
+
+	// IP Virtual Server version 1.2.1 (size=4096), only present once the
+	// ip_vs module is loaded
+	out, err = commandOutput(ctx, []string{"head", "-n", "1", "/proc/net/ip_vs"})
+	if err == nil && strings.HasPrefix(string(out), "IP Virtual Server version") {
+		c.Ipvs, _ = ParseVersion(string(out))
+	}
+
+	out, err = commandOutput(ctx, []string{"uname", "-r"})
+	if err == nil {
+		c.Kernel, _ = ParseVersion(string(out))
+	}
+	return c, nil
+}
+
+// Supports reports whether the host's ipvsadm understands the feature.
+func (c Capabilities) Supports(feature Feature) bool {
+	need, ok := FeatureIpvsadmVersion[feature]
+	if !ok || c.Ipvsadm.IsZero() {
+		return true
+	}
+	return !c.Ipvsadm.Less(need)
+}
+
+// SupportsScheduler reports whether the host's kernel has the scheduler.
+func (c Capabilities) SupportsScheduler(scheduler string) bool {
+	need, ok := SchedulerKernelVersion[scheduler]
+	if !ok || c.Kernel.IsZero() {
+		return true
+	}
+	return !c.Kernel.Less(need)
+}
+
+func (c Capabilities) checkFeature(feature Feature) error {
+	if c.Supports(feature) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s needs ipvsadm %s, have %s", Unsupported, feature, FeatureIpvsadmVersion[feature], c.Ipvsadm)
+}
+
+func (c Capabilities) checkScheduler(scheduler string) error {
+	if c.SupportsScheduler(scheduler) {
+		return nil
+	}
+	return fmt.Errorf("%w: scheduler %s needs kernel %s, have %s", Unsupported, scheduler, SchedulerKernelVersion[scheduler], c.Kernel)
+}
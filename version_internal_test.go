@@ -0,0 +1,83 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDetectCapabilities(test *testing.T) {
+	backend, backendRun = fakeExecute, fakeRun
+	fakeRunOutputs = map[string][]byte{
+		"ipvsadm -v":                []byte("ipvsadm v1.28 2015/02/09 (compiled with popt and IPVS v1.2.1)\n"),
+		"head -n 1 /proc/net/ip_vs": []byte("IP Virtual Server version 1.2.1 (size=4096)\n"),
+		"uname -r":                  []byte("4.9.0-8-amd64\n"),
+	}
+	defer func() { fakeRunOutputs = map[string][]byte{} }()
+
+	c, err := DetectCapabilities()
+	if err != nil {
+		test.Fatal(err)
+	}
+	if c.Ipvsadm != (Version{1, 28, 0}) || c.Ipvs != (Version{1, 2, 1}) || c.Kernel != (Version{4, 9, 0}) {
+		test.Fatalf("unexpected capabilities %+v", c)
+	}
+	if !c.Supports(FeatureSchedulerFlags) || c.Supports(FeatureTunnelType) {
+		test.Errorf("wrong feature support for %s", c.Ipvsadm)
+	}
+	if !c.SupportsScheduler("ovf") || c.SupportsScheduler("mh") {
+		test.Errorf("wrong scheduler support for %s", c.Kernel)
+	}
+}
+
+func TestValidateCapabilities(test *testing.T) {
+	HostCapabilities = Capabilities{Ipvsadm: Version{1, 28, 0}, Kernel: Version{4, 9, 0}}
+	defer func() { HostCapabilities = Capabilities{} }()
+
+	supported := Service{Host: "10.0.0.1", Port: 80, Scheduler: "sh", SchedulerFlags: []string{"sh-port"}}
+	if err := supported.Validate(); err != nil {
+		test.Errorf("unexpected error %v", err)
+	}
+	unsupported := []Service{
+		{Host: "10.0.0.1", Port: 80, Scheduler: "mh"},
+		{Host: "10.0.0.1", Port: 80, Servers: []Server{{Host: "10.0.0.2", Port: 80, Forwarder: "i", TunnelType: "gue", TunnelPort: 6080}}},
+	}
+	for i := range unsupported {
+		if err := unsupported[i].Validate(); !errors.Is(err, Unsupported) {
+			test.Errorf("service %d: expected Unsupported, got %v", i, err)
+		}
+	}
+
+	// nothing is ruled out when the versions are unknown
+	HostCapabilities = Capabilities{}
+	for i := range unsupported {
+		if err := unsupported[i].Validate(); err != nil {
+			test.Errorf("service %d: unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestServiceOptions(test *testing.T) {
+	service := Service{Host: "10.0.0.1", Port: 80, Scheduler: "mh", SchedulerFlags: []string{"mh-fallback", "mh-port"}, PersistenceEngine: "sip"}
+	expected := "-A -t 10.0.0.1:80 -s mh -b mh-fallback,mh-port --pe sip\n"
+	if service.String() != expected {
+		test.Errorf("expected %q got %q", expected, service.String())
+	}
+	var parsed Service
+	err := ParseSave(strings.NewReader(expected+"-a -t 10.0.0.1:80 -r 10.0.0.2:80 -i -w 1 --tun-type gue --tun-port 6080\n"), func(service Service) error {
+		parsed = service
+		return nil
+	})
+	if err != nil || len(parsed.SchedulerFlags) != 2 || parsed.SchedulerFlags[1] != "mh-port" || parsed.PersistenceEngine != "sip" {
+		test.Errorf("unexpected parsed service %+v %v", parsed, err)
+	}
+	if len(parsed.Servers) != 1 || parsed.Servers[0].TunnelType != "gue" || parsed.Servers[0].TunnelPort != 6080 {
+		test.Errorf("unexpected parsed servers %+v", parsed.Servers)
+	}
+}
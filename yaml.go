@@ -0,0 +1,365 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The yaml read here is the block style subset a config file needs:
+// mappings, lists, flow lists of scalars, quoted and plain scalars and
+// comments. Anchors, tags, multi line strings and flow mappings other than
+// {} are rejected.
+
+type (
+	yamlLine struct {
+		number int
+		indent int
+		text   string
+	}
+
+	yamlParser struct {
+		lines []yamlLine
+		next  int
+	}
+)
+
+var (
+	// plain scalars written without quotes
+	yamlPlain = regexp.MustCompile(`^[A-Za-z0-9_./][A-Za-z0-9_./-]*$`)
+	// plain scalars that read back as something other than a string
+	yamlReserved = regexp.MustCompile(`^(?i:null|~|true|false|yes|no|on|off|[-+]?[0-9][0-9_]*(\.[0-9]*)?([eE][-+]?[0-9]+)?|\.inf|\.nan)$`)
+)
+
+func (i Ipvs) ToYaml() ([]byte, error) {
+	return renderYaml(encodeIpvs(i)), nil
+}
+
+func (i *Ipvs) FromYaml(bytes []byte) error {
+	n, err := parseYaml(bytes)
+	if err != nil {
+		return err
+	}
+	return decodeIpvs(n, i)
+}
+
+func (s Service) ToYaml() ([]byte, error) {
+	return renderYaml(encodeService(s)), nil
+}
+
+func (s *Service) FromYaml(bytes []byte) error {
+	n, err := parseYaml(bytes)
+	if err != nil {
+		return err
+	}
+	return decodeValue(n, s)
+}
+
+func (s Server) ToYaml() ([]byte, error) {
+	return renderYaml(encodeServer(s)), nil
+}
+
+func (s *Server) FromYaml(bytes []byte) error {
+	n, err := parseYaml(bytes)
+	if err != nil {
+		return err
+	}
+	return decodeValue(n, s)
+}
+
+func renderYaml(n *node) []byte {
+	var b strings.Builder
+	writeYamlMapping(&b, n, 0)
+	return []byte(b.String())
+}
+
+func writeYamlMapping(b *strings.Builder, n *node, indent int) {
+	for j, f := range n.fields {
+		// the first key of a list item follows its dash
+		if j != 0 || !strings.HasSuffix(b.String(), "- ") {
+			b.WriteString(strings.Repeat(" ", indent))
+		}
+		b.WriteString(f.key + ":")
+		writeYamlValue(b, f.value, indent)
+	}
+}
+
+func writeYamlValue(b *strings.Builder, n *node, indent int) {
+	switch {
+	case n.kind == scalarNode:
+		b.WriteString(" " + yamlScalar(n) + "\n")
+	case n.kind == mappingNode && len(n.fields) == 0:
+		b.WriteString(" {}\n")
+	case n.kind == mappingNode:
+		b.WriteString("\n")
+		writeYamlMapping(b, n, indent+2)
+	case len(n.items) == 0:
+		b.WriteString(" []\n")
+	case n.items[0].kind == scalarNode:
+		a := make([]string, 0, len(n.items))
+		for _, item := range n.items {
+			a = append(a, yamlScalar(item))
+		}
+		b.WriteString(" [" + strings.Join(a, ", ") + "]\n")
+	default:
+		b.WriteString("\n")
+		for _, item := range n.items {
+			b.WriteString(strings.Repeat(" ", indent+2) + "- ")
+			writeYamlMapping(b, item, indent+4)
+		}
+	}
+}
+
+func yamlScalar(n *node) string {
+	if !n.string || (yamlPlain.MatchString(n.text) && !yamlReserved.MatchString(n.text)) {
+		return n.text
+	}
+	return strconv.Quote(n.text)
+}
+
+func parseYaml(bytes []byte) (*node, error) {
+	p := &yamlParser{}
+	for j, text := range strings.Split(string(bytes), "\n") {
+		text = strings.TrimRight(stripComment(strings.TrimRight(text, "\r")), " \t")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" || trimmed == "..." {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, configError(j+1, "tabs can't be used for indentation")
+		}
+		p.lines = append(p.lines, yamlLine{number: j + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	if len(p.lines) == 0 {
+		return &node{kind: mappingNode, line: 1}, nil
+	}
+	n, err := p.block(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.next < len(p.lines) {
+		return nil, configError(p.lines[p.next].number, "unexpected indentation")
+	}
+	return n, nil
+}
+
+// block parses the mapping or list starting at the next line, which is
+// indented by indent.
+func (p *yamlParser) block(indent int) (*node, error) {
+	line := p.lines[p.next]
+	if isYamlItem(line.text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) sequence(indent int) (*node, error) {
+	n := &node{kind: sequenceNode, line: p.lines[p.next].number}
+	for p.next < len(p.lines) && p.lines[p.next].indent == indent && isYamlItem(p.lines[p.next].text) {
+		line := p.lines[p.next]
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if rest == "" {
+			p.next++
+			item, err := p.child(line, indent)
+			if err != nil {
+				return nil, err
+			}
+			n.items = append(n.items, item)
+			continue
+		}
+		if _, _, ok := splitYamlKey(rest); ok || isYamlItem(rest) {
+			// the item is a block starting after the dash, read it as if
+			// it started on a line of its own
+			p.lines[p.next] = yamlLine{number: line.number, indent: line.indent + len(line.text) - len(rest), text: rest}
+			item, err := p.block(p.lines[p.next].indent)
+			if err != nil {
+				return nil, err
+			}
+			n.items = append(n.items, item)
+			continue
+		}
+		item, err := yamlValue(rest, line.number)
+		if err != nil {
+			return nil, err
+		}
+		n.items = append(n.items, item)
+		p.next++
+	}
+	return n, nil
+}
+
+func (p *yamlParser) mapping(indent int) (*node, error) {
+	n := &node{kind: mappingNode, line: p.lines[p.next].number}
+	for p.next < len(p.lines) && p.lines[p.next].indent == indent && !isYamlItem(p.lines[p.next].text) {
+		line := p.lines[p.next]
+		key, rest, ok := splitYamlKey(line.text)
+		if !ok {
+			return nil, configError(line.number, "expected a key: value, got %q", line.text)
+		}
+		if n.get(key) != nil {
+			return nil, configError(line.number, "duplicate key %q", key)
+		}
+		p.next++
+
+		var value *node
+		var err error
+		if rest == "" {
+			value, err = p.child(line, indent)
+		} else {
+			value, err = yamlValue(rest, line.number)
+		}
+		if err != nil {
+			return nil, err
+		}
+		n.fields = append(n.fields, field{key: key, value: value})
+	}
+	return n, nil
+}
+
+// child parses the block under parent, which may be a list at the same
+// indentation as a mapping key, or null if there is none.
+func (p *yamlParser) child(parent yamlLine, indent int) (*node, error) {
+	if p.next < len(p.lines) {
+		next := p.lines[p.next]
+		if next.indent > indent || (next.indent == indent && isYamlItem(next.text) && !isYamlItem(parent.text)) {
+			n, err := p.block(next.indent)
+			if err != nil {
+				return nil, err
+			}
+			n.line = parent.number
+			return n, nil
+		}
+	}
+	return &node{kind: scalarNode, line: parent.number, null: true}, nil
+}
+
+func isYamlItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitYamlKey splits "key: value" outside of quotes.
+func splitYamlKey(text string) (string, string, bool) {
+	var quote byte
+	for j := 0; j < len(text); j++ {
+		switch {
+		case quote != 0:
+			if text[j] == quote {
+				quote = 0
+			} else if text[j] == '\\' && quote == '"' {
+				j++
+			}
+		case j == 0 && (text[j] == '"' || text[j] == '\''):
+			quote = text[j]
+		case text[j] == ':' && (j+1 == len(text) || text[j+1] == ' '):
+			key := strings.TrimSpace(text[:j])
+			if unquoted, err := yamlUnquote(key); err == nil {
+				key = unquoted
+			}
+			return key, strings.TrimSpace(text[j+1:]), key != ""
+		}
+	}
+	return "", "", false
+}
+
+func yamlValue(text string, line int) (*node, error) {
+	switch {
+	case text == "[]":
+		return &node{kind: sequenceNode, line: line}, nil
+	case text == "{}":
+		return &node{kind: mappingNode, line: line}, nil
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, configError(line, "unterminated list %q", text)
+		}
+		n := &node{kind: sequenceNode, line: line}
+		for _, item := range splitFlow(text[1 : len(text)-1]) {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			scalar, err := yamlValue(item, line)
+			if err != nil {
+				return nil, err
+			}
+			if scalar.kind != scalarNode {
+				return nil, configError(line, "nested lists are not supported")
+			}
+			n.items = append(n.items, scalar)
+		}
+		return n, nil
+	case strings.ContainsAny(text[:1], "{&*!|>%@`"):
+		return nil, configError(line, "unsupported yaml %q", text)
+	}
+	unquoted, err := yamlUnquote(text)
+	if err != nil {
+		return nil, configError(line, "%v in %s", err, text)
+	}
+	n := &node{kind: scalarNode, line: line, text: unquoted, string: unquoted != text}
+	n.null = !n.string && (text == "~" || strings.EqualFold(text, "null"))
+	return n, nil
+}
+
+// yamlUnquote removes the quotes around a quoted scalar, plain scalars are
+// returned as they are.
+func yamlUnquote(text string) (string, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		return strconv.Unquote(text)
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return "", strconv.ErrSyntax
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	}
+	return text, nil
+}
+
+// splitFlow splits the items of a flow list on commas outside of quotes.
+func splitFlow(text string) []string {
+	items := make([]string, 0, 0)
+	var quote byte
+	start := 0
+	for j := 0; j < len(text); j++ {
+		switch {
+		case quote != 0:
+			if text[j] == quote {
+				quote = 0
+			} else if text[j] == '\\' && quote == '"' {
+				j++
+			}
+		case text[j] == '"' || text[j] == '\'':
+			quote = text[j]
+		case text[j] == ',':
+			items = append(items, text[start:j])
+			start = j + 1
+		}
+	}
+	return append(items, text[start:])
+}
+
+// stripComment removes a # comment that is outside of quotes and starts the
+// line or follows a space. It is shared with the toml reader.
+func stripComment(text string) string {
+	var quote byte
+	for j := 0; j < len(text); j++ {
+		switch {
+		case quote != 0:
+			if text[j] == quote {
+				quote = 0
+			} else if text[j] == '\\' && quote == '"' {
+				j++
+			}
+		case text[j] == '"' || text[j] == '\'':
+			quote = text[j]
+		case text[j] == '#' && (j == 0 || text[j-1] == ' ' || text[j-1] == '\t'):
+			return text[:j]
+		}
+	}
+	return text
+}
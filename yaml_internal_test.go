@@ -0,0 +1,138 @@
+// Copyright (c) 2016 Pagoda Box Inc
+//
+// This Source Code Form is subject to the terms of the Mozilla Public License, v.
+// 2.0. If a copy of the MPL was not distributed with this file, You can obtain one
+// at http://mozilla.org/MPL/2.0/.
+//
+package lvs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIpvsYaml(test *testing.T) {
+	ipvs := Ipvs{MulticastInterface: "eth1", Syncid: 4, Tcp: 900, Tcpfin: 120, Udp: 300, Services: testServices}
+	out, err := ipvs.ToYaml()
+	if err != nil {
+		test.Fatal(err)
+	}
+	for _, line := range []string{"version: 1\n", "mcast_interface: eth1\n", "tcp_fin_timeout: 120\n", "services:\n  - host: ", "    servers:\n      - host: "} {
+		if !strings.Contains(string(out), line) {
+			test.Errorf("expected %q in\n%s", line, out)
+		}
+	}
+
+	decoded := Ipvs{}
+	if err := decoded.FromYaml(out); err != nil {
+		test.Fatal(err)
+	}
+	if !decoded.Equal(ipvs) || decoded.MulticastInterface != "eth1" || decoded.Tcpfin != 120 {
+		test.Errorf("yaml did not round trip: %s\n%s", decoded.Diff(ipvs), out)
+	}
+	if decoded.FindService("udp", "10.0.0.1", 53) == nil {
+		test.Error("decoded services should be indexed")
+	}
+
+	empty, _ := Ipvs{}.ToYaml()
+	if !strings.Contains(string(empty), "services: []\n") {
+		test.Errorf("unexpected empty document\n%s", empty)
+	}
+}
+
+func TestYamlExample(test *testing.T) {
+	bytes, err := os.ReadFile("testdata/ipvs.yaml")
+	if err != nil {
+		test.Fatal(err)
+	}
+	ipvs := Ipvs{}
+	if err := ipvs.FromYaml(bytes); err != nil {
+		test.Fatal(err)
+	}
+	if ipvs.MulticastInterface != "eth1" || ipvs.Syncid != 4 || len(ipvs.Services) != 2 {
+		test.Fatalf("example decoded as %+v", ipvs)
+	}
+	web := ipvs.FindService("tcp", "192.168.0.10", 80)
+	if web == nil || len(web.Servers) != 2 || web.Servers[0].Weight != 2 || web.Persistence != 300 {
+		test.Errorf("web service decoded as %+v", web)
+	}
+	dns := ipvs.FindService("udp", "192.168.0.10", 53)
+	if dns == nil || len(dns.SchedulerFlags) != 1 || dns.SchedulerFlags[0] != "flag-1" || dns.Netmask != "" {
+		test.Errorf("dns service decoded as %+v", dns)
+	}
+
+	// the example is the same document the toml example describes
+	toml, err := os.ReadFile("testdata/ipvs.toml")
+	if err != nil {
+		test.Fatal(err)
+	}
+	other := Ipvs{}
+	if err := other.FromToml(toml); err != nil {
+		test.Fatal(err)
+	}
+	if !other.Equal(ipvs) {
+		test.Errorf("examples differ: %s", other.Diff(ipvs))
+	}
+}
+
+func TestServiceYaml(test *testing.T) {
+	service := testServices[0].Clone()
+	service.Servers[0].Host = "::1"
+	service.Servers[0].TunnelType = "gue"
+	out, err := service.ToYaml()
+	if err != nil {
+		test.Fatal(err)
+	}
+	decoded := Service{}
+	if err := decoded.FromYaml(out); err != nil {
+		test.Fatal(err)
+	}
+	if !decoded.Equal(service) {
+		test.Errorf("service did not round trip\n%s", out)
+	}
+
+	server := Server{}
+	if err := server.FromYaml([]byte("host: '10.0.0.1'\nport: 8_080 # the admin port\nweight: ~\nforwarder: \"i\"\ntunnel_type: gue\n")); err != nil {
+		test.Fatal(err)
+	}
+	if server.Host != "10.0.0.1" || server.Port != 8080 || server.Forwarder != "i" || server.TunnelType != "gue" {
+		test.Errorf("server decoded as %+v", server)
+	}
+	out, _ = server.ToYaml()
+	if !strings.HasPrefix(string(out), "host: 10.0.0.1\nport: 8080\n") {
+		test.Errorf("unexpected server yaml\n%s", out)
+	}
+
+	// strings that would read back as something else are quoted
+	quoted, _ := Server{Host: "10.0.0.1", Forwarder: "g", TunnelType: "true"}.ToYaml()
+	if !strings.Contains(string(quoted), `tunnel_type: "true"`) {
+		test.Errorf("expected a quoted tunnel type\n%s", quoted)
+	}
+}
+
+func TestYamlErrors(test *testing.T) {
+	tests := []struct {
+		yaml string
+		line int
+		want string
+	}{
+		{"version: 1\nservices:\n  - host: 10.0.0.1\n    prot: 80\n", 4, `unknown field "prot"`},
+		{"syncid: 4\ntcp_timeout: soon\n", 2, `invalid number "soon"`},
+		{"syncid: 4\nsyncid: 5\n", 2, `duplicate key "syncid"`},
+		{"services:\n\t- host: 10.0.0.1\n", 2, "tabs"},
+		{"services: {host: 10.0.0.1}\n", 1, "unsupported"},
+		{"syncid: 4\n  udp_fin_timeout: 5\n", 2, "indentation"},
+		{"services: 4\n", 1, "expected a list"},
+		{"# comment\nversion: 2\n", 2, "Unsupported Json Version"},
+	}
+	for _, tt := range tests {
+		ipvs := Ipvs{}
+		err := ipvs.FromYaml([]byte(tt.yaml))
+		configErr := &ConfigError{}
+		if !errors.As(err, &configErr) || configErr.Line != tt.line || !strings.Contains(err.Error(), tt.want) {
+			test.Errorf("%q: expected %q on line %d, got %v", tt.yaml, tt.want, tt.line, err)
+		}
+	}
+}